@@ -0,0 +1,264 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArgType is the type of a command argument
+type ArgType int
+
+// Types of the command arguments
+const (
+	ArgString   ArgType = iota // A word, or a quoted string ("several words")
+	ArgInt                     // An integer
+	ArgDuration                // A duration ("90s", "1h30m")
+)
+
+// Arg structure that describes a positional argument of a command
+type Arg struct {
+	Name     string
+	Type     ArgType
+	Optional bool // The argument can be omitted, the following arguments must be optional too
+	Rest     bool // The argument takes the rest of the line, it must be the last one
+}
+
+// Flag structure that describes a boolean option of a command, given anywhere on the line as "--name"
+type Flag struct {
+	Name string
+}
+
+// Arguments contains the arguments of a command, parsed according to Command.Args and Command.Flags
+type Arguments struct {
+	values map[string]interface{}
+	flags  map[string]bool
+}
+
+// String returns the value of a string argument, empty if it was omitted
+func (args Arguments) String(name string) string {
+	value, _ := args.values[name].(string)
+	return value
+}
+
+// Int returns the value of an integer argument, 0 if it was omitted
+func (args Arguments) Int(name string) int {
+	value, _ := args.values[name].(int)
+	return value
+}
+
+// Duration returns the value of a duration argument, 0 if it was omitted
+func (args Arguments) Duration(name string) time.Duration {
+	value, _ := args.values[name].(time.Duration)
+	return value
+}
+
+// Has checks if an optional argument was given
+func (args Arguments) Has(name string) bool {
+	_, present := args.values[name]
+	return present
+}
+
+// Flag checks if a flag was given
+func (args Arguments) Flag(name string) bool {
+	return args.flags[name]
+}
+
+// token is a word of a command line, or a quoted string
+type token struct {
+	value  string // Unquoted value
+	raw    string // Value as typed
+	quoted bool
+}
+
+// nextToken returns the first word of the command line starting at i, a quoted string being a single word,
+// and the position following it. ok is false if there is no word left.
+// In a quoted string, \" is a quote and \\ a backslash.
+func nextToken(line string, i int) (word token, next int, ok bool, err error) {
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	if i == len(line) {
+		return token{}, i, false, nil
+	}
+	start := i
+	if line[i] != '"' {
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		return token{value: line[start:i], raw: line[start:i]}, i, true, nil
+	}
+	var value []byte
+	for i++; i < len(line) && line[i] != '"'; i++ {
+		if line[i] == '\\' && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\') {
+			i++
+		}
+		value = append(value, line[i])
+	}
+	if i == len(line) {
+		return token{}, i, false, errors.New("unterminated quoted string")
+	}
+	i++
+	return token{value: string(value), raw: line[start:i], quoted: true}, i, true, nil
+}
+
+// hasSpec checks if the command declares its arguments, the command lines of the other commands are not parsed
+func (cmd *Command) hasSpec() bool {
+	return len(cmd.Args) != 0 || len(cmd.Flags) != 0
+}
+
+// Parse parses the arguments of a command line ("memo bob hi"), the first word being the trigger.
+// A Rest argument takes the rest of the line as typed, quotes and spacing included, only the flags around it are removed.
+func (cmd *Command) Parse(line string) (args Arguments, err error) {
+	args = Arguments{values: make(map[string]interface{}), flags: make(map[string]bool)}
+	_, i, ok, err := nextToken(line, 0)
+	if err != nil || !ok {
+		return args, err
+	}
+
+	for _, arg := range cmd.Args {
+		var text string
+		if arg.Rest {
+			text, i = cmd.restOfLine(line[i:], args.flags), len(line)
+			ok = text != ""
+		} else {
+			var word token
+			if word, i, ok, err = cmd.nextWord(line, i, args.flags); err != nil {
+				return args, err
+			}
+			text = word.value
+		}
+		if !ok {
+			if !arg.Optional {
+				return args, fmt.Errorf("missing argument <%s>", arg.Name)
+			}
+			break
+		}
+		if args.values[arg.Name], err = arg.convert(text); err != nil {
+			return args, err
+		}
+	}
+
+	word, _, ok, err := cmd.nextWord(line, i, args.flags)
+	if err != nil {
+		return args, err
+	}
+	if ok {
+		return args, fmt.Errorf("too many arguments (%q)", word.raw)
+	}
+	return args, nil
+}
+
+// nextWord returns the first word of the command line starting at i which is not a flag, and the position following it.
+// The flags can be anywhere on the line, the ones met on the way are set in flags.
+func (cmd *Command) nextWord(line string, i int, flags map[string]bool) (word token, next int, ok bool, err error) {
+	for {
+		if word, i, ok, err = nextToken(line, i); err != nil || !ok {
+			return word, i, ok, err
+		}
+		flag := cmd.flagOf(word)
+		if flag == "" {
+			return word, i, true, nil
+		}
+		flags[flag] = true
+	}
+}
+
+// restOfLine returns the text of a Rest argument: the rest of the line as typed, without the flags starting and ending it,
+// which are set in flags
+func (cmd *Command) restOfLine(rest string, flags map[string]bool) string {
+	for {
+		word, next, ok, err := nextToken(rest, 0)
+		flag := cmd.flagOf(word)
+		if err != nil || !ok || flag == "" {
+			break
+		}
+		flags[flag] = true
+		rest = rest[next:]
+	}
+	rest = strings.Trim(rest, " \t")
+	for rest != "" {
+		i := strings.LastIndexAny(rest, " \t")
+		flag := cmd.flagOf(token{value: rest[i+1:]})
+		if flag == "" {
+			break
+		}
+		flags[flag] = true
+		rest = strings.Trim(rest[:i+1], " \t")
+	}
+	return rest
+}
+
+// flagOf returns the name of the command's flag given by a word of the command line, empty if the word is not a flag
+func (cmd *Command) flagOf(word token) string {
+	if word.quoted || !strings.HasPrefix(word.value, "--") {
+		return ""
+	}
+	return cmd.flag(strings.TrimPrefix(word.value, "--"))
+}
+
+// flag returns the name of the command's flag matching name, empty if the command has no such flag
+func (cmd *Command) flag(name string) string {
+	for _, flag := range cmd.Flags {
+		if strings.EqualFold(flag.Name, name) {
+			return flag.Name
+		}
+	}
+	return ""
+}
+
+// convert converts the text of an argument to its type
+func (arg Arg) convert(text string) (interface{}, error) {
+	switch arg.Type {
+	case ArgInt:
+		value, err := strconv.Atoi(text)
+		if err != nil {
+			return nil, fmt.Errorf("<%s> must be a number, not %q", arg.Name, text)
+		}
+		return value, nil
+	case ArgDuration:
+		value, err := time.ParseDuration(text)
+		if err != nil {
+			return nil, fmt.Errorf("<%s> must be a duration like 90s or 1h30m, not %q", arg.Name, text)
+		}
+		return value, nil
+	}
+	return text, nil
+}
+
+// Usage returns the arguments and the flags of the command as shown in the usage messages ("<nick> [<message>] [--flag]")
+func (cmd *Command) Usage() string {
+	var parts []string
+	for _, arg := range cmd.Args {
+		part := "<" + arg.Name + ">"
+		if arg.Rest {
+			part = "<" + arg.Name + "...>"
+		}
+		if arg.Optional {
+			part = "[" + part + "]"
+		}
+		parts = append(parts, part)
+	}
+	for _, flag := range cmd.Flags {
+		parts = append(parts, "[--"+flag.Name+"]")
+	}
+	return strings.Join(parts, " ")
+}
+
+// replyUsage tells the user why the command line is invalid, and how to use the command
+func (bot *Bot) replyUsage(event *Event, cmd *Command, err error, callback func(*ReplyCallbackData)) {
+	if callback == nil {
+		return
+	}
+	callback(&ReplyCallbackData{
+		Message: strings.TrimSpace(fmt.Sprintf("Invalid command: %s. Usage: %s %s", err, bot.trigger(event), cmd.Usage())),
+		Target:  GetTargetFromEvent(event)})
+}
@@ -0,0 +1,108 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_nextToken(t *testing.T) {
+	line := ` memo  "two words" "say \"hi\"" back\slash "" `
+	var values []string
+	for i := 0; ; {
+		word, next, ok, err := nextToken(line, i)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !ok {
+			break
+		}
+		values, i = append(values, word.value), next
+	}
+	if expected := []string{"memo", "two words", `say "hi"`, `back\slash`, ""}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("Unexpected tokens: %q instead of %q", values, expected)
+	}
+	if _, _, _, err := nextToken(`memo "unterminated`, 4); err == nil {
+		t.Error("No error for an unterminated quoted string")
+	}
+}
+
+func Test_Parse(t *testing.T) {
+	cmd := &Command{
+		Triggers: []string{"remind"},
+		Args: []Arg{
+			{Name: "nick"},
+			{Name: "delay", Type: ArgDuration},
+			{Name: "count", Type: ArgInt, Optional: true},
+			{Name: "message", Optional: true, Rest: true}},
+		Flags: []Flag{{Name: "private"}}}
+
+	args, err := cmd.Parse(`remind bob 1h30m 2 buy  "some" milk --PRIVATE`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if args.String("nick") != "bob" || args.Duration("delay") != 90*time.Minute || args.Int("count") != 2 {
+		t.Errorf("Unexpected arguments: %#v", args)
+	}
+	if message := args.String("message"); message != `buy  "some" milk` {
+		t.Errorf("Unexpected rest of the line: %q", message)
+	}
+	if !args.Flag("private") {
+		t.Error("Flag not set")
+	}
+
+	args, err = cmd.Parse(`remind "bob" 5m`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if args.String("nick") != "bob" || args.Has("count") || args.Has("message") || args.Flag("private") {
+		t.Errorf("Unexpected arguments: %#v", args)
+	}
+
+	// The rest of the line is kept as typed
+	for line, expected := range map[string]string{
+		`remind bob 5m 1 "a single quoted message"`: `"a single quoted message"`,
+		`remind bob 5m 1 he said "hi --private`:     `he said "hi`,
+		"remind bob 5m 1  keep   the\tspacing  ":    "keep   the\tspacing",
+		"remind bob 5m 1 --private --loud word":     "--loud word",
+	} {
+		if args, err = cmd.Parse(line); err != nil || args.String("message") != expected {
+			t.Errorf("Unexpected rest of the line for %q: %q (%v) instead of %q", line, args.String("message"), err, expected)
+		}
+	}
+
+	for line, expected := range map[string]string{
+		"remind":               "missing argument <nick>",
+		"remind bob":           "missing argument <delay>",
+		"remind bob soon":      `<delay> must be a duration like 90s or 1h30m, not "soon"`,
+		"remind bob 5m twice":  `<count> must be a number, not "twice"`,
+		`remind bob "5m`:       "unterminated quoted string",
+		"remind bob 5m --loud": `<count> must be a number, not "--loud"`,
+	} {
+		if _, err := cmd.Parse(line); err == nil || err.Error() != expected {
+			t.Errorf("Unexpected error for %q: %v instead of %q", line, err, expected)
+		}
+	}
+
+	cmd = &Command{Triggers: []string{"revoke"}, Args: []Arg{{Name: "mask"}}}
+	if _, err := cmd.Parse("revoke bob alice"); err == nil || err.Error() != `too many arguments ("alice")` {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func Test_Usage(t *testing.T) {
+	cmd := &Command{
+		Args:  []Arg{{Name: "url"}, {Name: "tag", Rest: true}, {Name: "comment", Optional: true}},
+		Flags: []Flag{{Name: "nsfw"}}}
+	if usage := cmd.Usage(); usage != "<url> <tag...> [<comment>] [--nsfw]" {
+		t.Errorf("Unexpected usage: %q", usage)
+	}
+	if usage := (&Command{}).Usage(); usage != "" {
+		t.Errorf("Unexpected usage: %q", usage)
+	}
+}
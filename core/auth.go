@@ -0,0 +1,170 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Authentication methods
+const (
+	AuthSASLPlain    = "sasl_plain"    // SASL PLAIN, with a NickServ IDENTIFY fallback if the server does not support SASL
+	AuthSASLExternal = "sasl_external" // SASL EXTERNAL with a TLS client certificate, with a NickServ IDENTIFY fallback if a password is set
+	AuthNickServ     = "nickserv"      // NickServ IDENTIFY once connected
+)
+
+// Maximum time to wait for NickServ to confirm the identification before joining the channels anyway
+var authTimeout = 30 * time.Second
+
+// Authentication structure that contains the informations used to log the bot in its account
+type Authentication struct {
+	Method   string // AuthSASLPlain, AuthSASLExternal, AuthNickServ, or empty for no authentication
+	Account  string // Account name, the bot's nick is used if empty
+	Password string // Not needed for SASL EXTERNAL
+	CertFile string // Client certificate (PEM), for SASL EXTERNAL
+	KeyFile  string // Private key of the client certificate (PEM), for SASL EXTERNAL
+}
+
+// Check checks that the informations needed by the authentication method are set
+func (auth Authentication) Check() error {
+	switch auth.Method {
+	case "":
+		return nil
+	case AuthSASLPlain, AuthNickServ:
+		if auth.Password == "" {
+			return fmt.Errorf("the %q authentication needs a password", auth.Method)
+		}
+	case AuthSASLExternal:
+		if auth.CertFile == "" || auth.KeyFile == "" {
+			return fmt.Errorf("the %q authentication needs a client certificate and its key", auth.Method)
+		}
+	default:
+		return fmt.Errorf("unknown authentication method %q", auth.Method)
+	}
+	return nil
+}
+
+// isSASL checks if the authentication is done with SASL
+func (auth Authentication) isSASL() bool {
+	return auth.Method == AuthSASLPlain || auth.Method == AuthSASLExternal
+}
+
+// account returns the account name to use for the authentication
+func (auth Authentication) account(nick string) string {
+	if auth.Account != "" {
+		return auth.Account
+	}
+	return nick
+}
+
+// addAuthCallbacks adds the callbacks authenticating the bot, the channels are joined once the bot is logged in
+func (bot *Bot) addAuthCallbacks() {
+	// RPL_WELCOME: SASL, if used, is over
+	bot.addCallback("001", func(event *Event) {
+		auth := bot.network.Auth
+		bot.authMutex.Lock()
+		bot.registered = true
+		loggedIn := bot.loggedIn
+		bot.authMutex.Unlock()
+
+		switch {
+		case auth.Method == "" || loggedIn:
+			bot.joinChannels()
+		case auth.Password != "":
+			if auth.isSASL() {
+				log.Printf("SASL authentication unavailable on network %q, trying NickServ\n", bot.network.Name)
+			}
+			bot.transport.Privmsg("NickServ", "IDENTIFY "+auth.account(bot.network.Nick)+" "+auth.Password)
+			bot.authMutex.Lock()
+			bot.authTimer = time.AfterFunc(authTimeout, func() {
+				log.Printf("No answer from NickServ on network %q, joining the channels without being identified\n", bot.network.Name)
+				bot.joinChannels()
+			})
+			bot.authMutex.Unlock()
+		default:
+			log.Printf("Authentication failed on network %q, joining the channels without being identified\n", bot.network.Name)
+			bot.joinChannels()
+		}
+	})
+
+	// RPL_LOGGEDIN, sent after a successful SASL authentication or NickServ identification
+	bot.addCallback("900", func(event *Event) {
+		bot.setLoggedIn()
+	})
+
+	// RPL_SASLSUCCESS
+	bot.addCallback("903", func(event *Event) {
+		log.Printf("SASL authentication successful on network %q\n", bot.network.Name)
+		bot.setLoggedIn()
+	})
+
+	// ERR_SASLFAIL and ERR_SASLTOOLONG
+	for _, code := range []string{"904", "905"} {
+		bot.addCallback(code, func(event *Event) {
+			log.Printf("SASL authentication failed on network %q: %s\n", bot.network.Name, event.Message())
+		})
+	}
+
+	// Not every NickServ sends RPL_LOGGEDIN, so its notices are also checked
+	bot.addCallback("NOTICE", func(event *Event) {
+		if bot.fold(event.Nick) != bot.fold("NickServ") || bot.network.Auth.Method == "" {
+			return
+		}
+		message := strings.ToLower(event.Message())
+		switch {
+		case strings.Contains(message, "you are now identified"), strings.Contains(message, "you are now logged in"):
+			bot.setLoggedIn()
+		case strings.Contains(message, "invalid password"), strings.Contains(message, "incorrect password"):
+			log.Printf("NickServ identification failed on network %q: %s\n", bot.network.Name, event.Message())
+			bot.joinChannels()
+		}
+	})
+}
+
+// setLoggedIn marks the bot as logged in, and joins the channels if the registration is complete
+func (bot *Bot) setLoggedIn() {
+	bot.authMutex.Lock()
+	bot.loggedIn = true
+	registered := bot.registered
+	bot.authMutex.Unlock()
+	if registered {
+		bot.joinChannels()
+	}
+}
+
+// joinChannels joins the bot's channels, only once per connection
+func (bot *Bot) joinChannels() {
+	bot.authMutex.Lock()
+	if bot.joined {
+		bot.authMutex.Unlock()
+		return
+	}
+	bot.joined = true
+	if bot.authTimer != nil {
+		bot.authTimer.Stop()
+		bot.authTimer = nil
+	}
+	bot.authMutex.Unlock()
+
+	for _, channel := range bot.network.Channels {
+		bot.transport.Join(channel.Name, channel.Key)
+	}
+}
+
+// resetAuth resets the authentication state before a new connection
+func (bot *Bot) resetAuth() {
+	bot.authMutex.Lock()
+	defer bot.authMutex.Unlock()
+	bot.registered, bot.loggedIn, bot.joined = false, false, false
+	if bot.authTimer != nil {
+		bot.authTimer.Stop()
+		bot.authTimer = nil
+	}
+}
@@ -0,0 +1,31 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"testing"
+)
+
+func Test_AuthenticationCheck(t *testing.T) {
+	tests := []struct {
+		auth  Authentication
+		valid bool
+	}{
+		{Authentication{}, true},
+		{Authentication{Method: AuthSASLPlain, Password: "secret"}, true},
+		{Authentication{Method: AuthSASLPlain}, false},
+		{Authentication{Method: AuthNickServ, Account: "account", Password: "secret"}, true},
+		{Authentication{Method: AuthNickServ}, false},
+		{Authentication{Method: AuthSASLExternal, CertFile: "bot.crt", KeyFile: "bot.key"}, true},
+		{Authentication{Method: AuthSASLExternal, CertFile: "bot.crt"}, false},
+		{Authentication{Method: "kerberos", Password: "secret"}, false},
+	}
+	for _, test := range tests {
+		if err := test.auth.Check(); (err == nil) != test.valid {
+			t.Errorf("Unexpected result for %#v: %v", test.auth, err)
+		}
+	}
+}
@@ -8,190 +8,577 @@
 package core
 
 import (
-	"github.com/emirozer/go-helpers"
-	"github.com/thoj/go-ircevent"
-	// "log"
+	"github.com/vaz-ar/goxxx/core/format"
+	"log"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
-	updateUserListDone = make(chan bool, 1)
+	// Bots indexed by their network name, used to retrieve the bot from an event
+	bots      = make(map[string]*Bot)
+	botsMutex sync.RWMutex
 )
 
 // Bot structure that contains connection informations, IRC connection, command handlers and message handlers
 type Bot struct {
-	nick              string
-	server            string
-	channel           string
-	channelKey        string
-	Admins            *[]string
-	users             []string
-	ircConn           *irc.Connection
-	msgHandlers       []func(*irc.Event, func(*ReplyCallbackData))
-	msgReplyCallbacks []func(*ReplyCallbackData)
-	cmdHandlers       map[string]func(*irc.Event, func(*ReplyCallbackData)) bool
-	cmdReplyCallbacks map[string]func(*ReplyCallbackData)
-	lastReplyTime     time.Time
+	network          Network
+	channels         map[string]channelMembers // Members of the channels the bot is in, by folded channel name
+	pendingNames     map[string]channelMembers // Members received in RPL_NAMREPLY, waiting for RPL_ENDOFNAMES
+	prefixModes      string                    // Membership modes supported by the server, from the highest to the lowest
+	prefixSymbols    string                    // Prefixes of the membership modes in the NAMES replies
+	chanModes        string                    // Channel modes by type, as in RPL_ISUPPORT CHANMODES
+	mapping          int32                     // Case mapping of the network, as in RPL_ISUPPORT CASEMAPPING, accessed atomically
+	usersMutex       sync.RWMutex              // Protects channels, pendingNames, prefixModes, prefixSymbols and chanModes
+	transport        Transport
+	callbacks        map[string][]func(*Event) // Internal callbacks by event code
+	msgHandlers      []msgHandler
+	commands         map[string]*command // Commands by trigger
+	subscriptions    map[EventKind][]subscription
+	handlersMutex    sync.RWMutex // Protects msgHandlers, commands, subscriptions and modules, which can change while the bot runs
+	queue            *outQueue
+	lastGroups       map[string]*replyGroup // Reply group of the last command invocation, by target, nick and command
+	lastGroupsMutex  sync.Mutex
+	self             Event // Nick, user name and host of the bot, as seen by the server
+	selfMutex        sync.RWMutex
+	pages            map[string]*page // Results not yet displayed, by target and nick
+	pagesMutex       sync.Mutex
+	modules          []string // Names of the loaded modules
+	registered       bool     // RPL_WELCOME received on the current connection
+	loggedIn         bool     // Logged in the bot's account on the current connection
+	joined           bool     // Channels joined on the current connection
+	authTimer        *time.Timer
+	authMutex        sync.Mutex // Protects registered, loggedIn, joined and authTimer
+	status           ConnectionStatus
+	connections      int // Number of successful connections
+	failures         int // Number of failed connection attempts since the last successful connection
+	reclaimTimer     *time.Timer
+	statusMutex      sync.Mutex   // Protects status, connections, failures and reclaimTimer
+	workers          *workerPool  // Runs the command handlers, the message handlers and the subscribed handlers
+	limiter          *rateLimiter // Limits the number of commands run by each user
+	ignores          []ignore     // Ignore list of the network, loaded from the database when the bot starts
+	ignoresMutex     sync.RWMutex
+	permissions      []permission // Roles granted on the network, loaded from the database when the bot starts
+	permissionsMutex sync.RWMutex
+	lastCTCP         time.Time // Time of the last answer to a CTCP query
+	ctcpMutex        sync.Mutex
+	stop             chan struct{} // Closed when the bot stops, interrupts the reconnection
+	stopOnce         sync.Once
+}
+
+// msgHandler structure that contains a message handler, its reply callback and the module that added it
+type msgHandler struct {
+	handler Handler
+	reply   func(*ReplyCallbackData)
+	module  string
+}
+
+// command structure that contains a command, its reply callback and the module that added it
+type command struct {
+	*Command
+	reply  func(*ReplyCallbackData)
+	module string
+}
+
+// Network structure that contains the informations needed to connect to an IRC network
+type Network struct {
+	Name        string         // Name of the network, used to identify the network in the database
+	Server      string         // IRC_SERVER[:PORT]
+	UseTLS      bool           // Use a TLS connection
+	Nick        string         // Nick of the bot on this network
+	Channels    []Channel      // Channels to join
+	FloodBurst  int            // Number of lines that can be sent at once (optional)
+	FloodRate   time.Duration  // Minimal delay between two lines once the burst is spent (optional)
+	PageSize    int            // Number of results displayed at once, the others are displayed by the !more command (optional)
+	Owners      []string       // Masks of the bot's owners, see MatchMask (optional)
+	Auth        Authentication // Authentication of the bot (optional)
+	Prefix      string         // Prefix of the commands, "!" if empty (optional)
+	QuitMessage string         // Message sent with the QUIT command when the bot stops (optional)
+	PlainText   bool           // Strip the formatting (bold, colors, ...) from the messages sent, for the networks refusing it (optional)
+
+	ReconnectMinDelay time.Duration // Delay before reconnecting after losing the connection, doubled after each failed attempt (optional)
+	ReconnectMaxDelay time.Duration // Maximal delay between two connection attempts (optional)
+
+	Workers        int           // Number of handlers running at once (optional)
+	WorkerQueue    int           // Number of handler calls waiting for a worker, the next ones are refused (optional)
+	HandlerTimeout time.Duration // Time given to a handler before its context is cancelled, see Event.Context (optional)
+
+	RateLimit      int           // Number of commands a user can run in RateWindow, no limit if < 0 (optional)
+	RateWindow     time.Duration // Window of the rate limit, a user going over the limit twice in a window is ignored (optional)
+	IgnoreDuration time.Duration // Time a user going over the rate limits is ignored (optional)
+}
+
+// Channel structure that contains the name of a channel to join, its key (optional)
+// and the prefix of the commands on this channel (optional, the network's prefix is used if empty)
+type Channel struct {
+	Name   string
+	Key    string
+	Prefix string
 }
 
 // ReplyCallbackData Structure used by the handlers to send data in a standardized format
 type ReplyCallbackData struct {
-	Message string // Message to send
-	Target  string // Destination target of the message (Channel or Nick)
+	Message  string     // Message to send
+	Results  *ResultSet // Results to send instead of Message, paginated for command replies
+	Target   string     // Destination target of the message (Channel or Nick)
+	Priority bool       // Send the message before the other queued messages
+	Action   bool       // Send the message as a CTCP ACTION (/me)
+	group    uint64     // Set by the bot to identify the command invocation the message replies to
+}
+
+// ResultSet contains the results of a command.
+// The first results are sent, the other ones are kept for the !more command.
+type ResultSet struct {
+	Lines []string
 }
 
 // Command structure
 type Command struct {
 	Module      string
-	HelpMessage string
-	Triggers    []string
-	Handler     func(event *irc.Event, callback func(*ReplyCallbackData)) bool
+	HelpMessage string        // Description of the command, the triggers and the arguments are added by Help
+	Triggers    []string      // Triggers of the command without the prefix ("memo"), see Bot.Prefix
+	Role        Role          // Minimal role needed to run the command, RoleUser by default
+	Args        []Arg         // Positional arguments, parsed into Event.Args before calling the handler (optional)
+	Flags       []Flag        // Flags, parsed into Event.Args before calling the handler (optional)
+	Timeout     time.Duration // Time given to the handler, the network's HandlerTimeout if 0 (optional)
+	Cooldown    time.Duration // Time a user must wait before running the command again, for the expensive commands (optional)
+	Handler     Handler
 }
 
-// NewBot creates a new Bot, sets the required parameters and open the connection to the server.
-func NewBot(nick, server, channel, channelKey string) *Bot {
-	bot := Bot{nick: nick, server: server, channel: channel, channelKey: channelKey, Admins: new([]string)}
+// NewBot creates a new Bot using a go-ircevent transport, and sets the required parameters.
+func NewBot(network Network) *Bot {
+	return NewBotWithTransport(network, NewIRCEventTransport(network))
+}
+
+// NewBotWithTransport creates a new Bot using the given transport, and sets the required parameters.
+func NewBotWithTransport(network Network, transport Transport) *Bot {
+	bot := Bot{
+		network:       network,
+		transport:     transport,
+		callbacks:     make(map[string][]func(*Event)),
+		channels:      make(map[string]channelMembers),
+		pendingNames:  make(map[string]channelMembers),
+		prefixModes:   defaultPrefixModes,
+		prefixSymbols: defaultPrefixSymbols,
+		chanModes:     defaultChanModes,
+		self:          Event{Nick: network.Nick},
+		stop:          make(chan struct{})}
 
-	bot.ircConn = irc.IRC(nick, nick)
-	bot.ircConn.UseTLS = true
-	bot.ircConn.Connect(server)
+	botsMutex.Lock()
+	bots[network.Name] = &bot
+	botsMutex.Unlock()
 
 	//PRIVMSG
-	bot.ircConn.AddCallback("PRIVMSG", bot.mainHandler)
+	bot.addCallback("PRIVMSG", bot.mainHandler)
 
 	// RPL_WELCOME
-	bot.ircConn.AddCallback("001", func(event *irc.Event) {
-		go func(event *irc.Event) {
-			bot.ircConn.Join(channel + " " + channelKey)
-			// Necessary because the callback for RPL_NAMREPLY is called after joining the channel (NAMES command)
-			// If not called here updateUserListDone will always contains a value before being read by UpdateUserList()
-			<-updateUserListDone
-		}(event)
+	bot.addCallback("001", func(event *Event) {
+		// event.Arguments => [nick, message]
+		if len(event.Arguments) != 0 {
+			bot.selfMutex.Lock()
+			bot.self = Event{Nick: event.Arguments[0]}
+			bot.selfMutex.Unlock()
+		}
+	})
+
+	// The channels are joined once the bot is authenticated
+	bot.addAuthCallbacks()
+
+	// The bot reconnects when the connection is lost
+	bot.addReconnectCallbacks()
+
+	// The server echoes our JOIN with our full prefix, which is needed to compute the length available for a message
+	bot.addCallback("JOIN", func(event *Event) {
+		bot.selfMutex.Lock()
+		defer bot.selfMutex.Unlock()
+		if bot.fold(event.Nick) == bot.fold(bot.self.Nick) {
+			bot.self.User = event.User
+			bot.self.Host = event.Host
+		}
 	})
 
-	// RPL_NAMREPLY
-	bot.ircConn.AddCallback("353", func(event *irc.Event) {
-		var (
-			currentAdmins []string
-			currentUsers  []string
-		)
-		for _, user := range strings.Split(event.Message(), " ") {
-			if strings.HasPrefix(user, "@") {
-				currentAdmins = append(currentAdmins, strings.TrimPrefix(user, "@"))
-				currentUsers = append(currentUsers, strings.TrimPrefix(user, "@"))
-			} else {
-				currentUsers = append(currentUsers, user)
-			}
+	bot.addCallback("NICK", func(event *Event) {
+		bot.selfMutex.Lock()
+		defer bot.selfMutex.Unlock()
+		if bot.fold(event.Nick) == bot.fold(bot.self.Nick) {
+			bot.self.Nick = event.Message()
 		}
-		*bot.Admins = currentAdmins
-		bot.users = currentUsers
-		// log.Printf("Current admnistrators: %s", strings.Join(*bot.Admins, ", "))
-		// log.Printf("Current users: %s", strings.Join(bot.users, ", "))
-		updateUserListDone <- true
 	})
 
-	bot.cmdHandlers = make(map[string]func(*irc.Event, func(*ReplyCallbackData)) bool)
-	bot.cmdReplyCallbacks = make(map[string]func(*ReplyCallbackData))
-	bot.lastReplyTime = time.Now()
+	// The members of the channels are tracked from the received events
+	bot.addMembersCallbacks()
+
+	bot.commands = make(map[string]*command)
+	bot.subscriptions = make(map[EventKind][]subscription)
+	bot.lastGroups = make(map[string]*replyGroup)
+	bot.pages = make(map[string]*page)
+	bot.AddCmdHandler(&Command{Triggers: []string{moreTrigger}, Handler: bot.handleMoreCmd}, bot.Reply)
+	bot.AddCmdHandler(&Command{
+		Triggers: []string{"module"},
+		Role:     RoleAdmin,
+		Args:     []Arg{{Name: "action"}, {Name: "module", Optional: true}},
+		Handler:  bot.handleModuleCmd}, bot.Reply)
+	bot.AddCmdHandler(&Command{
+		Triggers: []string{"grant"},
+		Role:     RoleAdmin,
+		Args:     []Arg{{Name: "mask"}, {Name: "role"}},
+		Handler:  bot.handleGrantCmd}, bot.Reply)
+	bot.AddCmdHandler(&Command{
+		Triggers: []string{"revoke"},
+		Role:     RoleAdmin,
+		Args:     []Arg{{Name: "mask"}},
+		Handler:  bot.handleRevokeCmd}, bot.Reply)
+	bot.AddCmdHandler(&Command{
+		Triggers: []string{"ignore"},
+		Role:     RoleAdmin,
+		Args:     []Arg{{Name: "mask", Optional: true}},
+		Handler:  bot.handleIgnoreCmd}, bot.Reply)
+	bot.AddCmdHandler(&Command{
+		Triggers: []string{"unignore"},
+		Role:     RoleAdmin,
+		Args:     []Arg{{Name: "mask"}},
+		Handler:  bot.handleUnignoreCmd}, bot.Reply)
+	bot.queue = newOutQueue(bot.transport.Privmsg, network.FloodBurst, network.FloodRate)
+	bot.workers = newWorkerPool(network.Workers, network.WorkerQueue)
+	bot.limiter = newRateLimiter(network.RateLimit, network.RateWindow, network.IgnoreDuration)
 
 	return &bot
 }
 
+// addCallback adds an internal callback, called for every event with the corresponding code
+func (bot *Bot) addCallback(code string, callback func(*Event)) {
+	bot.callbacks[code] = append(bot.callbacks[code], callback)
+}
+
 // AddMsgHandler adds a message handler to bot.
 // msgProcessCallback will be called on every user message the bot reads (if a command was not found previously in the message).
 // replyCallback is to be called by msgProcessCallback (or not) to yield and process its result as a string message.
-func (bot *Bot) AddMsgHandler(msgProcessCallback func(*irc.Event, func(*ReplyCallbackData)), replyCallback func(*ReplyCallbackData)) {
-	if msgProcessCallback != nil {
-		bot.msgHandlers = append(bot.msgHandlers, msgProcessCallback)
-		bot.msgReplyCallbacks = append(bot.msgReplyCallbacks, replyCallback)
+func (bot *Bot) AddMsgHandler(msgProcessCallback Handler, replyCallback func(*ReplyCallbackData)) {
+	bot.addMsgHandler("", msgProcessCallback, replyCallback)
+}
+
+// addMsgHandler adds a message handler to bot, module is the name of the module adding the handler
+func (bot *Bot) addMsgHandler(module string, msgProcessCallback Handler, replyCallback func(*ReplyCallbackData)) {
+	if msgProcessCallback == nil {
+		return
 	}
+	bot.handlersMutex.Lock()
+	defer bot.handlersMutex.Unlock()
+	bot.msgHandlers = append(bot.msgHandlers, msgHandler{handler: msgProcessCallback, reply: replyCallback, module: module})
 }
 
 // AddCmdHandler adds a command handler to bot.
 // cmdStruct is a pointer to a Command structure.
 // replyCallback is to be called by cmdProcessCallback (or not) to yield and process its result as a string message.
-// Command handlers must return true if they found a command to process, false otherwise
+// Command handlers return an error when the command failed, the user is then told so
 func (bot *Bot) AddCmdHandler(cmdStruct *Command, replyCallback func(*ReplyCallbackData)) {
+	bot.addCmdHandler("", cmdStruct, replyCallback)
+}
+
+// addCmdHandler adds a command handler to bot, module is the name of the module adding the command
+func (bot *Bot) addCmdHandler(module string, cmdStruct *Command, replyCallback func(*ReplyCallbackData)) {
 	if cmdStruct.Handler == nil {
 		return
 	}
-	for _, command := range cmdStruct.Triggers {
-		bot.cmdHandlers[command] = cmdStruct.Handler
-		bot.cmdReplyCallbacks[command] = replyCallback
+	bot.handlersMutex.Lock()
+	defer bot.handlersMutex.Unlock()
+	for _, trigger := range cmdStruct.Triggers {
+		bot.commands[trigger] = &command{Command: cmdStruct, reply: replyCallback, module: module}
 	}
 }
 
-// Run starts the event loop
+// Network returns the name of the network the bot is connected to
+func (bot *Bot) Network() string {
+	return bot.network.Name
+}
+
+// Channels returns the names of the channels the bot is configured to join
+func (bot *Bot) Channels() []string {
+	var names []string
+	for _, channel := range bot.network.Channels {
+		names = append(names, channel.Name)
+	}
+	return names
+}
+
+// Run connects to the server and processes the received events until the bot stops.
+// The bot reconnects when the connection is lost.
 func (bot *Bot) Run() {
-	bot.ircConn.Loop()
+	bot.loadPermissions()
+	bot.loadIgnores()
+	if !bot.connect() {
+		return
+	}
+	for event := range bot.transport.Events() {
+		bot.handleEvent(event)
+	}
 }
 
-// Stop exits the event loop
+// handleEvent calls the internal callbacks for an event received from the server, then publishes it to the subscribers.
+// The bot's own messages sent back by the server are ignored.
+func (bot *Bot) handleEvent(event *Event) {
+	event.Network = bot.network.Name
+	if known := applyTags(event, time.Now()); !known && event.Nick != "" {
+		// Account seen in an extended JOIN or an ACCOUNT message, when the server does not tag the messages
+		event.Account = bot.memberAccount(event.Nick)
+	}
+	if bot.isEcho(event) {
+		return
+	}
+	// The formatting is removed before the commands are parsed and before the modules store the messages
+	stripFormatting(event)
+	// The CTCP queries are answered by the bot, the actions are given to the handlers as flagged messages
+	if query, params := decodeCTCP(event); query != "" {
+		bot.answerCTCP(event, query, params)
+		return
+	}
+	for _, callback := range bot.callbacks[event.Code] {
+		callback(event)
+	}
+	bot.publish(event)
+}
+
+// Shutdown stops the bot gracefully, within timeout: the new commands and events are ignored,
+// the running and queued handlers are given time to finish, the queued messages are sent, then the bot quits the server.
+// The handlers still running at the end of timeout are cancelled and the messages still queued are dropped.
+func (bot *Bot) Shutdown(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	if !bot.workers.drain(timeout) {
+		log.Printf("Handlers still running on network %q after %s, they are cancelled\n", bot.network.Name, timeout)
+	}
+	if !bot.queue.flush(time.Until(deadline)) {
+		log.Printf("Messages still queued on network %q after %s, they are dropped\n", bot.network.Name, timeout)
+	}
+	bot.Stop()
+}
+
+// Stop exits the event loop immediately, the running handlers are cancelled and the queued messages are dropped
 func (bot *Bot) Stop() {
+	bot.stopOnce.Do(func() { close(bot.stop) })
+	bot.statusMutex.Lock()
+	bot.status.Connected = false
+	if bot.reclaimTimer != nil {
+		bot.reclaimTimer.Stop()
+	}
+	bot.statusMutex.Unlock()
+
 	// Quit the current connection and disconnect from the server (details: https://tools.ietf.org/html/rfc1459#section-4.1.6)
-	bot.ircConn.Quit()
+	bot.transport.Quit()
+	bot.queue.close()
+	bot.workers.close()
+
+	botsMutex.Lock()
+	delete(bots, bot.network.Name)
+	botsMutex.Unlock()
 }
 
-// ReplyToAll sends a message to the channel where the bot is connected
+// ReplyToAll sends a message to the channel specified by "data.Target",
+// or to every channel where the bot is connected if "data.Target" is not a channel.
 func (bot *Bot) ReplyToAll(data *ReplyCallbackData) {
-	bot.reply(bot.channel, data.Message)
+	if isChannel(data.Target) {
+		bot.reply(data.Target, data)
+		return
+	}
+	for _, channel := range bot.network.Channels {
+		bot.reply(channel.Name, data)
+	}
 }
 
 // Reply sends a message to the user or channel specifed by "data.Target".
 func (bot *Bot) Reply(data *ReplyCallbackData) {
 	if data.Target != "" {
-		bot.reply(data.Target, data.Message)
+		bot.reply(data.Target, data)
 	}
 }
 
-// reply sends a message and introduces necessary pauses between consecutive messages to deal with flood control
-func (bot *Bot) reply(target string, message string) {
-	elapsedTime := time.Since(bot.lastReplyTime)
-	if elapsedTime < (2 * time.Second) {
-		time.Sleep((2 * time.Second) - elapsedTime)
+// reply adds a message to the outbound queue, which deals with flood control.
+// Line breaks are removed from the message, as well as the formatting if the network uses plain text,
+// and messages too long for a single IRC line are split.
+// An action is split the same way, each part being sent as an action.
+// Priority messages and short messages are sent before the other messages. The priority of the replies to a command
+// is decided once for the command invocation by its reply callback, so that the lines of a reply are sent in order.
+func (bot *Bot) reply(target string, data *ReplyCallbackData) {
+	if data.Results != nil {
+		// Results not paginated by a command reply callback are all sent, in order even if some lines are short
+		for _, line := range data.Results.Lines {
+			bot.queueMessage(target, bot.cleanMessage(line), data.Priority, data.Action, data.group)
+		}
+		return
 	}
-	bot.ircConn.Privmsg(target, message)
-	bot.lastReplyTime = time.Now()
+	message := bot.cleanMessage(data.Message)
+	bot.queueMessage(target, message, data.Priority || data.group == 0 && len(message) < shortReplyLength, data.Action, data.group)
 }
 
-// mainHandler is called on every message posted in the channel where the bot is connected or directly sent to the bot.
-func (bot *Bot) mainHandler(event *irc.Event) {
+// cleanMessage removes the line breaks from a message, as well as the formatting if the network uses plain text
+func (bot *Bot) cleanMessage(message string) string {
+	message = sanitizeMessage(message)
+	if bot.network.PlainText {
+		message = format.Strip(message)
+	}
+	return message
+}
+
+// queueMessage splits a message in lines short enough for IRC, and adds them to the outbound queue
+func (bot *Bot) queueMessage(target, message string, priority, action bool, group uint64) {
+	length := messageLength(bot.source(), target)
+	if action {
+		length -= len(ctcpDelimiter + "ACTION " + ctcpDelimiter)
+	}
+	for _, part := range splitMessage(message, length) {
+		if action {
+			part = ctcpDelimiter + "ACTION " + part + ctcpDelimiter
+		}
+		bot.queue.push(&outLine{target: target, message: part, group: group}, priority)
+	}
+}
+
+// source returns the prefix the server adds to the bot's messages ("nick!user@host").
+// The lengths of the user name and host are estimated until the bot has joined a channel.
+func (bot *Bot) source() string {
+	bot.selfMutex.RLock()
+	defer bot.selfMutex.RUnlock()
+	user, host := bot.self.User, bot.self.Host
+	if user == "" {
+		user = strings.Repeat("u", defaultUserLength)
+	}
+	if host == "" {
+		host = strings.Repeat("h", defaultHostLength)
+	}
+	return bot.self.Nick + "!" + user + "@" + host
+}
+
+// CancelReplies removes from the outbound queue the messages not yet sent in reply to the command invocation of data
+func (bot *Bot) CancelReplies(data *ReplyCallbackData) {
+	bot.queue.cancel(data.group)
+}
+
+// replyGroup identifies the replies of a command invocation in the outbound queue
+type replyGroup struct {
+	id       uint64
+	finished time.Time // Time the handler is stopped, its group is forgotten once its lines are sent after this time
+}
+
+// replyCallbackForCommand returns the reply callback given to a command handler for an event.
+// The messages sent through the callback are grouped, so that a new invocation of the same command
+// by the same user on the same target supersedes the messages from the previous invocation still in the queue.
+// The replies to administrators and owners are sent in priority, as well as the replies starting with a short message,
+// and the results are paginated.
+func (bot *Bot) replyCallbackForCommand(event *Event, cmd *Command, role Role, callback func(*ReplyCallbackData)) func(*ReplyCallbackData) {
+	if callback == nil {
+		return nil
+	}
+	group := &replyGroup{id: bot.queue.newGroup(), finished: time.Now().Add(bot.handlerTimeout(cmd))}
+	key := strings.Join([]string{bot.fold(GetTargetFromEvent(event)), bot.fold(event.Nick), cmd.Triggers[0]}, " ")
+
+	bot.lastGroupsMutex.Lock()
+	now := time.Now()
+	for key, last := range bot.lastGroups {
+		if now.After(last.finished) && !bot.queue.hasGroup(last.id) {
+			delete(bot.lastGroups, key)
+		}
+	}
+	if last, present := bot.lastGroups[key]; present {
+		bot.queue.cancel(last.id)
+	}
+	bot.lastGroups[key] = group
+	bot.lastGroupsMutex.Unlock()
+
+	priority := role >= RoleAdmin
+	var decided sync.Once
+	return func(data *ReplyCallbackData) {
+		// Decided by the first message, the next ones must not be sent before it
+		decided.Do(func() {
+			priority = priority || data.Priority || data.Results == nil && len(bot.cleanMessage(data.Message)) < shortReplyLength
+		})
+		data.group = group.id
+		data.Priority = priority
+		if data.Results != nil {
+			bot.sendPage(event, data, callback)
+			return
+		}
+		callback(data)
+	}
+}
+
+// mainHandler is called on every message posted in a channel where the bot is connected or directly sent to the bot.
+// The actions are given to the message handlers only, they are never commands.
+func (bot *Bot) mainHandler(event *Event) {
 
 	if strings.TrimSpace(event.Message()) == "" {
 		return
 	}
+	// The commands and the message handlers do not see the messages of the ignored users
+	if bot.isIgnored(event) {
+		return
+	}
+
+	var (
+		command *command
+		present bool
+	)
+	line, isCommand := bot.parseCommand(event)
+	isCommand = isCommand && !event.Action
+	bot.handlersMutex.RLock()
+	if fields := strings.Fields(line); isCommand && len(fields) != 0 {
+		command, present = bot.commands[strings.ToLower(fields[0])]
+	}
+	handlers := bot.msgHandlers
+	bot.handlersMutex.RUnlock()
 
-	cmd := strings.Fields(event.Message())[0]
-	cmdHandler, present := bot.cmdHandlers[cmd]
-	if present {
-		go func() {
-			if !helpers.StringInSlice(event.Nick, bot.users) {
-				UpdateUserList(event)
-				if !helpers.StringInSlice(event.Nick, bot.users) {
-					return
-				}
-			}
-			go cmdHandler(event, bot.cmdReplyCallbacks[cmd])
-		}()
+	// Only the users present in one of the bot's channels can run commands
+	if present && bot.isUser(event) {
+		// The command handlers receive the command line without the prefix, the trigger being the first field
+		event, role := commandEvent(event, line), bot.getRole(event)
+		if bot.allowCommand(event, command.Command, role, command.reply) {
+			reply := bot.replyCallbackForCommand(event, command.Command, role, command.reply)
+			bot.runCommand(command.module, command.Command, event, role, reply)
+		}
 	}
 
-	for i, handler := range bot.msgHandlers {
-		go handler(event, bot.msgReplyCallbacks[i])
+	for _, handler := range handlers {
+		bot.runHandler(handler.module, handler.handler, event, handler.reply)
 	}
 }
 
-// UpdateUserList Update the user list used for access control
-func UpdateUserList(event *irc.Event) {
-	event.Connection.SendRawf("NAMES %s", event.Arguments[0])
-	<-updateUserListDone
+// getBot returns the bot which received the event, nil if not found
+func getBot(event *Event) *Bot {
+	botsMutex.RLock()
+	defer botsMutex.RUnlock()
+	return bots[event.Network]
 }
 
 // GetTargetFromEvent If the message originated from a channel then return it, else return the nick that sent the message
-func GetTargetFromEvent(event *irc.Event) string {
+func GetTargetFromEvent(event *Event) string {
 	source := strings.TrimSpace(event.Arguments[0])
-	if strings.HasPrefix(source, "#") {
+	if isChannel(source) {
 		return source
 	}
 	return event.Nick
 }
+
+// GetChannelFromEvent If the message originated from a channel then return it, else return an empty string
+func GetChannelFromEvent(event *Event) string {
+	if len(event.Arguments) == 0 {
+		return ""
+	}
+	source := strings.TrimSpace(event.Arguments[0])
+	if isChannel(source) {
+		return source
+	}
+	return ""
+}
+
+// GetDefaultChannel returns the first channel configured for the network where the event was received, empty if there is none.
+// The modules use it when they need a channel and the event comes from a private message.
+func GetDefaultChannel(event *Event) string {
+	if bot := getBot(event); bot != nil && len(bot.network.Channels) != 0 {
+		return bot.network.Channels[0].Name
+	}
+	return ""
+}
+
+// isChannel checks if a target is a channel name
+func isChannel(target string) bool {
+	return strings.HasPrefix(target, "#")
+}
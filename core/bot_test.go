@@ -10,14 +10,52 @@ Package quote contains quote commands
 package core
 
 import (
-	"github.com/thoj/go-ircevent"
+	"sync"
 	"testing"
+	"time"
 )
 
+// fakeTransport is a Transport storing the lines sent by the bot, events are sent by the tests
+type fakeTransport struct {
+	events chan *Event
+	sent   []string
+	mutex  sync.Mutex
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{events: make(chan *Event)}
+}
+
+func (transport *fakeTransport) Connect() error { return nil }
+
+func (transport *fakeTransport) Join(channel, key string) {
+	transport.SendRaw("JOIN " + channel + " " + key)
+}
+
+func (transport *fakeTransport) Privmsg(target, message string) {
+	transport.SendRaw("PRIVMSG " + target + " :" + message)
+}
+
+func (transport *fakeTransport) SendRaw(line string) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	transport.sent = append(transport.sent, line)
+}
+
+func (transport *fakeTransport) Events() <-chan *Event { return transport.events }
+
+func (transport *fakeTransport) Quit() { close(transport.events) }
+
+func (transport *fakeTransport) lines() []string {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	return append([]string(nil), transport.sent...)
+}
+
 func Test_GetTargetFromEvent(t *testing.T) {
 
 	// Channel
-	event := irc.Event{
+	event := Event{
 		Nick:      "Sender",
 		Arguments: []string{"#test_channel", "test message"}}
 	expectedResult := "#test_channel"
@@ -29,7 +67,7 @@ func Test_GetTargetFromEvent(t *testing.T) {
 	}
 
 	// Nick
-	event = irc.Event{
+	event = Event{
 		Nick:      "Sender",
 		Arguments: []string{"Receiver", "test message"}}
 	expectedResult = "Sender"
@@ -40,3 +78,120 @@ func Test_GetTargetFromEvent(t *testing.T) {
 		t.Errorf("Result not matching expected result (%q != %q)", result, expectedResult)
 	}
 }
+
+func Test_GetChannelFromEvent(t *testing.T) {
+
+	// Channel
+	event := Event{
+		Nick:      "Sender",
+		Arguments: []string{"#test_channel", "test message"}}
+	expectedResult := "#test_channel"
+
+	result := GetChannelFromEvent(&event)
+
+	if result != expectedResult {
+		t.Errorf("Result not matching expected result (%q != %q)", result, expectedResult)
+	}
+
+	// Private message
+	event = Event{
+		Nick:      "Sender",
+		Arguments: []string{"Receiver", "test message"}}
+	expectedResult = ""
+
+	result = GetChannelFromEvent(&event)
+
+	if result != expectedResult {
+		t.Errorf("Result not matching expected result (%q != %q)", result, expectedResult)
+	}
+}
+
+func Test_GetDefaultChannel(t *testing.T) {
+	first := NewBotWithTransport(Network{Name: "first_network", Nick: "goxxx", Channels: []Channel{{Name: "#first"}, {Name: "#other"}}}, newFakeTransport())
+	defer first.Stop()
+	second := NewBotWithTransport(Network{Name: "second_network", Nick: "goxxx", Channels: []Channel{{Name: "#second"}}}, newFakeTransport())
+	defer second.Stop()
+
+	for network, expected := range map[string]string{"first_network": "#first", "second_network": "#second", "unknown_network": ""} {
+		if channel := GetDefaultChannel(&Event{Network: network, Arguments: []string{"goxxx", "invoke bob"}}); channel != expected {
+			t.Errorf("Default channel %q for %s instead of %q", channel, network, expected)
+		}
+	}
+}
+
+func Test_Run(t *testing.T) {
+	transport := newFakeTransport()
+	bot := NewBotWithTransport(Network{
+		Name:     "test_network",
+		Nick:     "goxxx",
+		Channels: []Channel{{Name: "#test_channel"}, {Name: "#other_channel", Key: "key"}}}, transport)
+
+	received := make(chan *Event, 1)
+	bot.AddCmdHandler(&Command{
+		Triggers: []string{"test"},
+		Handler: func(event *Event, callback func(*ReplyCallbackData)) error {
+			received <- event
+			return nil
+		}}, bot.Reply)
+
+	go bot.Run()
+	transport.events <- &Event{Code: "001", Arguments: []string{"goxxx", "Welcome"}}
+	transport.events <- &Event{Code: "JOIN", Nick: "goxxx", Arguments: []string{"#test_channel"}}
+	transport.events <- &Event{Code: "353", Arguments: []string{"goxxx", "=", "#test_channel", "goxxx @Admin Sender"}}
+	transport.events <- &Event{Code: "366", Arguments: []string{"goxxx", "#test_channel", "End of /NAMES list."}}
+	transport.events <- &Event{Code: "PRIVMSG", Nick: "Sender", Arguments: []string{"#test_channel", "!test argument"}}
+
+	select {
+	case event := <-received:
+		if event.Network != "test_network" {
+			t.Errorf("Incorrect network: should be %q, is %q", "test_network", event.Network)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Command handler not called")
+	}
+	bot.Stop()
+
+	lines := transport.lines()
+	if len(lines) < 2 || lines[0] != "JOIN #test_channel " || lines[1] != "JOIN #other_channel key" {
+		t.Errorf("Channels not joined, lines sent: %q", lines)
+	}
+	if getBot(&Event{Network: "test_network"}) != nil {
+		t.Error("Bot still registered after Stop")
+	}
+}
+
+func Test_replyCallbackForCommand(t *testing.T) {
+	transport := newFakeTransport()
+	bot := NewBotWithTransport(Network{Name: "test_replies", Nick: "goxxx", FloodBurst: 1, FloodRate: time.Hour, HandlerTimeout: time.Millisecond}, transport)
+	defer bot.queue.close()
+	command := &Command{Triggers: []string{"test"}}
+	long := "a reply long enough not to be sent in priority by itself"
+
+	reply := bot.replyCallbackForCommand(&Event{Nick: "Sender", Arguments: []string{"#test_channel", "test"}}, command, RoleUser, bot.Reply)
+	// The first line uses the only token, the others wait in the queue
+	reply(&ReplyCallbackData{Message: long, Target: "#test_channel"})
+	reply(&ReplyCallbackData{Message: long, Target: "#test_channel"})
+	reply(&ReplyCallbackData{Message: "short", Target: "#test_channel"})
+	for deadline := time.Now().Add(time.Second); len(transport.lines()) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	bot.queue.mutex.Lock()
+	priority, pending := len(bot.queue.priority), len(bot.queue.pending["#test_channel"])
+	bot.queue.mutex.Unlock()
+	if priority != 0 || pending != 2 {
+		t.Errorf("The lines of a reply must keep their order: %d priority lines and %d pending lines instead of 0 and 2", priority, pending)
+	}
+
+	// The group of the first invocation is kept while its lines wait in the queue, even once the handler is stopped
+	time.Sleep(5 * time.Millisecond)
+	bot.replyCallbackForCommand(&Event{Nick: "Other", Arguments: []string{"#test_channel", "test"}}, command, RoleUser, bot.Reply)
+	if count := len(bot.lastGroups); count != 2 {
+		t.Errorf("%d reply groups instead of 2", count)
+	}
+	bot.queue.cancel(bot.lastGroups[bot.fold("#test_channel")+" "+bot.fold("Sender")+" test"].id)
+	time.Sleep(5 * time.Millisecond)
+	bot.replyCallbackForCommand(&Event{Nick: "Third", Arguments: []string{"#test_channel", "test"}}, command, RoleUser, bot.Reply)
+	if count := len(bot.lastGroups); count != 1 {
+		t.Errorf("%d reply groups instead of 1, the finished ones must be removed", count)
+	}
+}
@@ -0,0 +1,61 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"time"
+)
+
+// Capabilities requested to the server during the registration (IRCv3 CAP negotiation), the ones it does not support are ignored:
+//   - server-time: the messages have a "time" tag, the time they were sent
+//   - account-tag: the messages have an "account" tag, the services account of the sender
+//   - extended-join: the JOIN messages contain the account of the user joining the channel
+//   - account-notify: the server sends an ACCOUNT message when a member of the bot's channels logs in or out
+//   - message-tags: the messages can have tags, like "msgid"
+//   - echo-message: the server sends back the messages of the bot, they are ignored
+var requestedCaps = []string{"server-time", "account-tag", "extended-join", "account-notify", "message-tags", "echo-message"}
+
+// applyTags sets the time, the message identifier and the account of the event from its tags.
+// received is the time the event was received, used when the server does not send the "time" tag.
+// known is true if the event tells the account of its sender ("account" tag, extended JOIN or ACCOUNT message).
+func applyTags(event *Event, received time.Time) (known bool) {
+	event.Time = received
+	// "2017-03-24T12:20:32.123Z"
+	if sent, err := time.Parse(time.RFC3339Nano, event.Tags["time"]); err == nil {
+		event.Time = sent
+	}
+	event.MessageID = event.Tags["msgid"]
+	if account, present := event.Tags["account"]; present {
+		event.Account = account
+		return true
+	}
+
+	switch {
+	case event.Code == "JOIN" && len(event.Arguments) >= 3:
+		// extended-join: [channel, account, real name], the account is "*" if the user is not logged in
+		event.Account = accountName(event.Arguments[1])
+		return true
+	case event.Code == "ACCOUNT" && len(event.Arguments) != 0:
+		// account-notify: [account], "*" if the user logged out
+		event.Account = accountName(event.Arguments[0])
+		return true
+	}
+	return false
+}
+
+// accountName returns the name of an account as sent by the server, "*" meaning no account
+func accountName(account string) string {
+	if account == "*" {
+		return ""
+	}
+	return account
+}
+
+// isEcho checks if the event is one of the bot's messages, sent back by the server (echo-message capability)
+func (bot *Bot) isEcho(event *Event) bool {
+	return (event.Code == "PRIVMSG" || event.Code == "NOTICE") && event.Nick != "" && bot.isSelf(event.Nick)
+}
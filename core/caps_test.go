@@ -0,0 +1,41 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_applyTags(t *testing.T) {
+	received := time.Date(2017, time.March, 24, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		event     Event
+		time      time.Time
+		messageID string
+		account   string
+		known     bool
+	}{
+		{Event{Code: "PRIVMSG", Arguments: []string{"#channel", "hello"}}, received, "", "", false},
+		{Event{Code: "PRIVMSG", Arguments: []string{"#channel", "hello"},
+			Tags: map[string]string{"time": "2017-03-24T11:59:30.123Z", "msgid": "abc", "account": "sender"}},
+			time.Date(2017, time.March, 24, 11, 59, 30, 123000000, time.UTC), "abc", "sender", true},
+		{Event{Code: "PRIVMSG", Arguments: []string{"#channel", "hello"}, Tags: map[string]string{"time": "yesterday"}}, received, "", "", false},
+		{Event{Code: "JOIN", Arguments: []string{"#channel", "sender", "Real Name"}}, received, "", "sender", true},
+		{Event{Code: "JOIN", Arguments: []string{"#channel", "*", "Real Name"}}, received, "", "", true},
+		{Event{Code: "JOIN", Arguments: []string{"#channel"}}, received, "", "", false},
+		{Event{Code: "ACCOUNT", Arguments: []string{"sender"}}, received, "", "sender", true},
+		{Event{Code: "ACCOUNT", Arguments: []string{"*"}}, received, "", "", true},
+	}
+	for _, test := range tests {
+		event := test.event
+		known := applyTags(&event, received)
+		if !event.Time.Equal(test.time) || event.MessageID != test.messageID || event.Account != test.account || known != test.known {
+			t.Errorf("applyTags(%s %q %q) => time %s, message ID %q, account %q (%t)",
+				test.event.Code, test.event.Arguments, test.event.Tags, event.Time, event.MessageID, event.Account, known)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// CaseMapping is the way a network compares nicks and channel names, given by the CASEMAPPING token of RPL_ISUPPORT
+type CaseMapping int32
+
+// Case mappings supported by the bot (details: https://modern.ircdocs.horse/#casemapping-parameter)
+const (
+	CaseMappingRFC1459       CaseMapping = iota // "rfc1459": "[]\~" are the upper case of "{}|^", used when the server does not tell
+	CaseMappingStrictRFC1459                    // "strict-rfc1459": "[]\" are the upper case of "{}|"
+	CaseMappingASCII                            // "ascii": only the letters have an upper case
+)
+
+var (
+	rfc1459Replacer       = strings.NewReplacer("[", "{", "]", "}", "\\", "|", "~", "^")
+	strictRFC1459Replacer = strings.NewReplacer("[", "{", "]", "}", "\\", "|")
+)
+
+// ParseCaseMapping returns the case mapping corresponding to the value of the CASEMAPPING token,
+// CaseMappingRFC1459 if the value is unknown
+func ParseCaseMapping(name string) CaseMapping {
+	switch strings.ToLower(name) {
+	case "ascii":
+		return CaseMappingASCII
+	case "strict-rfc1459":
+		return CaseMappingStrictRFC1459
+	}
+	return CaseMappingRFC1459
+}
+
+// Fold returns the lower case form of a nick or a channel name: two names are equal if their folded forms are equal.
+// The folded form is used to compare the names, and as key when the names are stored.
+func (mapping CaseMapping) Fold(name string) string {
+	name = toLowerASCII(name)
+	switch mapping {
+	case CaseMappingRFC1459:
+		return rfc1459Replacer.Replace(name)
+	case CaseMappingStrictRFC1459:
+		return strictRFC1459Replacer.Replace(name)
+	}
+	return name
+}
+
+// toLowerASCII changes the upper case letters of the ASCII range to lower case, the other characters are kept:
+// the case mappings do not fold the non-ASCII letters
+func toLowerASCII(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, name)
+}
+
+// NormalizeNick returns the folded form of a nick, following the case mapping of the network where the event was received.
+// The modules use it to compare nicks, and as key when they store data for a nick.
+func NormalizeNick(event *Event, nick string) string {
+	return caseMappingOf(event).Fold(nick)
+}
+
+// caseMappingOf returns the case mapping of the network where the event was received
+func caseMappingOf(event *Event) CaseMapping {
+	if bot := getBot(event); bot != nil {
+		return bot.caseMapping()
+	}
+	return CaseMappingRFC1459
+}
+
+// caseMapping returns the case mapping of the bot's network
+func (bot *Bot) caseMapping() CaseMapping {
+	return CaseMapping(atomic.LoadInt32(&bot.mapping))
+}
+
+// setCaseMapping changes the case mapping of the bot's network
+func (bot *Bot) setCaseMapping(mapping CaseMapping) {
+	atomic.StoreInt32(&bot.mapping, int32(mapping))
+}
+
+// fold returns the key used to index a nick or a channel name, following the case mapping of the bot's network
+func (bot *Bot) fold(name string) string {
+	return bot.caseMapping().Fold(name)
+}
@@ -0,0 +1,52 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"testing"
+)
+
+func Test_CaseMappingFold(t *testing.T) {
+	tests := []struct {
+		mapping  CaseMapping
+		name     string
+		expected string
+	}{
+		{CaseMappingRFC1459, "Bob[Away]\\~", "bob{away}|^"},
+		{CaseMappingStrictRFC1459, "Bob[Away]\\~", "bob{away}|~"},
+		{CaseMappingASCII, "Bob[Away]\\~", "bob[away]\\~"},
+		{CaseMappingRFC1459, "#Éclair", "#Éclair"},
+		{ParseCaseMapping("STRICT-RFC1459"), "[]", "{}"},
+		{ParseCaseMapping("rfc7613"), "Bob~", "bob^"},
+	}
+	for _, test := range tests {
+		if folded := test.mapping.Fold(test.name); folded != test.expected {
+			t.Errorf("Fold(%q) = %q with mapping %d, expected %q", test.name, folded, test.mapping, test.expected)
+		}
+	}
+}
+
+func Test_CaseMappingFromISupport(t *testing.T) {
+	bot := NewBotWithTransport(Network{Name: "test_casemapping", Nick: "goxxx"}, newFakeTransport())
+	defer bot.Stop()
+
+	// RFC 1459 until the server tells otherwise
+	event := &Event{Network: "test_casemapping", Nick: "Bob[1]"}
+	if nick := NormalizeNick(event, event.Nick); nick != "bob{1}" {
+		t.Errorf("Unexpected normalized nick with the default mapping: %q", nick)
+	}
+	if !MatchMask("bob{1}!*@*", event) {
+		t.Error("Mask not matched with the default mapping")
+	}
+
+	bot.handleEvent(&Event{Code: "005", Arguments: []string{"goxxx", "CASEMAPPING=ascii", "are supported by this server"}})
+	if nick := NormalizeNick(event, event.Nick); nick != "bob[1]" {
+		t.Errorf("Unexpected normalized nick with the ascii mapping: %q", nick)
+	}
+	if MatchMask("bob{1}!*@*", event) || !MatchMask("BOB[1]!*@*", event) {
+		t.Error("Mask matched with the wrong mapping")
+	}
+}
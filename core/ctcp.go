@@ -0,0 +1,116 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ctcpDelimiter surrounds the CTCP messages
+	ctcpDelimiter = "\x01"
+	// Minimum time between two answers to CTCP queries, the other queries are dropped
+	ctcpInterval = time.Second
+	// Address of the source code, answered to the CTCP SOURCE queries
+	sourceURL = "https://github.com/vaz-ar/goxxx"
+)
+
+// CTCP queries answered by the bot (details: https://tools.ietf.org/id/draft-oakley-irc-ctcp-02.html)
+var ctcpQueries = map[string]func(params string) string{
+	"CLIENTINFO": func(string) string { return "ACTION CLIENTINFO PING SOURCE TIME VERSION" },
+	"PING":       func(params string) string { return params },
+	"SOURCE":     func(string) string { return sourceURL },
+	"TIME":       func(string) string { return time.Now().Format(time.RFC1123Z) },
+	"VERSION":    func(string) string { return Version() },
+}
+
+var (
+	// Version and build time of the bot, set by SetVersion
+	botVersion, botBuildTime string
+	versionMutex             sync.RWMutex
+)
+
+// SetVersion stores the version and the build time of the bot, answered to the CTCP VERSION queries
+func SetVersion(version, buildTime string) {
+	versionMutex.Lock()
+	defer versionMutex.Unlock()
+	botVersion, botBuildTime = version, buildTime
+}
+
+// Version returns the name and the version of the bot ("goxxx v1.0 (built 2017-05-01)")
+func Version() string {
+	versionMutex.RLock()
+	defer versionMutex.RUnlock()
+	version := "goxxx"
+	if botVersion != "" {
+		version += " " + botVersion
+	}
+	if botBuildTime != "" {
+		version += " (built " + botBuildTime + ")"
+	}
+	return version
+}
+
+// parseCTCP splits a CTCP message ("\x01PING 1234\x01") into its command and its parameters.
+// ok is false if the message is not a CTCP message.
+func parseCTCP(message string) (command, params string, ok bool) {
+	if len(message) < 2 || !strings.HasPrefix(message, ctcpDelimiter) {
+		return "", "", false
+	}
+	// The closing delimiter is optional
+	message = strings.TrimSuffix(message[1:], ctcpDelimiter)
+	command = message
+	if i := strings.Index(message, " "); i != -1 {
+		command, params = message[:i], message[i+1:]
+	}
+	return strings.ToUpper(command), params, command != ""
+}
+
+// decodeCTCP decodes the CTCP message of a PRIVMSG event.
+// An ACTION becomes a message flagged with Action, whose text is the text of the action.
+// The command and the parameters of the other CTCP messages (the queries) are returned, query is empty for the other events.
+func decodeCTCP(event *Event) (query, params string) {
+	if event.Code != "PRIVMSG" {
+		return "", ""
+	}
+	command, params, ok := parseCTCP(event.Message())
+	if !ok {
+		return "", ""
+	}
+	if command != "ACTION" {
+		return command, params
+	}
+	event.Arguments = append([]string(nil), event.Arguments...)
+	event.Arguments[len(event.Arguments)-1] = params
+	event.Action = true
+	return "", ""
+}
+
+// answerCTCP answers a CTCP query with a NOTICE, the unknown queries and the queries from the ignored users are not answered.
+// At most one query is answered every ctcpInterval, so that the queries cannot be used to flood the bot off the server.
+func (bot *Bot) answerCTCP(event *Event, query, params string) {
+	answer, known := ctcpQueries[query]
+	if !known || event.Nick == "" || bot.isIgnored(event) {
+		return
+	}
+	bot.ctcpMutex.Lock()
+	now := time.Now()
+	if now.Sub(bot.lastCTCP) < ctcpInterval {
+		bot.ctcpMutex.Unlock()
+		log.Printf("CTCP %s from %s on network %q not answered: too many queries\n", query, event.Source, bot.network.Name)
+		return
+	}
+	bot.lastCTCP = now
+	bot.ctcpMutex.Unlock()
+
+	reply := strings.TrimSpace(query + " " + sanitizeMessage(answer(params)))
+	bot.transport.SendRaw(fmt.Sprintf("NOTICE %s :%s%s%s", event.Nick, ctcpDelimiter, reply, ctcpDelimiter))
+}
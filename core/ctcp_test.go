@@ -0,0 +1,53 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"testing"
+)
+
+func Test_decodeCTCP(t *testing.T) {
+	tests := []struct {
+		event   Event
+		query   string
+		params  string
+		action  bool
+		message string
+	}{
+		{Event{Code: "PRIVMSG", Arguments: []string{"#channel", "hello"}}, "", "", false, "hello"},
+		{Event{Code: "PRIVMSG", Arguments: []string{"#channel", "\x01ACTION waves\x01"}}, "", "", true, "waves"},
+		{Event{Code: "PRIVMSG", Arguments: []string{"#channel", "\x01ACTION !help\x01"}}, "", "", true, "!help"},
+		{Event{Code: "PRIVMSG", Arguments: []string{"goxxx", "\x01VERSION\x01"}}, "VERSION", "", false, "\x01VERSION\x01"},
+		{Event{Code: "PRIVMSG", Arguments: []string{"goxxx", "\x01PING 1234 5678\x01"}}, "PING", "1234 5678", false, "\x01PING 1234 5678\x01"},
+		{Event{Code: "PRIVMSG", Arguments: []string{"goxxx", "\x01time"}}, "TIME", "", false, "\x01time"},
+		{Event{Code: "PRIVMSG", Arguments: []string{"goxxx", "\x01\x01"}}, "", "", false, "\x01\x01"},
+		{Event{Code: "NOTICE", Arguments: []string{"goxxx", "\x01VERSION other 1.0\x01"}}, "", "", false, "\x01VERSION other 1.0\x01"},
+	}
+	for _, test := range tests {
+		event := test.event
+		query, params := decodeCTCP(&event)
+		if query != test.query || params != test.params || event.Action != test.action || event.Message() != test.message {
+			t.Errorf("Unexpected decoding of %q: %q, %q, %t, %q", test.event.Message(), query, params, event.Action, event.Message())
+		}
+	}
+}
+
+func Test_Version(t *testing.T) {
+	defer SetVersion("", "")
+	tests := []struct {
+		version, buildTime, expected string
+	}{
+		{"", "", "goxxx"},
+		{"v1.2", "", "goxxx v1.2"},
+		{"v1.2", "2017-05-01", "goxxx v1.2 (built 2017-05-01)"},
+	}
+	for _, test := range tests {
+		SetVersion(test.version, test.buildTime)
+		if version := Version(); version != test.expected {
+			t.Errorf("Version() = %q, expected %q", version, test.expected)
+		}
+	}
+}
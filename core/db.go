@@ -0,0 +1,34 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Format of the DATETIME columns, in UTC as CURRENT_TIMESTAMP
+const dbTimeFormat = "2006-01-02 15:04:05"
+
+// DBTime formats a time to be stored in a DATETIME column, like event.Time for the real send time of a message.
+// The current time is used for a zero time.
+func DBTime(t time.Time) string {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t.UTC().Format(dbTimeFormat)
+}
+
+// getDB returns the database given to the modules, nil if none
+func getDB() *sql.DB {
+	modulesMutex.RLock()
+	defer modulesMutex.RUnlock()
+	if moduleDependencies == nil {
+		return nil
+	}
+	return moduleDependencies.DB
+}
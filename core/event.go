@@ -0,0 +1,71 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"context"
+	"github.com/vaz-ar/goxxx/core/format"
+	"time"
+)
+
+// Event structure that contains a message received from an IRC server
+type Event struct {
+	Code      string            // Command or numeric reply ("PRIVMSG", "JOIN", "001", ...)
+	Raw       string            // Raw line as received from the server
+	Source    string            // Prefix of the message ("nick!user@host" or server name)
+	Nick      string            // Nick of the sender
+	User      string            // User name of the sender
+	Host      string            // Host of the sender
+	Account   string            // Services account of the sender, empty if unknown or not logged in
+	Arguments []string          // Parameters of the message, the last one being the trailing parameter
+	Network   string            // Name of the network where the event was received
+	Args      Arguments         // Arguments of the command, for the events given to the command handlers declaring their arguments
+	Time      time.Time         // Time the message was sent, from the "server-time" tag, or the time it was received
+	MessageID string            // Identifier of the message, from the "msgid" tag, empty if the server does not send it
+	Tags      map[string]string // IRCv3 tags of the message
+	Action    bool              // The PRIVMSG is a CTCP ACTION (/me), its message is the text of the action
+	ctx       context.Context
+}
+
+// Message returns the last argument of the event (the message for a PRIVMSG)
+func (event *Event) Message() string {
+	if len(event.Arguments) == 0 {
+		return ""
+	}
+	return event.Arguments[len(event.Arguments)-1]
+}
+
+// Codes of the events whose text is stripped of its formatting when received
+var formattedCodes = map[string]bool{"PRIVMSG": true, "NOTICE": true, "TOPIC": true}
+
+// stripFormatting removes the formatting (bold, colors, ...) from the text of a message, a notice or a topic
+func stripFormatting(event *Event) {
+	if !formattedCodes[event.Code] || len(event.Arguments) < 2 {
+		return
+	}
+	if stripped := format.Strip(event.Message()); stripped != event.Message() {
+		event.Arguments = append([]string(nil), event.Arguments...)
+		event.Arguments[len(event.Arguments)-1] = stripped
+	}
+}
+
+// Context returns the context of the handler the event was given to.
+// It is cancelled when the handler's deadline is reached or when the bot stops,
+// the handlers pass it to their HTTP requests and other long operations.
+func (event *Event) Context() context.Context {
+	if event.ctx == nil {
+		return context.Background()
+	}
+	return event.ctx
+}
+
+// withContext returns a copy of the event with the given context
+func (event *Event) withContext(ctx context.Context) *Event {
+	copy := *event
+	copy.ctx = ctx
+	return &copy
+}
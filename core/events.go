@@ -0,0 +1,95 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+// EventKind identifies the events the modules can subscribe to
+type EventKind string
+
+// Kinds of events published to the subscribers
+const (
+	KindMessage EventKind = "message" // Message posted in a channel or sent to the bot, CTCP messages excluded
+	KindAction  EventKind = "action"  // CTCP ACTION (/me), the event is flagged with Action and its message is the text of the action
+	KindNotice  EventKind = "notice"  // NOTICE received by the bot
+	KindJoin    EventKind = "join"    // A user joined a channel
+	KindPart    EventKind = "part"    // A user left a channel
+	KindQuit    EventKind = "quit"    // A user disconnected from the network
+	KindKick    EventKind = "kick"    // A user was kicked out of a channel
+	KindNick    EventKind = "nick"    // A user changed nick, the new nick is the message of the event
+	KindTopic   EventKind = "topic"   // The topic of a channel was changed
+	KindMode    EventKind = "mode"    // The modes of a channel or a user were changed
+)
+
+// Codes of the events published, by kind (PRIVMSG events are published as KindMessage or KindAction)
+var eventKinds = map[string]EventKind{
+	"NOTICE": KindNotice,
+	"JOIN":   KindJoin,
+	"PART":   KindPart,
+	"QUIT":   KindQuit,
+	"KICK":   KindKick,
+	"NICK":   KindNick,
+	"TOPIC":  KindTopic,
+	"MODE":   KindMode}
+
+// Subscription structure that contains a handler called for every event of a kind, and the way its replies are sent
+type Subscription struct {
+	Kind       EventKind
+	Handler    Handler
+	ReplyToAll bool // Send the replies to every channel when their target is not a channel
+}
+
+// subscription structure that contains a subscribed handler, its reply callback and the module that added it
+type subscription struct {
+	handler Handler
+	reply   func(*ReplyCallbackData)
+	module  string
+}
+
+// Subscribe adds a handler called for every event of the given kind received by the bot.
+// replyCallback is to be called by handler (or not) to send its replies.
+func (bot *Bot) Subscribe(kind EventKind, handler Handler, replyCallback func(*ReplyCallbackData)) {
+	bot.subscribe("", kind, handler, replyCallback)
+}
+
+// subscribe adds a handler for a kind of events, module is the name of the module adding the handler
+func (bot *Bot) subscribe(module string, kind EventKind, handler Handler, replyCallback func(*ReplyCallbackData)) {
+	if handler == nil {
+		return
+	}
+	bot.handlersMutex.Lock()
+	defer bot.handlersMutex.Unlock()
+	bot.subscriptions[kind] = append(bot.subscriptions[kind], subscription{handler: handler, reply: replyCallback, module: module})
+}
+
+// publish calls the handlers subscribed to the kind of the event, on the worker pool
+func (bot *Bot) publish(event *Event) {
+	kind := kindOf(event)
+	if kind == "" {
+		return
+	}
+	bot.handlersMutex.RLock()
+	subscriptions := bot.subscriptions[kind]
+	bot.handlersMutex.RUnlock()
+	// The messages of the ignored users are not published
+	if len(subscriptions) != 0 && (kind == KindMessage || kind == KindAction || kind == KindNotice) && bot.isIgnored(event) {
+		return
+	}
+	for _, subscription := range subscriptions {
+		bot.runHandler(subscription.module, subscription.handler, event, subscription.reply)
+	}
+}
+
+// kindOf returns the kind of an event, empty if the event is not published.
+// The CTCP messages were decoded already: the queries are not published, the actions are flagged.
+func kindOf(event *Event) EventKind {
+	if event.Code != "PRIVMSG" {
+		return eventKinds[event.Code]
+	}
+	if event.Action {
+		return KindAction
+	}
+	return KindMessage
+}
@@ -0,0 +1,63 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_kindOf(t *testing.T) {
+	tests := []struct {
+		event Event
+		kind  EventKind
+	}{
+		{Event{Code: "PRIVMSG", Arguments: []string{"#channel", "hello"}}, KindMessage},
+		{Event{Code: "PRIVMSG", Arguments: []string{"#channel", "waves"}, Action: true}, KindAction},
+		{Event{Code: "JOIN", Arguments: []string{"#channel"}}, KindJoin},
+		{Event{Code: "NICK", Arguments: []string{"new_nick"}}, KindNick},
+		{Event{Code: "TOPIC", Arguments: []string{"#channel", "new topic"}}, KindTopic},
+		{Event{Code: "001", Arguments: []string{"goxxx", "Welcome"}}, ""},
+	}
+	for _, test := range tests {
+		if kind := kindOf(&test.event); kind != test.kind {
+			t.Errorf("Unexpected kind for %#v: %q", test.event, kind)
+		}
+	}
+}
+
+func Test_Subscribe(t *testing.T) {
+	bot := NewBotWithTransport(Network{Name: "test_subscribe", Nick: "goxxx"}, newFakeTransport())
+	defer bot.Stop()
+
+	received := make(chan *Event, 1)
+	handler := func(event *Event, callback func(*ReplyCallbackData)) error {
+		received <- event
+		return nil
+	}
+	bot.Subscribe(KindJoin, handler, bot.Reply)
+	bot.subscribe("test_module", KindAction, handler, bot.Reply)
+
+	bot.handleEvent(&Event{Code: "PRIVMSG", Nick: "Sender", Arguments: []string{"#channel", "hello"}})
+	bot.handleEvent(&Event{Code: "JOIN", Nick: "Sender", Arguments: []string{"#channel"}})
+	select {
+	case event := <-received:
+		if event.Code != "JOIN" || event.Network != "test_subscribe" {
+			t.Errorf("Unexpected event: %#v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscribed handler not called")
+	}
+
+	// The subscriptions of a module are removed with the module
+	bot.UnloadModule("test_module")
+	bot.handleEvent(&Event{Code: "PRIVMSG", Nick: "Sender", Arguments: []string{"#channel", "\x01ACTION waves\x01"}})
+	select {
+	case event := <-received:
+		t.Errorf("Handler of an unloaded module called: %#v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,156 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+/*
+Package format formats the messages sent by the bot with the IRC control codes (bold, italics, colors, ...),
+and strips these codes from the messages received.
+
+Each function closes the codes it opens, so that the functions can be nested and the formatting never leaks
+to the rest of the message. The formatted text stays readable once stripped, by clients or by the channels
+refusing the formatting:
+
+	format.Bold("XKCD") + ": " + format.Link("Exploits of a Mom", "https://xkcd.com/327/")
+
+is displayed as "XKCD: Exploits of a Mom (https://xkcd.com/327/)" without formatting.
+*/
+package format
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Control codes (details: https://modern.ircdocs.horse/formatting.html)
+const (
+	BoldCode          = "\x02"
+	ColorCode         = "\x03"
+	HexColorCode      = "\x04"
+	ResetCode         = "\x0f"
+	MonospaceCode     = "\x11"
+	ReverseCode       = "\x16"
+	ItalicCode        = "\x1d"
+	StrikethroughCode = "\x1e"
+	UnderlineCode     = "\x1f"
+	// Every control code removed by Strip
+	controlCodes = BoldCode + ColorCode + HexColorCode + ResetCode + MonospaceCode + ReverseCode + ItalicCode + StrikethroughCode + UnderlineCode
+)
+
+// Color is one of the 16 colors of the mIRC palette
+type Color int
+
+// Colors supported by most clients
+const (
+	White Color = iota
+	Black
+	Blue
+	Green
+	Red
+	Brown
+	Magenta
+	Orange
+	Yellow
+	LightGreen
+	Cyan
+	LightCyan
+	LightBlue
+	Pink
+	Grey
+	LightGrey
+)
+
+// Bold returns the text in bold
+func Bold(text string) string {
+	return wrap(BoldCode, text)
+}
+
+// Italic returns the text in italics
+func Italic(text string) string {
+	return wrap(ItalicCode, text)
+}
+
+// Underline returns the text underlined
+func Underline(text string) string {
+	return wrap(UnderlineCode, text)
+}
+
+// Colored returns the text in the color foreground.
+// The code of the color is always written with two digits, so that a text starting with a digit is not taken for the color.
+func Colored(text string, foreground Color) string {
+	if text == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s%02d%s%s", ColorCode, int(foreground)%16, text, ColorCode)
+}
+
+// Link returns a link with a label: the label is underlined and followed by the address, "label (url)".
+// The address is kept apart from the control codes, some clients would otherwise take the codes for a part of the address.
+func Link(label, url string) string {
+	if label == "" || label == url {
+		return url
+	}
+	return Underline(label) + " (" + url + ")"
+}
+
+// wrap surrounds the text with a control code, which toggles the formatting on and off
+func wrap(code, text string) string {
+	if text == "" {
+		return ""
+	}
+	return code + text + code
+}
+
+// Strip removes the control codes from a text, along with the colors following the color codes
+func Strip(text string) string {
+	if !strings.ContainsAny(text, controlCodes) {
+		return text
+	}
+	stripped := make([]byte, 0, len(text))
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case ColorCode[0]:
+			i = skipColor(text, i+1, isDigit, 2)
+		case HexColorCode[0]:
+			i = skipColor(text, i+1, isHexDigit, 6)
+		default:
+			if strings.IndexByte(controlCodes, text[i]) == -1 {
+				stripped = append(stripped, text[i])
+			}
+			i++
+		}
+	}
+	return string(stripped)
+}
+
+// skipColor returns the index following the colors starting at i ("4", "04,12", "FF0000,000000", ...).
+// A color is made of at most size characters accepted by isValid, the background color is optional.
+func skipColor(text string, i int, isValid func(byte) bool, size int) int {
+	end := skipChars(text, i, isValid, size)
+	if end == i {
+		// No color: the code alone resets the colors
+		return i
+	}
+	if end+1 < len(text) && text[end] == ',' && isValid(text[end+1]) {
+		end = skipChars(text, end+1, isValid, size)
+	}
+	return end
+}
+
+// skipChars returns the index following the characters accepted by isValid starting at i, at most size characters are skipped
+func skipChars(text string, i int, isValid func(byte) bool, size int) int {
+	end := i
+	for end < len(text) && end-i < size && isValid(text[end]) {
+		end++
+	}
+	return end
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,57 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package format
+
+import (
+	"testing"
+)
+
+func Test_Strip(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"plain text", "plain text"},
+		{"\x02bold\x02 and \x1ditalic\x1d, \x1funderlined\x1f", "bold and italic, underlined"},
+		{"\x034red\x03 \x0304,12red on blue\x03", "red red on blue"},
+		{"\x0312345", "345"},
+		{"\x03,12comma kept", ",12comma kept"},
+		{"score\x034,", "score,"},
+		{"\x04FF0000red\x04 \x04ff0000,00FF00red on green\x0f", "red red on green"},
+		{"\x16reverse\x0f \x11mono\x11 \x1estrike\x1e", "reverse mono strike"},
+		{"end with a color\x03", "end with a color"},
+		{"\x01ACTION kept\x01", "\x01ACTION kept\x01"},
+	}
+	for _, test := range tests {
+		if result := Strip(test.text); result != test.expected {
+			t.Errorf("Strip(%q) = %q, expected %q", test.text, result, test.expected)
+		}
+	}
+}
+
+func Test_Formatting(t *testing.T) {
+	tests := []struct {
+		formatted string
+		expected  string
+		stripped  string
+	}{
+		{Bold("bold"), "\x02bold\x02", "bold"},
+		{Italic("italic"), "\x1ditalic\x1d", "italic"},
+		{Underline(""), "", ""},
+		{Colored("1st", Red), "\x03041st\x03", "1st"},
+		{Bold(Colored("nested", LightBlue)) + " text", "\x02\x0312nested\x03\x02 text", "nested text"},
+		{Link("XKCD", "https://xkcd.com/"), "\x1fXKCD\x1f (https://xkcd.com/)", "XKCD (https://xkcd.com/)"},
+		{Link("https://xkcd.com/", "https://xkcd.com/"), "https://xkcd.com/", "https://xkcd.com/"},
+	}
+	for _, test := range tests {
+		if test.formatted != test.expected {
+			t.Errorf("Unexpected formatted text: %q instead of %q", test.formatted, test.expected)
+		}
+		if stripped := Strip(test.formatted); stripped != test.stripped {
+			t.Errorf("Strip(%q) = %q, expected %q", test.formatted, stripped, test.stripped)
+		}
+	}
+}
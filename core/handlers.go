@@ -0,0 +1,113 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Handler is the signature of the command handlers, message handlers and subscribed handlers.
+// callback is to be called by the handler (or not) to send its replies.
+// The handlers run on a pool of workers, with a deadline: long operations must use the context of the event (see Event.Context).
+// A handler returns an error when it could not do its job (database error, unreachable website, ...),
+// the error is logged and, for a command, the user is told that the command failed.
+type Handler func(event *Event, callback func(*ReplyCallbackData)) error
+
+// call calls the handler, a panic of the handler is returned as an error so that it does not stop the bot
+func (handler Handler) call(event *Event, callback func(*ReplyCallbackData)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return handler(event, callback)
+}
+
+// handlerTimeout returns the time given to a handler: the command's timeout, or the network's one
+func (bot *Bot) handlerTimeout(cmd *Command) time.Duration {
+	if cmd != nil && cmd.Timeout > 0 {
+		return cmd.Timeout
+	}
+	if bot.network.HandlerTimeout > 0 {
+		return bot.network.HandlerTimeout
+	}
+	return defaultHandlerTimeout
+}
+
+// runCommand queues a command of a module (empty for the core's commands) for the worker pool, the user is told if the bot is too busy to run it.
+// The role of the user, given by role, is checked and the arguments are parsed before calling the handler.
+// If the handler fails, the error is logged with the command line and its sender, and the user gets a short failure message.
+func (bot *Bot) runCommand(module string, cmd *Command, event *Event, role Role, callback func(*ReplyCallbackData)) {
+	target := GetTargetFromEvent(event)
+	queued := bot.workers.submit(bot.handlerTimeout(cmd), func(ctx context.Context) {
+		// The module cannot be reloaded while its handler runs
+		lock := moduleLock(module)
+		lock.RLock()
+		defer lock.RUnlock()
+		event := event.withContext(ctx)
+		if !bot.checkRole(event, cmd, role, callback) {
+			return
+		}
+		if cmd.hasSpec() {
+			args, err := cmd.Parse(event.Message())
+			if err != nil {
+				bot.replyUsage(event, cmd, err, callback)
+				return
+			}
+			event.Args = args
+		}
+
+		err := cmd.Handler.call(event, callback)
+		if err == nil {
+			return
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("%s (timeout: %s)", err, bot.handlerTimeout(cmd))
+		}
+		log.Printf("Command %q from %s on %s (network %q) failed: %s\n", event.Message(), event.Source, target, bot.network.Name, err)
+		if callback != nil {
+			callback(&ReplyCallbackData{Message: fmt.Sprintf("Sorry, %s failed", bot.trigger(event)), Target: target})
+		}
+	})
+	if !queued && bot.workers.stopping() {
+		log.Printf("Command %q from %s on %s (network %q) ignored: the bot is stopping\n", event.Message(), event.Source, target, bot.network.Name)
+	} else if !queued {
+		log.Printf("Command %q from %s on %s (network %q) refused: too many handlers running\n", event.Message(), event.Source, target, bot.network.Name)
+		if callback != nil {
+			callback(&ReplyCallbackData{Message: fmt.Sprintf("Sorry, I am too busy to run %s, try again later", bot.trigger(event)), Target: target})
+		}
+	}
+}
+
+// trigger returns the trigger of a command event, with its prefix ("!memo")
+func (bot *Bot) trigger(event *Event) string {
+	return bot.Prefix(GetTargetFromEvent(event)) + strings.Fields(event.Message())[0]
+}
+
+// runHandler queues a message handler or a subscribed handler for the worker pool, logging its failure.
+// Nobody asked for anything, so no failure message is sent.
+func (bot *Bot) runHandler(module string, handler Handler, event *Event, callback func(*ReplyCallbackData)) {
+	if module == "" {
+		module = "core"
+	}
+	queued := bot.workers.submit(bot.handlerTimeout(nil), func(ctx context.Context) {
+		lock := moduleLock(module)
+		lock.RLock()
+		defer lock.RUnlock()
+		if err := handler.call(event.withContext(ctx), callback); err != nil {
+			log.Printf("Handler of module %q failed on %q (network %q): %s\n", module, event.Raw, bot.network.Name, err)
+		}
+	})
+	if !queued && !bot.workers.stopping() {
+		log.Printf("Handler of module %q dropped for %q (network %q): too many handlers running\n", module, event.Raw, bot.network.Name)
+	}
+}
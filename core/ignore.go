@@ -0,0 +1,215 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sqlSelectIgnores = "SELECT mask FROM Ignore WHERE network = $1 ORDER BY mask"
+	sqlInsertIgnore  = "INSERT OR REPLACE INTO Ignore (network, mask, added_by) VALUES ($1, $2, $3)"
+	sqlDeleteIgnore  = "DELETE FROM Ignore WHERE network = $1 AND mask = $2"
+)
+
+// normalizeIgnoreMask returns the mask stored in the ignore list for the mask given to the !ignore command:
+// a nick alone ("otherbot") matches every hostmask of the nick ("otherbot!*@*"), the other masks are kept as they are
+func normalizeIgnoreMask(mask string) string {
+	if strings.HasPrefix(mask, accountMaskPrefix) || strings.ContainsAny(mask, "!@") {
+		return mask
+	}
+	return mask + "!*@*"
+}
+
+// ignore is an entry of the ignore list
+type ignore struct {
+	mask  string    // Folded mask
+	until time.Time // End of an automatic ignore, zero for the masks stored in the database
+}
+
+// loadIgnores loads the ignore list of the bot's network from the database
+func (bot *Bot) loadIgnores() {
+	db := getDB()
+	if db == nil {
+		return
+	}
+	rows, err := db.Query(sqlSelectIgnores, bot.network.Name)
+	if err != nil {
+		log.Printf("%q: %s\n", err, sqlSelectIgnores)
+		return
+	}
+	defer rows.Close()
+	var ignores []ignore
+	var mask string
+	for rows.Next() {
+		if err = rows.Scan(&mask); err != nil {
+			log.Println(err)
+			return
+		}
+		ignores = append(ignores, ignore{mask: mask})
+	}
+	if err = rows.Err(); err != nil {
+		log.Println(err)
+		return
+	}
+	bot.ignoresMutex.Lock()
+	bot.ignores = ignores
+	bot.ignoresMutex.Unlock()
+}
+
+// ignoreList returns the masks ignored on the bot's network, the automatic ignores are followed by their remaining time
+func (bot *Bot) ignoreList() (masks []string) {
+	now := time.Now()
+	bot.ignoresMutex.RLock()
+	defer bot.ignoresMutex.RUnlock()
+	for _, entry := range bot.ignores {
+		if entry.until.IsZero() {
+			masks = append(masks, entry.mask)
+		} else if now.Before(entry.until) {
+			masks = append(masks, fmt.Sprintf("%s (automatic, %s left)", entry.mask, roundWait(entry.until.Sub(now))))
+		}
+	}
+	sort.Strings(masks)
+	return masks
+}
+
+// addIgnore adds a folded mask to the ignore list, until the end of an automatic ignore or forever if until is zero.
+// It returns false if the mask is already ignored forever.
+func (bot *Bot) addIgnore(mask string, until time.Time) bool {
+	bot.ignoresMutex.Lock()
+	defer bot.ignoresMutex.Unlock()
+	if bot.ignoredForever(mask) {
+		return false
+	}
+	bot.ignores = append(bot.ignores, ignore{mask: mask, until: until})
+	return true
+}
+
+// ignoredForever checks if a folded mask is in the ignore list, not automatically ignored. The caller must hold ignoresMutex.
+func (bot *Bot) ignoredForever(mask string) bool {
+	for _, entry := range bot.ignores {
+		if entry.mask == mask && entry.until.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// removeIgnore removes the entries of the ignore list matching remove, and returns the number of entries removed
+func (bot *Bot) removeIgnore(remove func(ignore) bool) (removed int) {
+	bot.ignoresMutex.Lock()
+	defer bot.ignoresMutex.Unlock()
+	kept := bot.ignores[:0]
+	for _, entry := range bot.ignores {
+		if remove(entry) {
+			removed++
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	bot.ignores = kept
+	return removed
+}
+
+// ignoreAutomatically ignores the sender of the event for a while, the entry is removed from the ignore list at the end of the ignore
+func (bot *Bot) ignoreAutomatically(event *Event, duration time.Duration) {
+	mask, until := bot.fold(rateMask(event)), time.Now().Add(duration)
+	if !bot.addIgnore(mask, until) {
+		return
+	}
+	time.AfterFunc(duration, func() {
+		bot.removeIgnore(func(entry ignore) bool { return entry.mask == mask && entry.until.Equal(until) })
+	})
+}
+
+// isIgnored checks if the sender of the event is ignored: its messages are not given to the commands and to the handlers.
+// A user is ignored when a mask of the ignore list matches it, the list containing the automatic ignores of the users going over the rate limits.
+// The owners are never ignored, so that they can always manage the ignore list.
+func (bot *Bot) isIgnored(event *Event) bool {
+	for _, mask := range bot.network.Owners {
+		if MatchMask(mask, event) {
+			return false
+		}
+	}
+	now := time.Now()
+	bot.ignoresMutex.RLock()
+	defer bot.ignoresMutex.RUnlock()
+	for _, entry := range bot.ignores {
+		if (entry.until.IsZero() || now.Before(entry.until)) && MatchMask(entry.mask, event) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleIgnoreCmd handles the !ignore command: "!ignore <mask>" adds a mask to the ignore list, "!ignore" lists the ignored masks.
+// The mask is a nick, a hostmask or "account:<account name>", see MatchMask. It is stored folded, following the case mapping of the network.
+func (bot *Bot) handleIgnoreCmd(event *Event, callback func(*ReplyCallbackData)) error {
+	target := GetTargetFromEvent(event)
+	if getDB() == nil {
+		callback(&ReplyCallbackData{Message: "The ignore list cannot be used without a database", Target: target})
+		return nil
+	}
+	if !event.Args.Has("mask") {
+		masks := bot.ignoreList()
+		if len(masks) == 0 {
+			callback(&ReplyCallbackData{Message: "Nobody is ignored", Target: target})
+			return nil
+		}
+		callback(&ReplyCallbackData{Results: &ResultSet{Lines: masks}, Target: target})
+		return nil
+	}
+
+	mask := normalizeIgnoreMask(event.Args.String("mask"))
+	bot.ignoresMutex.RLock()
+	ignored := bot.ignoredForever(bot.fold(mask))
+	bot.ignoresMutex.RUnlock()
+	if ignored {
+		callback(&ReplyCallbackData{Message: fmt.Sprintf("%q is already ignored", mask), Target: target})
+		return nil
+	}
+	// The ignore list is only changed once the mask is stored, so that it is the same after a restart
+	if _, err := getDB().Exec(sqlInsertIgnore, bot.network.Name, bot.fold(mask), event.Nick); err != nil {
+		log.Printf("%q: %s\n", err, sqlInsertIgnore)
+		callback(&ReplyCallbackData{Message: "Ignore command failed: unable to store the mask", Target: target})
+		return nil
+	}
+	bot.addIgnore(bot.fold(mask), time.Time{})
+	log.Printf("%q ignored by %s for network %q\n", mask, event.Nick, bot.network.Name)
+	callback(&ReplyCallbackData{Message: fmt.Sprintf("%q ignored", mask), Target: target})
+	return nil
+}
+
+// handleUnignoreCmd handles the !unignore command: "!unignore <mask>" removes a mask from the ignore list.
+func (bot *Bot) handleUnignoreCmd(event *Event, callback func(*ReplyCallbackData)) error {
+	target := GetTargetFromEvent(event)
+	if getDB() == nil {
+		callback(&ReplyCallbackData{Message: "The ignore list cannot be used without a database", Target: target})
+		return nil
+	}
+	mask := normalizeIgnoreMask(event.Args.String("mask"))
+	bot.ignoresMutex.RLock()
+	ignored := bot.ignoredForever(bot.fold(mask))
+	bot.ignoresMutex.RUnlock()
+	if !ignored {
+		callback(&ReplyCallbackData{Message: fmt.Sprintf("%q is not ignored", mask), Target: target})
+		return nil
+	}
+	if _, err := getDB().Exec(sqlDeleteIgnore, bot.network.Name, bot.fold(mask)); err != nil {
+		log.Printf("%q: %s\n", err, sqlDeleteIgnore)
+		callback(&ReplyCallbackData{Message: "Unignore command failed: unable to remove the mask", Target: target})
+		return nil
+	}
+	bot.removeIgnore(func(entry ignore) bool { return entry.mask == bot.fold(mask) && entry.until.IsZero() })
+	log.Printf("%q no longer ignored, removed by %s for network %q\n", mask, event.Nick, bot.network.Name)
+	callback(&ReplyCallbackData{Message: fmt.Sprintf("%q no longer ignored", mask), Target: target})
+	return nil
+}
@@ -0,0 +1,60 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_normalizeIgnoreMask(t *testing.T) {
+	tests := []struct {
+		mask     string
+		expected string
+	}{
+		{"OtherBot", "OtherBot!*@*"},
+		{"OtherBot!*@*", "OtherBot!*@*"},
+		{"*!*@bots.example.org", "*!*@bots.example.org"},
+		{"*@bots.example.org", "*@bots.example.org"},
+		{"account:OtherBot", "account:OtherBot"},
+	}
+	for _, test := range tests {
+		if mask := normalizeIgnoreMask(test.mask); mask != test.expected {
+			t.Errorf("normalizeIgnoreMask(%q) = %q instead of %q", test.mask, mask, test.expected)
+		}
+	}
+}
+
+func Test_isIgnored(t *testing.T) {
+	bot := NewBotWithTransport(Network{Name: "test_ignore", Nick: "goxxx", Owners: []string{"Owner!*@*"}}, newFakeTransport())
+	defer bot.Stop()
+
+	bot.addIgnore("otherbot!*@*", time.Time{})
+	bot.addIgnore("owner!*@*", time.Time{})
+	if bot.addIgnore("otherbot!*@*", time.Time{}) {
+		t.Error("Mask added twice to the ignore list")
+	}
+	if !bot.isIgnored(&Event{Network: "test_ignore", Nick: "OtherBot", User: "bot", Host: "bots.example.org"}) {
+		t.Error("Ignored user not ignored")
+	}
+	if bot.isIgnored(&Event{Network: "test_ignore", Nick: "Owner", User: "owner", Host: "example.org"}) {
+		t.Error("Owner ignored")
+	}
+
+	// The automatic ignores are removed from the list once they are over
+	flooder := &Event{Network: "test_ignore", Nick: "Flooder", User: "flood", Host: "Example.org"}
+	bot.ignoreAutomatically(flooder, 50*time.Millisecond)
+	if !bot.isIgnored(flooder) || !bot.isIgnored(&Event{Network: "test_ignore", Nick: "Renamed", User: "flood", Host: "example.org"}) {
+		t.Error("User not ignored automatically")
+	}
+	if masks := bot.ignoreList(); len(masks) != 3 || masks[0] != "*!flood@example.org (automatic, 1s left)" {
+		t.Errorf("Unexpected ignore list: %q", masks)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if bot.isIgnored(flooder) || len(bot.ignoreList()) != 2 {
+		t.Errorf("Automatic ignore not removed: %q", bot.ignoreList())
+	}
+}
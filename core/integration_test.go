@@ -0,0 +1,1057 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core_test
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/vaz-ar/goxxx/core"
+	"github.com/vaz-ar/goxxx/core/format"
+	"github.com/vaz-ar/goxxx/core/irctest"
+	"github.com/vaz-ar/goxxx/database"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testNick      = "goxxx"
+	testOwner     = "Owner"
+	testChannel   = "#test_channel"
+	testTimeout   = 5 * time.Second
+	testFloodRate = 200 * time.Millisecond
+)
+
+// startBot starts a test server and a bot connected to it, the returned function stops both.
+// The bot can send one message every testFloodRate, and testOwner is the owner of the bot.
+func startBot(t *testing.T, channels []core.Channel, setup func(*irctest.Server, *core.Bot)) (*irctest.Server, *core.Bot, func()) {
+	return startBotWith(t, func(network *core.Network) { network.Channels = channels }, setup)
+}
+
+// startBotWith starts a test server and a bot connected to it, configure can change the network used by the bot
+func startBotWith(t *testing.T, configure func(*core.Network), setup func(*irctest.Server, *core.Bot)) (*irctest.Server, *core.Bot, func()) {
+	server, err := irctest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startBotOn(server, configure, setup)
+}
+
+// startBotOn starts a bot connected to server, the returned function stops both
+func startBotOn(server *irctest.Server, configure func(*core.Network), setup func(*irctest.Server, *core.Bot)) (*irctest.Server, *core.Bot, func()) {
+	network := core.Network{
+		Name:       "test_network",
+		Server:     server.Addr(),
+		Nick:       testNick,
+		FloodBurst: 1,
+		FloodRate:  testFloodRate,
+		Owners:     []string{testOwner + "!*@*"}}
+	configure(&network)
+	bot := core.NewBot(network)
+	if setup != nil {
+		setup(server, bot)
+	}
+	go bot.Run()
+	return server, bot, func() {
+		bot.Stop()
+		server.Close()
+	}
+}
+
+// waitFor fails the test if no line sent by the bot matches pattern
+func waitFor(t *testing.T, server *irctest.Server, pattern string) irctest.Line {
+	line, ok := server.WaitFor(pattern, 0, testTimeout)
+	if !ok {
+		t.Fatalf("No line matching %q sent by the bot, lines received by the server: %q", pattern, server.Received())
+	}
+	return line
+}
+
+// echoCommand returns a command replying with its arguments
+func echoCommand(calls chan<- *core.Event) *core.Command {
+	return &core.Command{
+		Triggers: []string{"echo"},
+		Handler: func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+			if calls != nil {
+				calls <- event
+			}
+			callback(&core.ReplyCallbackData{
+				Message: event.Message()[len("echo "):],
+				Target:  core.GetTargetFromEvent(event)})
+			return nil
+		}}
+}
+
+func Test_Registration(t *testing.T) {
+	server, _, stop := startBot(t, []core.Channel{{Name: testChannel}}, nil)
+	defer stop()
+
+	waitFor(t, server, "^NICK "+testNick+"$")
+	waitFor(t, server, "^USER ")
+}
+
+func Test_JoinOnWelcome(t *testing.T) {
+	channels := []core.Channel{{Name: testChannel}, {Name: "#keyed_channel", Key: "secret"}}
+	server, _, stop := startBot(t, channels, func(server *irctest.Server, bot *core.Bot) {
+		server.SetChannelKey("#keyed_channel", "secret")
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	waitFor(t, server, "^JOIN #keyed_channel secret$")
+
+	for _, channel := range channels {
+		if members := server.Members(channel.Name); len(members) != 1 || members[0] != testNick {
+			t.Errorf("Bot not in %s, members: %q", channel.Name, members)
+		}
+	}
+}
+
+func Test_CommandDispatch(t *testing.T) {
+	calls := make(chan *core.Event, 1)
+	server, _, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser("Sender", testChannel, "")
+		bot.AddCmdHandler(echoCommand(calls), bot.Reply)
+	})
+	defer stop()
+
+	// The user list is received in the NAMES reply sent after joining the channel
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	server.Say("Sender", testChannel, "!echo hello world")
+
+	select {
+	case event := <-calls:
+		if event.Nick != "Sender" || event.Network != "test_network" {
+			t.Errorf("Unexpected event: %#v", event)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Command handler not called")
+	}
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :hello world$")
+
+	// Private message
+	server.Say("Sender", testNick, "!echo private")
+	waitFor(t, server, "^PRIVMSG Sender :private$")
+}
+
+func Test_CommandPrefix(t *testing.T) {
+	channels := []core.Channel{{Name: testChannel}, {Name: "#other_channel", Prefix: "?"}}
+	server, _, stop := startBot(t, channels, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser("Sender", testChannel, "")
+		server.AddUser("Sender", "#other_channel", "")
+		bot.AddCmdHandler(echoCommand(nil), bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN #other_channel$")
+	server.Say("Sender", "#other_channel", "!echo default prefix")
+	server.Say("Sender", "#other_channel", "?echo channel prefix")
+	waitFor(t, server, "^PRIVMSG #other_channel :channel prefix$")
+	server.Say("Sender", testChannel, testNick+": echo addressed")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :addressed$")
+	server.Say("Sender", testNick, "echo private")
+	waitFor(t, server, "^PRIVMSG Sender :private$")
+	if count := server.Count("default prefix"); count != 0 {
+		t.Errorf("Command with the network's prefix run on a channel with its own prefix")
+	}
+}
+
+func Test_CommandUsage(t *testing.T) {
+	calls := make(chan *core.Event, 1)
+	server, _, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser("Sender", testChannel, "")
+		bot.AddCmdHandler(&core.Command{
+			Triggers: []string{"repeat"},
+			Args:     []core.Arg{{Name: "count", Type: core.ArgInt}, {Name: "text", Rest: true}},
+			Flags:    []core.Flag{{Name: "loud"}},
+			Handler: func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+				calls <- event
+				return nil
+			}}, bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	server.Say("Sender", testChannel, "!repeat twice hello")
+	waitFor(t, server, `^PRIVMSG `+testChannel+` :Invalid command: <count> must be a number, not "twice"\. Usage: !repeat <count> <text\.\.\.> \[--loud\]$`)
+
+	server.Say("Sender", testChannel, `!repeat 2 --loud "hello"  world`)
+	select {
+	case event := <-calls:
+		if event.Args.Int("count") != 2 || event.Args.String("text") != `"hello"  world` || !event.Args.Flag("loud") {
+			t.Errorf("Unexpected arguments: %#v", event.Args)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Command handler not called")
+	}
+}
+
+func Test_HandlerFailures(t *testing.T) {
+	server, _, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser("Sender", testChannel, "")
+		bot.AddCmdHandler(echoCommand(nil), bot.Reply)
+		bot.AddCmdHandler(&core.Command{
+			Triggers: []string{"fail"},
+			Handler: func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+				return errors.New("database is locked")
+			}}, bot.Reply)
+		bot.AddCmdHandler(&core.Command{
+			Triggers: []string{"panic"},
+			Handler: func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+				var results *core.ResultSet
+				return fmt.Errorf("%d results", len(results.Lines))
+			}}, bot.Reply)
+		bot.AddCmdHandler(&core.Command{
+			Triggers: []string{"slow"},
+			Timeout:  50 * time.Millisecond,
+			Handler: func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+				<-event.Context().Done()
+				return event.Context().Err()
+			}}, bot.Reply)
+		bot.AddMsgHandler(func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+			panic("message handler failure")
+		}, bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	server.Say("Sender", testChannel, "!fail")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :Sorry, !fail failed$")
+	server.Say("Sender", testChannel, "!panic")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :Sorry, !panic failed$")
+	server.Say("Sender", testChannel, "!slow")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :Sorry, !slow failed$")
+	// The bot is still running
+	server.Say("Sender", testChannel, "!echo still alive")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :still alive$")
+	if count := server.Count("database is locked"); count != 0 {
+		t.Errorf("The details of the error were sent to the user")
+	}
+}
+
+func Test_Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	server, bot, stop := startBotWith(t, func(network *core.Network) {
+		network.Channels = []core.Channel{{Name: testChannel}}
+		network.QuitMessage = "See you later"
+	}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser("Sender", testChannel, "")
+		bot.AddCmdHandler(&core.Command{
+			Triggers: []string{"slow"},
+			Handler: func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+				close(started)
+				time.Sleep(200 * time.Millisecond)
+				for i := 1; i <= 3; i++ {
+					callback(&core.ReplyCallbackData{Message: fmt.Sprintf("result %d", i), Target: core.GetTargetFromEvent(event)})
+				}
+				return nil
+			}}, bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	server.Say("Sender", testChannel, "!slow")
+	<-started
+	bot.Shutdown(testTimeout)
+
+	// The running command finished and its replies were sent before the bot quit
+	quit := waitFor(t, server, "^QUIT :See you later$")
+	for i := 1; i <= 3; i++ {
+		if line := waitFor(t, server, fmt.Sprintf("^PRIVMSG %s :result %d$", testChannel, i)); indexOf(server, line) > indexOf(server, quit) {
+			t.Errorf("Reply %d sent after QUIT", i)
+		}
+	}
+}
+
+func Test_RateLimit(t *testing.T) {
+	var heard int32
+	server, _, stop := startBotWith(t, func(network *core.Network) {
+		network.Channels = []core.Channel{{Name: testChannel}}
+		network.RateLimit = 2
+		network.RateWindow = time.Minute
+	}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser("Sender", testChannel, "")
+		server.AddUser(testOwner, testChannel, "")
+		bot.AddCmdHandler(echoCommand(nil), bot.Reply)
+		bot.AddMsgHandler(func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+			if event.Message() == "still there?" {
+				atomic.AddInt32(&heard, 1)
+			}
+			return nil
+		}, bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	for i := 1; i <= 5; i++ {
+		server.Say("Sender", testChannel, fmt.Sprintf("!echo sender %d", i))
+	}
+	server.Say("Sender", testChannel, "still there?")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :sender 2$")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :Sender: please slow down, you can run !echo again in [0-9ms]+$")
+
+	// The owner is not limited
+	for i := 1; i <= 3; i++ {
+		server.Say(testOwner, testChannel, fmt.Sprintf("!echo owner %d", i))
+	}
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :owner 3$")
+
+	// The sender was warned once, then ignored
+	if count := server.Count("sender [345]$"); count != 0 {
+		t.Errorf("%d commands run over the rate limit", count)
+	}
+	if count := server.Count("slow down"); count != 1 {
+		t.Errorf("%d warnings sent instead of 1", count)
+	}
+	if atomic.LoadInt32(&heard) != 0 {
+		t.Errorf("Message of an ignored user given to the message handlers")
+	}
+}
+
+func Test_Capabilities(t *testing.T) {
+	calls := make(chan *core.Event, 10)
+	server, _, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser("Sender", testChannel, "")
+		server.SetUserAccount("Sender", "sender_account")
+		server.SetUserAccount("Member", "member_account")
+		bot.AddCmdHandler(echoCommand(calls), bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	for _, capability := range irctest.Capabilities {
+		if !server.Enabled(capability) {
+			t.Errorf("Capability %q not enabled", capability)
+		}
+	}
+
+	// account-tag and message-tags
+	server.Say("Sender", testChannel, "!echo !echo echoed")
+	if event := <-calls; event.Account != "sender_account" || event.MessageID == "" {
+		t.Errorf("Account and message ID not set from the tags: %#v", event)
+	}
+	// server-time
+	server.Send("@time=2016-05-01T12:30:00.000Z :Sender!sender@127.0.0.1 PRIVMSG " + testChannel + " :!echo late")
+	if event := <-calls; !event.Time.Equal(time.Date(2016, time.May, 1, 12, 30, 0, 0, time.UTC)) {
+		t.Errorf("Time not set from the server-time tag: %s", event.Time)
+	}
+
+	// extended-join and account-notify, for the messages without account tag
+	server.Join("Member", testChannel)
+	server.Send(":Member!member@127.0.0.1 PRIVMSG " + testChannel + " :!echo logged in")
+	if event := <-calls; event.Account != "member_account" {
+		t.Errorf("Account from the extended JOIN not used: %#v", event)
+	}
+	server.SetUserAccount("Member", "")
+	server.Send(":Member!member@127.0.0.1 PRIVMSG " + testChannel + " :!echo logged out")
+	if event := <-calls; event.Account != "" {
+		t.Errorf("Account kept after the user logged out: %#v", event)
+	}
+
+	// echo-message: the bot's messages sent back by the server are ignored
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :logged out$")
+	if count := server.Count("^PRIVMSG " + testChannel + " :echoed$"); count != 0 {
+		t.Errorf("Command run from a message of the bot")
+	}
+}
+
+func Test_CTCP(t *testing.T) {
+	core.SetVersion("v1.2", "2017-05-01")
+	defer core.SetVersion("", "")
+	actions := make(chan *core.Event, 1)
+	server, _, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser("Sender", testChannel, "")
+		bot.AddCmdHandler(echoCommand(nil), bot.Reply)
+		bot.AddCmdHandler(&core.Command{
+			Triggers: []string{"wave"},
+			Handler: func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+				callback(&core.ReplyCallbackData{Message: "waves back", Target: core.GetTargetFromEvent(event), Action: true})
+				return nil
+			}}, bot.Reply)
+		bot.AddMsgHandler(func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+			if event.Action {
+				actions <- event
+			}
+			return nil
+		}, bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	server.Say("Sender", testNick, "\x01VERSION\x01")
+	waitFor(t, server, "^NOTICE Sender :\x01VERSION goxxx v1.2 \\(built 2017-05-01\\)\x01$")
+	// Answered once per second at most
+	server.Say("Sender", testNick, "\x01TIME\x01")
+	time.Sleep(1100 * time.Millisecond)
+	server.Say("Sender", testNick, "\x01PING 1234\x01")
+	waitFor(t, server, "^NOTICE Sender :\x01PING 1234\x01$")
+	if count := server.Count("VERSION"); count != 1 {
+		t.Errorf("VERSION answered %d times instead of once", count)
+	}
+	if count := server.Count("TIME"); count != 0 {
+		t.Errorf("Query answered too soon after the previous one")
+	}
+
+	// The actions are given to the message handlers, they are not commands
+	server.Say("Sender", testChannel, "\x01ACTION !echo hi\x01")
+	select {
+	case event := <-actions:
+		if event.Message() != "!echo hi" {
+			t.Errorf("Unexpected message for an action: %q", event.Message())
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Action not given to the message handlers")
+	}
+	// The modules can reply with actions
+	server.Say("Sender", testChannel, "!wave")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :\x01ACTION waves back\x01$")
+	if count := server.Count("^PRIVMSG " + testChannel + " :hi$"); count != 0 {
+		t.Errorf("Action run as a command")
+	}
+}
+
+func Test_Formatting(t *testing.T) {
+	server, _, stop := startBotWith(t, func(network *core.Network) {
+		network.Channels = []core.Channel{{Name: testChannel}}
+		network.PlainText = true
+	}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser("Sender", testChannel, "")
+		bot.AddCmdHandler(echoCommand(nil), bot.Reply)
+		bot.AddCmdHandler(&core.Command{
+			Triggers: []string{"bold"},
+			Handler: func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+				callback(&core.ReplyCallbackData{Message: format.Bold("plain") + " " + format.Link("text", "https://example.org/"), Target: core.GetTargetFromEvent(event)})
+				return nil
+			}}, bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	// The formatting is removed before parsing the commands
+	server.Say("Sender", testChannel, "\x02!echo\x02 \x0304,12colored\x03 \x1ftext\x1f")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :colored text$")
+	// and from the replies on a network using plain text
+	server.Say("Sender", testChannel, "!bold")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :plain text \\(https://example.org/\\)$")
+}
+
+func Test_CommandFromUnknownUser(t *testing.T) {
+	calls := make(chan *core.Event, 1)
+	server, _, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		bot.AddCmdHandler(echoCommand(calls), bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	server.Say("Stranger", testChannel, "!echo hello")
+
+	select {
+	case event := <-calls:
+		t.Errorf("Command handler called for a user not in the channel: %#v", event)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if count := server.Count("^NAMES "); count != 0 {
+		t.Errorf("%d NAMES commands sent, the members must be tracked from the events", count)
+	}
+}
+
+func Test_MembersTracking(t *testing.T) {
+	calls := make(chan *core.Event, 1)
+	server, bot, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser("Present", testChannel, "+")
+		bot.AddCmdHandler(echoCommand(calls), bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	// The user joins after the bot, it is known from its JOIN message
+	server.Join("Latecomer", testChannel)
+	server.Say("Latecomer", testChannel, "!echo hello")
+	select {
+	case <-calls:
+	case <-time.After(testTimeout):
+		t.Fatal("Command handler not called for a user who joined the channel")
+	}
+
+	server.Send(":" + irctest.ServerName + " MODE " + testChannel + " +o-v Latecomer Present")
+	server.Send(":Latecomer!latecomer@127.0.0.1 NICK :Renamed")
+	server.Part("Present", testChannel)
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :hello$")
+	// The events are processed in order, a command sent after the changes is run once they are applied
+	server.Say("Renamed", testChannel, "!echo sync")
+	select {
+	case <-calls:
+	case <-time.After(testTimeout):
+		t.Fatal("Command handler not called for a renamed user")
+	}
+
+	members := bot.Members(testChannel)
+	if len(members) != 2 || members[0].Nick != testNick || members[1].Nick != "Renamed" || !members[1].IsOperator() {
+		t.Errorf("Unexpected members: %+v", members)
+	}
+	if count := server.Count("^NAMES "); count != 0 {
+		t.Errorf("%d NAMES commands sent, the members must be tracked from the events", count)
+	}
+}
+
+func Test_ReplyThrottling(t *testing.T) {
+	server, _, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser("Sender", testChannel, "")
+		server.AddUser("Other", testChannel, "")
+		bot.AddCmdHandler(echoCommand(nil), bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	server.Say("Sender", testChannel, "!echo first")
+	server.Say("Other", testChannel, "!echo second")
+
+	first := waitFor(t, server, "^PRIVMSG "+testChannel+" :(first|second)$")
+	second, ok := server.WaitFor("^PRIVMSG "+testChannel+" :(first|second)$", indexOf(server, first)+1, testTimeout)
+	if !ok {
+		t.Fatalf("Second reply not sent, lines received by the server: %q", server.Received())
+	}
+	if delay := second.Time.Sub(first.Time); delay < testFloodRate-10*time.Millisecond {
+		t.Errorf("Replies not throttled, delay between the replies: %s", delay)
+	}
+}
+
+func Test_SupersededReplies(t *testing.T) {
+	server, _, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser("Sender", testChannel, "")
+		bot.AddCmdHandler(&core.Command{
+			Triggers: []string{"count"},
+			Handler: func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+				for i := 1; i <= 5; i++ {
+					callback(&core.ReplyCallbackData{
+						Message: fmt.Sprintf("%s: counting for a while, line #%d", event.Message(), i),
+						Target:  core.GetTargetFromEvent(event)})
+				}
+				return nil
+			}}, bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	server.Say("Sender", testChannel, "!count first")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :count first: counting for a while, line #1$")
+	server.Say("Sender", testChannel, "!count second")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :count second: counting for a while, line #5$")
+
+	if count := server.Count("^PRIVMSG .*:count first"); count == 5 {
+		t.Errorf("Replies of the first invocation not cancelled by the second one")
+	}
+}
+
+// indexOf returns the index of a line in the lines received by the server
+func indexOf(server *irctest.Server, line irctest.Line) int {
+	for i, received := range server.Received() {
+		if received == line {
+			return i
+		}
+	}
+	return -1
+}
+
+func Test_LongReplies(t *testing.T) {
+	words := strings.Repeat("lorem ipsum dolor sit amet ", 50)
+	server, _, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser("Sender", testChannel, "")
+		bot.AddCmdHandler(&core.Command{
+			Triggers: []string{"long"},
+			Handler: func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+				callback(&core.ReplyCallbackData{
+					Message: "Title\r\nQUIT :injected\n" + words,
+					Target:  core.GetTargetFromEvent(event)})
+				return nil
+			}}, bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	server.Say("Sender", testChannel, "!long")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :.*amet$")
+
+	var parts []string
+	for _, line := range server.Received() {
+		if strings.HasPrefix(line.Text, "QUIT") {
+			t.Errorf("Raw command injected: %q", line.Text)
+		}
+		if !strings.HasPrefix(line.Text, "PRIVMSG ") {
+			continue
+		}
+		// Length of the line relayed by the server to the other users
+		if length := len(":" + testNick + "!" + testNick + "@127.0.0.1 " + line.Text + "\r\n"); length > 512 {
+			t.Errorf("Line too long (%d bytes): %q", length, line.Text)
+		}
+		parts = append(parts, strings.TrimPrefix(line.Text, "PRIVMSG "+testChannel+" :"))
+	}
+	if len(parts) < 3 {
+		t.Errorf("Reply not split: %q", parts)
+	}
+	if message, expected := strings.Join(parts, " "), "Title QUIT :injected "+strings.TrimSpace(words); message != expected {
+		t.Errorf("Incorrect reply: %q instead of %q", message, expected)
+	}
+}
+
+func Test_MoreResults(t *testing.T) {
+	server, _, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser("Sender", testChannel, "")
+		server.AddUser("Other", testChannel, "")
+		bot.AddCmdHandler(&core.Command{
+			Triggers: []string{"list"},
+			Handler: func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+				var results core.ResultSet
+				for i := 1; i <= 6; i++ {
+					results.Lines = append(results.Lines, fmt.Sprintf("result #%d", i))
+				}
+				callback(&core.ReplyCallbackData{Results: &results, Target: core.GetTargetFromEvent(event)})
+				return nil
+			}}, bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	server.Say("Sender", testChannel, "!list")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :2 more result\\(s\\), type !more to display them$")
+	if server.Count("result #5") != 0 {
+		t.Errorf("Results sent beyond the first page: %q", server.Received())
+	}
+
+	// The remaining results are kept for the user who ran the command
+	server.Say("Other", testChannel, "!more")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :No more results$")
+
+	// The words following the trigger are ignored
+	server.Say("Sender", testChannel, "!more please")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :result #6$")
+	server.Say("Sender", testChannel, "!more")
+	first := waitFor(t, server, "^PRIVMSG "+testChannel+" :No more results$")
+	if _, ok := server.WaitFor("^PRIVMSG "+testChannel+" :No more results$", indexOf(server, first)+1, testTimeout); !ok {
+		t.Errorf("Results not forgotten once displayed: %q", server.Received())
+	}
+}
+
+// counterModule is a module counting its initialisations, with a "!counter" command replying with the count
+type counterModule struct {
+	inits int32
+}
+
+func (module *counterModule) Name() string { return "test_counter" }
+func (module *counterModule) Init(dependencies *core.Dependencies) error {
+	atomic.AddInt32(&module.inits, 1)
+	return nil
+}
+func (module *counterModule) Commands() []*core.Command {
+	return []*core.Command{{
+		Module:   "test_counter",
+		Triggers: []string{"counter"},
+		Handler: func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+			callback(&core.ReplyCallbackData{
+				Message: fmt.Sprintf("initialised %d time(s)", atomic.LoadInt32(&module.inits)),
+				Target:  core.GetTargetFromEvent(event)})
+			return nil
+		}}}
+}
+func (module *counterModule) MsgHandlers() []core.MsgHandler     { return nil }
+func (module *counterModule) Subscriptions() []core.Subscription { return nil }
+func (module *counterModule) Shutdown()                          {}
+
+var testCounterModule = &counterModule{}
+
+func init() {
+	core.RegisterModule(testCounterModule)
+}
+
+// testDB is the database created by useTestDatabase
+var testDB *sql.DB
+
+// useTestDatabase creates a database in a temporary directory and gives it to the modules, the returned function removes it
+func useTestDatabase(t *testing.T) func() {
+	directory, err := ioutil.TempDir("", "goxxx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := database.NewDatabase(filepath.Join(directory, "tests.sqlite"), "../database/migrations", true)
+	core.SetDependencies(&core.Dependencies{DB: db})
+	testDB = db
+	return func() {
+		core.ShutdownModules()
+		core.SetDependencies(nil)
+		db.Close()
+		os.RemoveAll(directory)
+	}
+}
+
+func Test_ModuleCommand(t *testing.T) {
+	defer useTestDatabase(t)()
+
+	server, bot, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser(testOwner, testChannel, "")
+		server.AddUser("Sender", testChannel, "@")
+	})
+	stopped := false
+	defer func() {
+		if !stopped {
+			stop()
+		}
+	}()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	server.Say("Sender", testChannel, "!module enable test_counter")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :You need the \"admin\" role to run this command$")
+
+	server.Say(testOwner, testChannel, "!module enable test_counter")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :Module \"test_counter\" enabled$")
+	server.Say("Sender", testChannel, "!counter")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :initialised 1 time\\(s\\)$")
+
+	server.Say(testOwner, testChannel, "!module reload test_counter")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :Module \"test_counter\" reloaded$")
+	server.Say("Sender", testChannel, "!counter")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :initialised 2 time\\(s\\)$")
+
+	server.Say(testOwner, testChannel, "!module list")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :Enabled modules: test_counter \\(available modules: .*test_counter.*\\)$")
+
+	server.Say(testOwner, testChannel, "!module disable test_counter")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :Module \"test_counter\" disabled$")
+	if modules := bot.Modules(); len(modules) != 0 {
+		t.Errorf("Modules still loaded after being disabled: %q", modules)
+	}
+
+	// The disabled state is kept for the next start, even if the module is in the configured list
+	stop()
+	stopped = true
+	restarted := core.NewBot(core.Network{Name: "test_network"})
+	defer restarted.Stop()
+	restarted.StartModules([]string{"test_counter"})
+	if modules := restarted.Modules(); len(modules) != 0 {
+		t.Errorf("Disabled module loaded at startup: %q", modules)
+	}
+}
+
+func Test_Roles(t *testing.T) {
+	defer useTestDatabase(t)()
+
+	server, _, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser(testOwner, testChannel, "")
+		server.AddUser("Sender", testChannel, "")
+		server.AddUser("Other", testChannel, "")
+		bot.AddCmdHandler(&core.Command{
+			Triggers: []string{"secret"},
+			Role:     core.RoleTrusted,
+			Handler: func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+				callback(&core.ReplyCallbackData{Message: "secret for " + event.Nick, Target: core.GetTargetFromEvent(event)})
+				return nil
+			}}, bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	server.Say("Sender", testChannel, "!secret")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :You need the \"trusted\" role to run this command$")
+
+	server.Say(testOwner, testChannel, "!grant Sender!*@* trusted")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :Role \"trusted\" granted to \"Sender!\\*@\\*\"$")
+	server.Say("Sender", testChannel, "!secret")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :secret for Sender$")
+
+	// Only more privileged users can manage roles
+	server.Say("Sender", testChannel, "!grant Other!*@* trusted")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :You need the \"admin\" role to run this command$")
+
+	// Banned users cannot run any command
+	server.Say(testOwner, testChannel, "!grant Other!*@* banned")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :Role \"banned\" granted to \"Other!\\*@\\*\"$")
+	server.Say("Other", testChannel, "!secret")
+	server.Say(testOwner, testChannel, "!revoke Sender!*@*")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :Role \"trusted\" revoked from \"Sender!\\*@\\*\"$")
+	if server.Count("secret for Other") != 0 {
+		t.Errorf("Banned user got a reply: %q", server.Received())
+	}
+
+	server.Say("Sender", testChannel, "!secret")
+	first := waitFor(t, server, "^PRIVMSG "+testChannel+" :You need the \"trusted\" role to run this command$")
+	if _, ok := server.WaitFor("^PRIVMSG "+testChannel+" :You need the \"trusted\" role to run this command$", indexOf(server, first)+1, testTimeout); !ok {
+		t.Errorf("Role not revoked: %q", server.Received())
+	}
+
+	// The administrators cannot manage the masks matching the owners or the other administrators
+	server.Say(testOwner, testChannel, "!grant Sender!*@* admin")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :Role \"admin\" granted to \"Sender!\\*@\\*\"$")
+	server.Say("Sender", testChannel, "!grant *!*@* banned")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :\"\\*!\\*@\\*\" matches an owner of the bot$")
+	server.Say("Sender", testChannel, "!grant Sender!~sender@* banned")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :You cannot manage the \"admin\" role$")
+	server.Say(testOwner, testChannel, "!secret")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :secret for "+testOwner+"$")
+}
+
+func Test_Ignore(t *testing.T) {
+	defer useTestDatabase(t)()
+
+	var heard int32
+	server, _, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		server.AddUser(testOwner, testChannel, "")
+		server.AddUser("OtherBot", testChannel, "")
+		bot.AddCmdHandler(echoCommand(nil), bot.Reply)
+		bot.AddMsgHandler(func(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+			if event.Nick == "OtherBot" {
+				atomic.AddInt32(&heard, 1)
+			}
+			return nil
+		}, bot.Reply)
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	server.Say(testOwner, testChannel, "!ignore")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :Nobody is ignored$")
+	server.Say(testOwner, testChannel, "!ignore OtherBot")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :\"OtherBot!\\*@\\*\" ignored$")
+
+	server.Say("OtherBot", testChannel, "!echo ignored")
+	server.Say("OtherBot", testChannel, "https://example.org")
+	server.Say(testOwner, testChannel, "!ignore")
+	// The masks are stored folded
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :otherbot!\\*@\\*$")
+	if count := server.Count(":ignored$"); count != 0 {
+		t.Errorf("Command of an ignored user run")
+	}
+	if atomic.LoadInt32(&heard) != 0 {
+		t.Errorf("Message of an ignored user given to the message handlers")
+	}
+
+	// The owners cannot be ignored
+	server.Say(testOwner, testChannel, "!ignore "+testOwner)
+	server.Say(testOwner, testChannel, "!echo owner")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :owner$")
+
+	server.Say(testOwner, testChannel, "!unignore OTHERBOT")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :\"OTHERBOT!\\*@\\*\" no longer ignored$")
+	server.Say("OtherBot", testChannel, "!echo heard")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :heard$")
+	server.Say(testOwner, testChannel, "!unignore OtherBot")
+	waitFor(t, server, "^PRIVMSG "+testChannel+" :\"OtherBot!\\*@\\*\" is not ignored$")
+
+	// The ignore list is not changed if the database cannot be updated
+	if _, err := testDB.Exec("DROP TABLE Ignore"); err != nil {
+		t.Fatal(err)
+	}
+	server.Say(testOwner, testChannel, "!ignore OtherBot")
+	failed := waitFor(t, server, "^PRIVMSG "+testChannel+" :Ignore command failed: unable to store the mask$")
+	server.Say(testOwner, testChannel, "!ignore")
+	if line, ok := server.WaitFor("^PRIVMSG "+testChannel+" :", indexOf(server, failed)+1, testTimeout); !ok || line.Text != "PRIVMSG "+testChannel+" :owner!*@*" {
+		t.Errorf("Mask ignored while it was not stored: %q", server.Received())
+	}
+}
+
+func Test_SASLPlain(t *testing.T) {
+	server, _, stop := startBotWith(t, func(network *core.Network) {
+		network.Channels = []core.Channel{{Name: testChannel}}
+		network.Auth = core.Authentication{Method: core.AuthSASLPlain, Account: "bot_account", Password: "secret"}
+	}, func(server *irctest.Server, bot *core.Bot) {
+		server.SetAccount("bot_account", "secret")
+		server.SetRegisteredOnly(testChannel)
+	})
+	defer stop()
+
+	authenticate := waitFor(t, server, "^AUTHENTICATE PLAIN$")
+	join := waitFor(t, server, "^JOIN "+testChannel+"$")
+	if indexOf(server, join) < indexOf(server, authenticate) {
+		t.Errorf("Channel joined before the authentication: %q", server.Received())
+	}
+	if account := server.Account(); account != "bot_account" {
+		t.Errorf("Bot logged in as %q instead of \"bot_account\"", account)
+	}
+	if server.Count("NickServ") != 0 {
+		t.Errorf("NickServ used while SASL succeeded: %q", server.Received())
+	}
+}
+
+func Test_NickServFallback(t *testing.T) {
+	server, _, stop := startBotWith(t, func(network *core.Network) {
+		network.Channels = []core.Channel{{Name: testChannel}}
+		network.Auth = core.Authentication{Method: core.AuthSASLPlain, Account: "bot_account", Password: "secret"}
+	}, func(server *irctest.Server, bot *core.Bot) {
+		server.SetAccount("bot_account", "secret")
+		server.DisableSASL()
+		server.SetRegisteredOnly(testChannel)
+	})
+	defer stop()
+
+	identify := waitFor(t, server, "^PRIVMSG NickServ :IDENTIFY bot_account secret$")
+	join := waitFor(t, server, "^JOIN "+testChannel+"$")
+	if indexOf(server, join) < indexOf(server, identify) {
+		t.Errorf("Channel joined before the identification: %q", server.Received())
+	}
+	if account := server.Account(); account != "bot_account" {
+		t.Errorf("Bot logged in as %q instead of \"bot_account\"", account)
+	}
+}
+
+// Certificate of the TLS test servers, trusted by the bot through SSL_CERT_FILE
+var serverCertificate struct {
+	once             sync.Once
+	certificate, key []byte
+	err              error
+}
+
+// startTLSBotWith starts a TLS test server and a bot connected to it, authenticated with SASL EXTERNAL.
+// The bot's certificate logs it in account, if not empty. The system certificates are only loaded once, so every TLS test server uses the same certificate.
+func startTLSBotWith(t *testing.T, account string, configure func(*core.Network), setup func(*irctest.Server, *core.Bot)) (*irctest.Server, func()) {
+	directory, err := ioutil.TempDir("", "goxxx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCertificate.once.Do(func() {
+		serverCertificate.certificate, serverCertificate.key, serverCertificate.err = irctest.GenerateCertificate("127.0.0.1")
+		if serverCertificate.err != nil {
+			return
+		}
+		path := filepath.Join(os.TempDir(), fmt.Sprintf("goxxx_test_ca_%d.pem", os.Getpid()))
+		if serverCertificate.err = ioutil.WriteFile(path, serverCertificate.certificate, 0600); serverCertificate.err == nil {
+			os.Setenv("SSL_CERT_FILE", path)
+		}
+	})
+	certificate, key, err := irctest.GenerateCertificate("goxxx")
+	if err == nil {
+		err = serverCertificate.err
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(directory, "bot.crt"), certificate, 0600)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(directory, "bot.key"), key, 0600)
+	}
+	if err != nil {
+		os.RemoveAll(directory)
+		t.Fatal(err)
+	}
+	server, err := irctest.NewTLSServer(serverCertificate.certificate, serverCertificate.key)
+	if err == nil && account != "" {
+		err = server.SetCertificate(account, certificate)
+	}
+	if err != nil {
+		os.RemoveAll(directory)
+		t.Fatal(err)
+	}
+	server, _, stop := startBotOn(server, func(network *core.Network) {
+		network.UseTLS = true
+		network.Channels = []core.Channel{{Name: testChannel}}
+		network.Auth = core.Authentication{Method: core.AuthSASLExternal,
+			CertFile: filepath.Join(directory, "bot.crt"), KeyFile: filepath.Join(directory, "bot.key")}
+		configure(network)
+	}, setup)
+	return server, func() {
+		stop()
+		os.RemoveAll(directory)
+	}
+}
+
+func Test_SASLExternal(t *testing.T) {
+	server, stop := startTLSBotWith(t, "bot_account", func(network *core.Network) {}, func(server *irctest.Server, bot *core.Bot) {
+		server.SetRegisteredOnly(testChannel)
+	})
+	defer stop()
+
+	authenticate := waitFor(t, server, "^AUTHENTICATE \\+$")
+	join := waitFor(t, server, "^JOIN "+testChannel+"$")
+	if indexOf(server, join) < indexOf(server, authenticate) {
+		t.Errorf("Channel joined before the authentication: %q", server.Received())
+	}
+	if account := server.Account(); account != "bot_account" {
+		t.Errorf("Bot logged in as %q instead of \"bot_account\"", account)
+	}
+}
+
+func Test_SASLExternalFallback(t *testing.T) {
+	server, stop := startTLSBotWith(t, "", func(network *core.Network) {
+		network.Auth.Account = "bot_account"
+		network.Auth.Password = "secret"
+	}, func(server *irctest.Server, bot *core.Bot) {
+		server.SetAccount("bot_account", "secret")
+		server.DisableSASL()
+		server.SetRegisteredOnly(testChannel)
+	})
+	defer stop()
+
+	identify := waitFor(t, server, "^PRIVMSG NickServ :IDENTIFY bot_account secret$")
+	join := waitFor(t, server, "^JOIN "+testChannel+"$")
+	if indexOf(server, join) < indexOf(server, identify) {
+		t.Errorf("Channel joined before the identification: %q", server.Received())
+	}
+	if server.Count("AUTHENTICATE") != 0 {
+		t.Errorf("SASL used while the server does not support it: %q", server.Received())
+	}
+}
+
+func Test_NickServFailure(t *testing.T) {
+	server, _, stop := startBotWith(t, func(network *core.Network) {
+		network.Channels = []core.Channel{{Name: testChannel}}
+		network.Auth = core.Authentication{Method: core.AuthNickServ, Password: "wrong"}
+	}, func(server *irctest.Server, bot *core.Bot) {
+		server.SetAccount(testNick, "secret")
+	})
+	defer stop()
+
+	// The channels are joined anyway, those which do not need an account can still be used
+	waitFor(t, server, "^PRIVMSG NickServ :IDENTIFY "+testNick+" wrong$")
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	if account := server.Account(); account != "" {
+		t.Errorf("Bot logged in as %q with a wrong password", account)
+	}
+}
+
+func Test_Reconnect(t *testing.T) {
+	server, bot, stop := startBotWith(t, func(network *core.Network) {
+		network.Channels = []core.Channel{{Name: "#keyed_channel", Key: "secret"}}
+		network.ReconnectMinDelay = 100 * time.Millisecond
+		network.ReconnectMaxDelay = 200 * time.Millisecond
+	}, func(server *irctest.Server, bot *core.Bot) {
+		server.SetChannelKey("#keyed_channel", "secret")
+	})
+	defer stop()
+
+	waitFor(t, server, "^JOIN #keyed_channel secret$")
+	received := len(server.Received())
+	server.Disconnect()
+
+	// The bot registers again and rejoins its channels with their keys
+	if _, ok := server.WaitFor("^JOIN #keyed_channel secret$", received, testTimeout); !ok {
+		t.Fatalf("Channel not joined again, lines received by the server: %q", server.Received())
+	}
+	if count := server.Count("^NICK " + testNick + "$"); count != 2 {
+		t.Errorf("Bot registered %d times, expected 2", count)
+	}
+	status := bot.Status()
+	if !status.Connected || status.Reconnections != 1 || status.LastDisconnection.IsZero() {
+		t.Errorf("Unexpected connection status: %+v", status)
+	}
+}
+
+func Test_ReclaimNick(t *testing.T) {
+	server, _, stop := startBot(t, []core.Channel{{Name: testChannel}}, func(server *irctest.Server, bot *core.Bot) {
+		server.ReserveNick(testNick)
+	})
+	defer stop()
+
+	// The bot registers with another nick, and takes its nick back once it is released
+	waitFor(t, server, "^NICK "+testNick+"_$")
+	waitFor(t, server, "^JOIN "+testChannel+"$")
+	received := len(server.Received())
+	server.ReleaseNick(testNick)
+	if _, ok := server.WaitFor("^NICK "+testNick+"$", received, testTimeout); !ok {
+		t.Fatalf("Nick not reclaimed, lines received by the server: %q", server.Received())
+	}
+}
@@ -0,0 +1,233 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/thoj/go-ircevent"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registration states of an ircEventTransport connection
+const (
+	stateRegistering int32 = iota
+	stateRegistered
+	stateQuitting
+)
+
+// ircEventTransport is a Transport based on the go-ircevent library
+type ircEventTransport struct {
+	conn      *irc.Connection
+	server    string
+	auth      Authentication
+	nick      string // Configured nick
+	attempt   string // Nick tried during the registration
+	started   bool   // Connect was already called, the next calls reconnect
+	state     int32  // Registration state of the current connection, accessed atomically
+	events    chan *Event
+	done      chan struct{} // Closed when the transport quits, before closing events
+	closeOnce sync.Once
+	mutex     sync.RWMutex // Prevents events from being closed while an event is being forwarded
+}
+
+// NewIRCEventTransport returns a Transport using the go-ircevent library to connect to the network's server
+func NewIRCEventTransport(network Network) Transport {
+	transport := &ircEventTransport{
+		conn:   irc.IRC(network.Nick, network.Nick),
+		server: network.Server,
+		nick:   network.Nick,
+		auth:   network.Auth,
+		events: make(chan *Event),
+		done:   make(chan struct{})}
+	transport.conn.UseTLS = network.UseTLS
+	transport.conn.RequestCaps = requestedCaps
+	// Used as the default quit message
+	transport.conn.Version = Version()
+	if network.QuitMessage != "" {
+		transport.conn.QuitMessage = network.QuitMessage
+	}
+	if network.Auth.isSASL() {
+		transport.conn.UseSASL = true
+		transport.conn.SASLLogin = network.Auth.account(network.Nick)
+		transport.conn.SASLPassword = network.Auth.Password
+		transport.conn.SASLMech = "PLAIN"
+		if network.Auth.Method == AuthSASLExternal {
+			// go-ircevent requests the "sasl" capability, sends "AUTHENTICATE EXTERNAL" and holds the registration until the end of the authentication,
+			// but it answers the server's challenge with the PLAIN credentials. Its answer is replaced once the capability is acknowledged.
+			transport.conn.SASLMech = "EXTERNAL"
+			transport.conn.AddCallback("CAP", transport.replaceSASLResponse)
+		}
+	}
+	// Every event received by go-ircevent is forwarded to the bot
+	transport.conn.AddCallback("*", transport.forward)
+	transport.conn.AddCallback("001", func(*irc.Event) {
+		atomic.StoreInt32(&transport.state, stateRegistered)
+	})
+	// The CTCP queries are answered by the bot, not by go-ircevent
+	for _, code := range []string{"CTCP_VERSION", "CTCP_TIME", "CTCP_PING", "CTCP_USERINFO", "CTCP_CLIENTINFO"} {
+		transport.conn.ClearCallback(code)
+	}
+	// go-ircevent adds "_" to the nick each time it is in use, even after the registration when the bot tries to reclaim its nick.
+	// It is only done during the registration, the bot deals with the nick afterwards.
+	transport.conn.ClearCallback("433")
+	transport.conn.AddCallback("433", func(*irc.Event) {
+		if atomic.LoadInt32(&transport.state) == stateRegistering {
+			transport.attempt += "_"
+			transport.conn.SendRaw("NICK " + transport.attempt)
+		}
+	})
+	return transport
+}
+
+// Connect opens the connection, or reconnects, and watches the connection errors in a separate goroutine
+func (transport *ircEventTransport) Connect() error {
+	if transport.auth.Method == AuthSASLExternal {
+		// SASL EXTERNAL authenticates with the client certificate presented during the TLS handshake
+		if !transport.conn.UseTLS {
+			return errors.New("SASL EXTERNAL needs a TLS connection")
+		}
+		certificate, err := tls.LoadX509KeyPair(transport.auth.CertFile, transport.auth.KeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load the client certificate: %s", err)
+		}
+		transport.conn.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	}
+	atomic.StoreInt32(&transport.state, stateRegistering)
+	transport.attempt = transport.nick
+	var err error
+	if transport.started {
+		err = transport.conn.Reconnect()
+	} else {
+		err = transport.conn.Connect(transport.server)
+	}
+	if err != nil {
+		return err
+	}
+	transport.started = true
+	go transport.watch(transport.conn.ErrorChan())
+	return nil
+}
+
+// watch waits for an error on the connection, and tells the bot that the connection is lost.
+// go-ircevent's Loop is not used, the bot decides when to reconnect.
+func (transport *ircEventTransport) watch(errors chan error) {
+	select {
+	case err := <-errors:
+		if atomic.LoadInt32(&transport.state) == stateQuitting {
+			transport.close()
+			return
+		}
+		transport.send(&Event{Code: EventDisconnected, Arguments: []string{err.Error()}})
+	case <-transport.done:
+	}
+}
+
+// replaceSASLResponse replaces go-ircevent's AUTHENTICATE callback, sending the PLAIN credentials, once the "sasl" capability is acknowledged.
+// The EXTERNAL response is empty ("+"): the server takes the account from the client certificate.
+func (transport *ircEventTransport) replaceSASLResponse(ircEvent *irc.Event) {
+	if len(ircEvent.Arguments) < 3 || ircEvent.Arguments[1] != "ACK" {
+		return
+	}
+	for _, capability := range strings.Fields(ircEvent.Arguments[2]) {
+		if capability == "sasl" {
+			transport.conn.ClearCallback("AUTHENTICATE")
+			transport.conn.AddCallback("AUTHENTICATE", func(ircEvent *irc.Event) {
+				if ircEvent.Message() == "+" {
+					transport.SendRaw("AUTHENTICATE +")
+				}
+			})
+			return
+		}
+	}
+}
+
+// Join joins a channel
+func (transport *ircEventTransport) Join(channel, key string) {
+	transport.conn.Join(strings.TrimSpace(channel + " " + key))
+}
+
+// Privmsg sends a message to a channel or a nick
+func (transport *ircEventTransport) Privmsg(target, message string) {
+	transport.conn.Privmsg(target, message)
+}
+
+// SendRaw sends a raw IRC line
+func (transport *ircEventTransport) SendRaw(line string) {
+	transport.conn.SendRaw(line)
+}
+
+// Events returns the channel on which the received events are sent
+func (transport *ircEventTransport) Events() <-chan *Event {
+	return transport.events
+}
+
+// Quit disconnects from the server
+func (transport *ircEventTransport) Quit() {
+	atomic.StoreInt32(&transport.state, stateQuitting)
+	transport.conn.Quit()
+	transport.close()
+}
+
+// close closes the events channel, only once
+func (transport *ircEventTransport) close() {
+	transport.closeOnce.Do(func() {
+		// Unblock the events being forwarded, then wait for them before closing the channel
+		close(transport.done)
+		transport.mutex.Lock()
+		close(transport.events)
+		transport.mutex.Unlock()
+	})
+}
+
+// forward converts a go-ircevent event and sends it on the events channel
+func (transport *ircEventTransport) forward(ircEvent *irc.Event) {
+	transport.send(newEventFromIRCEvent(ircEvent))
+}
+
+// send sends an event on the events channel, unless the transport has quit
+func (transport *ircEventTransport) send(event *Event) {
+	transport.mutex.RLock()
+	defer transport.mutex.RUnlock()
+	select {
+	case <-transport.done:
+		return
+	default:
+	}
+	select {
+	case transport.events <- event:
+	case <-transport.done:
+	}
+}
+
+// newEventFromIRCEvent converts a go-ircevent event to an Event.
+// go-ircevent decodes CTCP messages and changes their code ("CTCP_ACTION", "CTCP_VERSION", ...),
+// they are converted back to PRIVMSG events so that the bot receives the messages as sent by the server.
+func newEventFromIRCEvent(ircEvent *irc.Event) *Event {
+	event := &Event{
+		Code:      ircEvent.Code,
+		Raw:       ircEvent.Raw,
+		Source:    ircEvent.Source,
+		Nick:      ircEvent.Nick,
+		User:      ircEvent.User,
+		Host:      ircEvent.Host,
+		Arguments: append([]string(nil), ircEvent.Arguments...),
+		Tags:      ircEvent.Tags}
+
+	if strings.HasPrefix(event.Code, "CTCP") && len(event.Arguments) != 0 {
+		message := event.Message()
+		if event.Code == "CTCP_ACTION" {
+			message = "ACTION " + message
+		}
+		event.Arguments[len(event.Arguments)-1] = "\x01" + message + "\x01"
+		event.Code = "PRIVMSG"
+	}
+	return event
+}
@@ -0,0 +1,42 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"github.com/thoj/go-ircevent"
+	"testing"
+)
+
+func Test_newEventFromIRCEvent(t *testing.T) {
+	ircEvent := irc.Event{
+		Code:      "PRIVMSG",
+		Nick:      "Sender",
+		User:      "sender",
+		Host:      "example.org",
+		Source:    "Sender!sender@example.org",
+		Arguments: []string{"#test_channel", "test message"}}
+
+	event := newEventFromIRCEvent(&ircEvent)
+	if event.Code != "PRIVMSG" || event.Nick != "Sender" || event.Host != "example.org" || event.Message() != "test message" {
+		t.Errorf("Event not matching the go-ircevent event: %#v", event)
+	}
+
+	// CTCP ACTION decoded by go-ircevent
+	ircEvent.Code = "CTCP_ACTION"
+	ircEvent.Arguments = []string{"#test_channel", "waves"}
+	expectedMessage := "\x01ACTION waves\x01"
+
+	event = newEventFromIRCEvent(&ircEvent)
+	if event.Code != "PRIVMSG" {
+		t.Errorf("Incorrect code: should be %q, is %q", "PRIVMSG", event.Code)
+	}
+	if event.Message() != expectedMessage {
+		t.Errorf("Incorrect message: should be %q, is %q", expectedMessage, event.Message())
+	}
+	if ircEvent.Arguments[1] != "waves" {
+		t.Errorf("The go-ircevent event was modified: %q", ircEvent.Arguments)
+	}
+}
@@ -0,0 +1,714 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+/*
+Package irctest provides a small IRC server listening on the loopback interface, used to test the bot end-to-end.
+
+The server speaks enough of RFC 1459 for the bot to connect (NICK, USER, JOIN, NAMES, PRIVMSG, PING, QUIT),
+and supports SASL PLAIN and a simulated NickServ for the accounts added with SetAccount.
+A server created by NewTLSServer also supports SASL EXTERNAL for the client certificates added with SetCertificate.
+It also supports the IRCv3 capabilities listed in Capabilities: the messages of the simulated users are tagged
+with their time, their account (see SetUserAccount) and an identifier, and the messages of the client are echoed.
+Only one client (the bot) is connected at a time. The other users of the channels are simulated by the tests,
+and every line sent by the bot is recorded so that the tests can make assertions on it.
+*/
+package irctest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ServerName is the name used by the server as prefix for its replies
+	ServerName = "irc.test"
+	// pollInterval is the time between two checks of the received lines in WaitFor
+	pollInterval = 10 * time.Millisecond
+)
+
+// Capabilities are the IRCv3 capabilities supported by the server, "sasl" excepted
+var Capabilities = []string{"server-time", "account-tag", "extended-join", "account-notify", "message-tags", "echo-message"}
+
+// Line is a line received from the client
+type Line struct {
+	Time time.Time // Reception time
+	Text string    // Content of the line, without the trailing CR-LF
+}
+
+// channel stores the state of a channel: its key, if only logged in users can join, and its members with their prefix ("@", "+" or "")
+type channel struct {
+	key            string
+	registeredOnly bool
+	members        map[string]string
+}
+
+// Server is an IRC server for tests
+type Server struct {
+	listener     net.Listener
+	conn         net.Conn
+	nick         string
+	registered   bool
+	userSent     bool              // USER received, registration is completed once the capability negotiation ends
+	capStarted   bool              // Capability negotiation in progress
+	saslMech     string            // SASL mechanism in progress
+	account      string            // Account the client is logged in
+	accounts     map[string]string // Passwords by account
+	certificates map[string]string // Accounts by client certificate (DER), for SASL EXTERNAL
+	noSASL       bool              // Do not advertise the "sasl" capability
+	caps         map[string]bool   // Capabilities enabled by the client
+	userAccts    map[string]string // Accounts of the simulated users, by nick
+	messageID    int               // Identifier of the last message sent with a "msgid" tag
+	reserved     map[string]bool   // Nicks used by simulated users, the client cannot take them
+	channels     map[string]*channel
+	received     []Line
+	mutex        sync.Mutex
+	writeMutex   sync.Mutex
+}
+
+// NewServer creates a server listening on a random port of the loopback interface and starts accepting clients
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return newServer(listener), nil
+}
+
+// newServer creates a server using listener and starts accepting clients
+func newServer(listener net.Listener) *Server {
+	server := &Server{listener: listener, channels: make(map[string]*channel), accounts: make(map[string]string),
+		certificates: make(map[string]string), reserved: make(map[string]bool), caps: make(map[string]bool), userAccts: make(map[string]string)}
+	go server.accept()
+	return server
+}
+
+// Addr returns the address of the server, to be used as the bot's server
+func (server *Server) Addr() string {
+	return server.listener.Addr().String()
+}
+
+// Close stops the server and disconnects the client
+func (server *Server) Close() {
+	server.listener.Close()
+	server.Disconnect()
+}
+
+// Disconnect closes the connection with the current client
+func (server *Server) Disconnect() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.conn != nil {
+		server.conn.Close()
+		server.conn = nil
+	}
+}
+
+// SetChannelKey sets the key needed to join a channel, the channel is created if needed
+func (server *Server) SetChannelKey(name, key string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.getChannel(name).key = key
+}
+
+// SetRegisteredOnly sets a channel so that only logged in users can join it (mode +r), the channel is created if needed
+func (server *Server) SetRegisteredOnly(name string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.getChannel(name).registeredOnly = true
+}
+
+// SetAccount adds an account the client can log in with, through SASL PLAIN or NickServ.
+// The "sasl" capability is only advertised once an account or a client certificate exists.
+func (server *Server) SetAccount(account, password string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.accounts[account] = password
+}
+
+// DisableSASL stops advertising the "sasl" capability, the accounts can only be used through NickServ
+func (server *Server) DisableSASL() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.noSASL = true
+}
+
+// Account returns the account the client is logged in, empty if not logged in
+func (server *Server) Account() string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.account
+}
+
+// Enabled checks if the client enabled a capability
+func (server *Server) Enabled(capability string) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.caps[capability]
+}
+
+// SetUserAccount logs a simulated user in an account, or out if account is empty.
+// The client is notified if it enabled the "account-notify" capability.
+func (server *Server) SetUserAccount(nick, account string) {
+	server.mutex.Lock()
+	if account == "" {
+		delete(server.userAccts, nick)
+	} else {
+		server.userAccts[nick] = account
+	}
+	notify := server.caps["account-notify"]
+	server.mutex.Unlock()
+	if notify {
+		server.Send(fmt.Sprintf(":%s ACCOUNT %s", userMask(nick), accountOrStar(account)))
+	}
+}
+
+// AddUser adds a simulated user to a channel without notifying the client, prefix can be "@", "+" or "".
+// The client will only know about the user through a NAMES reply.
+func (server *Server) AddUser(nick, channelName, prefix string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.getChannel(channelName).members[nick] = prefix
+}
+
+// ReserveNick makes a nick used by a simulated user, the client receives ERR_NICKNAMEINUSE if it tries to take it
+func (server *Server) ReserveNick(nick string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.reserved[strings.ToLower(nick)] = true
+}
+
+// ReleaseNick makes a reserved nick available, its simulated user quits
+func (server *Server) ReleaseNick(nick string) {
+	server.mutex.Lock()
+	delete(server.reserved, strings.ToLower(nick))
+	server.mutex.Unlock()
+	server.Send(fmt.Sprintf(":%s QUIT :Quit", userMask(nick)))
+}
+
+// Join adds a simulated user to a channel and notifies the client, with the user's account if "extended-join" is enabled
+func (server *Server) Join(nick, channelName string) {
+	server.AddUser(nick, channelName, "")
+	server.mutex.Lock()
+	extended, account := server.caps["extended-join"], server.userAccts[nick]
+	server.mutex.Unlock()
+	if extended {
+		server.Send(fmt.Sprintf(":%s JOIN %s %s :%s", userMask(nick), channelName, accountOrStar(account), nick))
+	} else {
+		server.Send(fmt.Sprintf(":%s JOIN %s", userMask(nick), channelName))
+	}
+}
+
+// Part removes a simulated user from a channel and notifies the client
+func (server *Server) Part(nick, channelName string) {
+	server.mutex.Lock()
+	delete(server.getChannel(channelName).members, nick)
+	server.mutex.Unlock()
+	server.Send(fmt.Sprintf(":%s PART %s :Leaving", userMask(nick), channelName))
+}
+
+// Members returns the members of a channel, the client included, sorted by nick
+func (server *Server) Members(channelName string) (members []string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if channel, present := server.channels[channelName]; present {
+		for nick := range channel.members {
+			members = append(members, nick)
+		}
+	}
+	sort.Strings(members)
+	return
+}
+
+// Say sends a message from a simulated user to a channel or to the client, tagged according to the enabled capabilities
+func (server *Server) Say(nick, target, message string) {
+	server.mutex.Lock()
+	tags := server.tags(server.userAccts[nick], time.Now())
+	server.mutex.Unlock()
+	server.Send(fmt.Sprintf("%s:%s PRIVMSG %s :%s", tags, userMask(nick), target, message))
+}
+
+// tags returns the tags of a message sent by a user logged in account at the time sent, followed by a space,
+// or an empty string if the client enabled no capability adding tags. The caller must hold the mutex.
+func (server *Server) tags(account string, sent time.Time) string {
+	var tags []string
+	if server.caps["server-time"] {
+		tags = append(tags, "time="+sent.UTC().Format("2006-01-02T15:04:05.000Z"))
+	}
+	if server.caps["account-tag"] && account != "" {
+		tags = append(tags, "account="+account)
+	}
+	if server.caps["message-tags"] {
+		server.messageID++
+		tags = append(tags, fmt.Sprintf("msgid=%d", server.messageID))
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	return "@" + strings.Join(tags, ";") + " "
+}
+
+// Send sends a raw line to the client
+func (server *Server) Send(line string) {
+	server.mutex.Lock()
+	conn := server.conn
+	server.mutex.Unlock()
+	if conn != nil {
+		server.write(conn, line)
+	}
+}
+
+// Received returns the lines received from the client since the server started
+func (server *Server) Received() []Line {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]Line(nil), server.received...)
+}
+
+// WaitFor waits until a line received from the client matches the regular expression pattern, and returns it.
+// Only the lines received after the skip first ones are checked.
+// ok is false if no line matched before the timeout.
+func (server *Server) WaitFor(pattern string, skip int, timeout time.Duration) (line Line, ok bool) {
+	re := regexp.MustCompile(pattern)
+	deadline := time.Now().Add(timeout)
+	for {
+		received := server.Received()
+		for i := skip; i < len(received); i++ {
+			if re.MatchString(received[i].Text) {
+				return received[i], true
+			}
+		}
+		if time.Now().After(deadline) {
+			return Line{}, false
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Count returns the number of received lines matching the regular expression pattern
+func (server *Server) Count(pattern string) (count int) {
+	re := regexp.MustCompile(pattern)
+	for _, line := range server.Received() {
+		if re.MatchString(line.Text) {
+			count++
+		}
+	}
+	return
+}
+
+// accept accepts the clients, a new client replaces the previous one
+func (server *Server) accept() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.mutex.Lock()
+		if server.conn != nil {
+			server.conn.Close()
+		}
+		server.conn = conn
+		server.nick = ""
+		server.registered = false
+		server.userSent = false
+		server.capStarted = false
+		server.account = ""
+		server.caps = make(map[string]bool)
+		server.mutex.Unlock()
+		go server.handle(conn)
+	}
+}
+
+// handle reads the lines sent by a client
+func (server *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		text, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		text = strings.TrimRight(text, "\r\n")
+		server.mutex.Lock()
+		server.received = append(server.received, Line{Time: time.Now(), Text: text})
+		server.mutex.Unlock()
+		if !server.process(conn, text) {
+			return
+		}
+	}
+}
+
+// process handles a line sent by the client, returns false if the connection must be closed
+func (server *Server) process(conn net.Conn, text string) bool {
+	command, params := parseLine(text)
+
+	server.mutex.Lock()
+	nick := server.nick
+	server.mutex.Unlock()
+
+	switch command {
+	case "NICK":
+		if len(params) < 1 {
+			server.reply(conn, "431", "*", "No nickname given")
+			return true
+		}
+		server.mutex.Lock()
+		if server.reserved[strings.ToLower(params[0])] {
+			server.mutex.Unlock()
+			target := nick
+			if target == "" {
+				target = "*"
+			}
+			server.reply(conn, "433", target, params[0], "Nickname is already in use")
+			return true
+		}
+		server.nick = params[0]
+		registered := server.registered
+		welcome := !registered && server.userSent && !server.capStarted
+		server.mutex.Unlock()
+		if registered {
+			server.write(conn, fmt.Sprintf(":%s NICK :%s", userMask(nick), params[0]))
+		} else if welcome {
+			// The first nick was in use
+			server.welcome(conn)
+		}
+
+	case "USER":
+		server.mutex.Lock()
+		server.userSent = true
+		waiting := server.capStarted || server.nick == ""
+		server.mutex.Unlock()
+		if !waiting {
+			server.welcome(conn)
+		}
+
+	case "CAP":
+		server.processCap(conn, nick, params)
+
+	case "AUTHENTICATE":
+		server.processAuthenticate(conn, nick, params)
+
+	case "PING":
+		server.write(conn, fmt.Sprintf(":%s PONG %s :%s", ServerName, ServerName, strings.Join(params, " ")))
+
+	case "JOIN":
+		if len(params) < 1 {
+			server.reply(conn, "461", nick, "JOIN", "Not enough parameters")
+			return true
+		}
+		names := strings.Split(params[0], ",")
+		var keys []string
+		if len(params) > 1 {
+			keys = strings.Split(params[1], ",")
+		}
+		for i, name := range names {
+			key := ""
+			if i < len(keys) {
+				key = keys[i]
+			}
+			server.mutex.Lock()
+			channel := server.getChannel(name)
+			allowed := channel.key == "" || channel.key == key
+			loggedIn := !channel.registeredOnly || server.account != ""
+			if allowed && loggedIn {
+				channel.members[nick] = ""
+			}
+			server.mutex.Unlock()
+			if !allowed {
+				server.reply(conn, "475", nick, name, "Cannot join channel (+k)")
+				continue
+			}
+			if !loggedIn {
+				server.reply(conn, "477", nick, name, "Cannot join channel (+r) - you need to be logged into your NickServ account")
+				continue
+			}
+			if server.Enabled("extended-join") {
+				server.write(conn, fmt.Sprintf(":%s JOIN %s %s :%s", userMask(nick), name, accountOrStar(server.Account()), nick))
+			} else {
+				server.write(conn, fmt.Sprintf(":%s JOIN %s", userMask(nick), name))
+			}
+			server.sendNames(conn, nick, name)
+		}
+
+	case "NAMES":
+		if len(params) < 1 {
+			return true
+		}
+		for _, name := range strings.Split(params[0], ",") {
+			server.sendNames(conn, nick, name)
+		}
+
+	case "PRIVMSG":
+		if len(params) == 2 && strings.EqualFold(params[0], "NickServ") {
+			server.processNickServ(conn, nick, params[1])
+		} else if len(params) == 2 && server.Enabled("echo-message") {
+			server.mutex.Lock()
+			tags := server.tags(server.account, time.Now())
+			server.mutex.Unlock()
+			server.write(conn, fmt.Sprintf("%s:%s PRIVMSG %s :%s", tags, userMask(nick), params[0], params[1]))
+		}
+
+	case "NOTICE", "PONG":
+		// Recorded, nothing to do
+
+	case "QUIT":
+		server.write(conn, "ERROR :Closing link")
+		server.mutex.Lock()
+		for _, channel := range server.channels {
+			delete(channel.members, nick)
+		}
+		server.mutex.Unlock()
+		return false
+
+	default:
+		server.reply(conn, "421", nick, command, "Unknown command")
+	}
+	return true
+}
+
+// welcome completes the registration of the client
+func (server *Server) welcome(conn net.Conn) {
+	server.mutex.Lock()
+	server.registered = true
+	nick := server.nick
+	server.mutex.Unlock()
+	server.reply(conn, "001", nick, "Welcome to the test network "+nick)
+	server.reply(conn, "002", nick, "Your host is "+ServerName)
+	server.reply(conn, "376", nick, "End of /MOTD command.")
+}
+
+// processCap handles the capability negotiation, a request is acknowledged if every requested capability is supported
+func (server *Server) processCap(conn net.Conn, nick string, params []string) {
+	if len(params) < 1 {
+		return
+	}
+	if nick == "" {
+		nick = "*"
+	}
+	server.mutex.Lock()
+	sasl := (len(server.accounts) != 0 || len(server.certificates) != 0) && !server.noSASL
+	server.mutex.Unlock()
+
+	switch strings.ToUpper(params[0]) {
+	case "LS":
+		server.mutex.Lock()
+		server.capStarted = true
+		server.mutex.Unlock()
+		caps := Capabilities
+		if sasl {
+			caps = append([]string{"sasl"}, caps...)
+		}
+		server.write(conn, fmt.Sprintf(":%s CAP %s LS :%s", ServerName, nick, strings.Join(caps, " ")))
+	case "REQ":
+		if len(params) < 2 {
+			return
+		}
+		requested := strings.Fields(params[1])
+		for _, capability := range requested {
+			if !(sasl && capability == "sasl") && !supported(capability) {
+				server.write(conn, fmt.Sprintf(":%s CAP %s NAK :%s", ServerName, nick, params[1]))
+				return
+			}
+		}
+		server.mutex.Lock()
+		for _, capability := range requested {
+			server.caps[capability] = true
+		}
+		server.mutex.Unlock()
+		server.write(conn, fmt.Sprintf(":%s CAP %s ACK :%s", ServerName, nick, params[1]))
+	case "END":
+		server.mutex.Lock()
+		server.capStarted = false
+		welcome := server.userSent && !server.registered && server.nick != ""
+		server.mutex.Unlock()
+		if welcome {
+			server.welcome(conn)
+		}
+	}
+}
+
+// processAuthenticate handles the SASL authentication with the PLAIN or EXTERNAL mechanism.
+// EXTERNAL logs the client in the account of the certificate presented during the TLS handshake.
+func (server *Server) processAuthenticate(conn net.Conn, nick string, params []string) {
+	if len(params) < 1 {
+		return
+	}
+	if nick == "" {
+		nick = "*"
+	}
+	server.mutex.Lock()
+	mech := server.saslMech
+	server.mutex.Unlock()
+
+	if mech == "" {
+		if params[0] != "PLAIN" && params[0] != "EXTERNAL" {
+			server.reply(conn, "908", nick, "PLAIN,EXTERNAL", "are available SASL mechanisms")
+			server.reply(conn, "904", nick, "SASL authentication failed")
+			return
+		}
+		server.mutex.Lock()
+		server.saslMech = params[0]
+		server.mutex.Unlock()
+		server.write(conn, "AUTHENTICATE +")
+		return
+	}
+
+	server.mutex.Lock()
+	server.saslMech = ""
+	server.mutex.Unlock()
+	if mech == "EXTERNAL" {
+		// The response is the authorization identity, "+" when empty: the account is the certificate's
+		server.mutex.Lock()
+		account, present := server.certificates[clientCertificate(conn)]
+		if present && params[0] == "+" {
+			server.account = account
+		}
+		server.mutex.Unlock()
+		if !present || params[0] != "+" {
+			server.reply(conn, "904", nick, "SASL authentication failed")
+			return
+		}
+		server.reply(conn, "900", nick, userMask(nick), account, "You are now logged in as "+account)
+		server.reply(conn, "903", nick, "SASL authentication successful")
+		return
+	}
+	// PLAIN payload: authorization identity, authentication identity and password separated by NUL characters
+	payload, err := base64.StdEncoding.DecodeString(params[0])
+	parts := strings.Split(string(payload), "\x00")
+	if err != nil || len(parts) != 3 || !server.login(parts[1], parts[2]) {
+		server.reply(conn, "904", nick, "SASL authentication failed")
+		return
+	}
+	server.reply(conn, "900", nick, userMask(nick), parts[1], "You are now logged in as "+parts[1])
+	server.reply(conn, "903", nick, "SASL authentication successful")
+}
+
+// processNickServ handles the messages sent to NickServ, only "IDENTIFY [account] password" is supported
+func (server *Server) processNickServ(conn net.Conn, nick, message string) {
+	fields := strings.Fields(message)
+	if len(fields) < 2 || strings.ToUpper(fields[0]) != "IDENTIFY" {
+		server.write(conn, fmt.Sprintf(":NickServ!NickServ@services. NOTICE %s :Unknown command", nick))
+		return
+	}
+	account, password := nick, fields[1]
+	if len(fields) > 2 {
+		account, password = fields[1], fields[2]
+	}
+	if !server.login(account, password) {
+		server.write(conn, fmt.Sprintf(":NickServ!NickServ@services. NOTICE %s :Invalid password for %s.", nick, account))
+		return
+	}
+	server.write(conn, fmt.Sprintf(":NickServ!NickServ@services. NOTICE %s :You are now identified for %s.", nick, account))
+	server.reply(conn, "900", nick, userMask(nick), account, "You are now logged in as "+account)
+}
+
+// login logs the client in if the password of the account is correct
+func (server *Server) login(account, password string) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	expected, present := server.accounts[account]
+	if !present || expected != password {
+		return false
+	}
+	server.account = account
+	return true
+}
+
+// sendNames sends the RPL_NAMREPLY and RPL_ENDOFNAMES replies for a channel
+func (server *Server) sendNames(conn net.Conn, nick, name string) {
+	server.mutex.Lock()
+	var names []string
+	if channel, present := server.channels[name]; present {
+		for member, prefix := range channel.members {
+			names = append(names, prefix+member)
+		}
+	}
+	server.mutex.Unlock()
+	sort.Strings(names)
+	if len(names) != 0 {
+		server.reply(conn, "353", nick, "=", name, strings.Join(names, " "))
+	}
+	server.reply(conn, "366", nick, name, "End of /NAMES list.")
+}
+
+// reply sends a numeric reply or a command from the server, the last parameter is sent as trailing parameter
+func (server *Server) reply(conn net.Conn, code string, params ...string) {
+	last := len(params) - 1
+	params[last] = ":" + params[last]
+	server.write(conn, fmt.Sprintf(":%s %s %s", ServerName, code, strings.Join(params, " ")))
+}
+
+// write sends a line to a client
+func (server *Server) write(conn net.Conn, line string) {
+	server.writeMutex.Lock()
+	defer server.writeMutex.Unlock()
+	conn.Write([]byte(line + "\r\n"))
+}
+
+// getChannel returns a channel, creating it if needed. The caller must hold the mutex.
+func (server *Server) getChannel(name string) *channel {
+	if _, present := server.channels[name]; !present {
+		server.channels[name] = &channel{members: make(map[string]string)}
+	}
+	return server.channels[name]
+}
+
+// parseLine splits a line in its command and parameters, the prefix is ignored
+func parseLine(text string) (command string, params []string) {
+	if strings.HasPrefix(text, ":") {
+		if i := strings.Index(text, " "); i != -1 {
+			text = text[i+1:]
+		} else {
+			return "", nil
+		}
+	}
+	trailing := ""
+	hasTrailing := false
+	if i := strings.Index(text, " :"); i != -1 {
+		trailing = text[i+2:]
+		hasTrailing = true
+		text = text[:i]
+	}
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	command = strings.ToUpper(fields[0])
+	params = fields[1:]
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return
+}
+
+// supported checks if a capability is in Capabilities
+func supported(capability string) bool {
+	for _, name := range Capabilities {
+		if name == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// accountOrStar returns an account as sent in the JOIN and ACCOUNT messages, "*" if the user is not logged in
+func accountOrStar(account string) string {
+	if account == "" {
+		return "*"
+	}
+	return account
+}
+
+// userMask returns the full mask used as prefix for the messages of a user
+func userMask(nick string) string {
+	return fmt.Sprintf("%s!%s@127.0.0.1", nick, strings.ToLower(nick))
+}
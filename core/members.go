@@ -0,0 +1,375 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	// Channel membership modes and their prefixes in NAMES replies, from the highest to the lowest,
+	// used until the server sends its own in RPL_ISUPPORT (owner, admin, operator, half-operator, voice)
+	defaultPrefixModes   = "qaohv"
+	defaultPrefixSymbols = "~&@%+"
+	// Channel modes taking a parameter, by type (list, always, only when set, never), see RPL_ISUPPORT CHANMODES
+	defaultChanModes = "beI,k,l,imnpst"
+)
+
+// Member structure that describes a user present in a channel
+type Member struct {
+	Nick    string
+	User    string // User name, empty until the user is seen joining the channel
+	Host    string // Host, empty until the user is seen joining the channel
+	Account string // Services account, empty if not logged in or unknown (known from the extended JOIN and ACCOUNT messages)
+	Modes   string // Membership modes ("q", "a", "o", "h", "v"), from the highest to the lowest
+}
+
+// HasMode checks if the member has a membership mode ('o' for an operator, 'v' for a voiced user, ...)
+func (member Member) HasMode(mode byte) bool {
+	return strings.IndexByte(member.Modes, mode) != -1
+}
+
+// IsOperator checks if the member is an operator of the channel, or has a higher mode (owner or admin)
+func (member Member) IsOperator() bool {
+	return member.HasMode('q') || member.HasMode('a') || member.HasMode('o')
+}
+
+// channelMembers stores the members of a channel the bot is in, indexed by folded nick
+type channelMembers map[string]*Member
+
+// resetMembers forgets the channels and their members, they are received again after joining the channels
+func (bot *Bot) resetMembers() {
+	bot.usersMutex.Lock()
+	defer bot.usersMutex.Unlock()
+	bot.channels = make(map[string]channelMembers)
+	bot.pendingNames = make(map[string]channelMembers)
+}
+
+// isSelf checks if a nick is the bot's nick
+func (bot *Bot) isSelf(nick string) bool {
+	bot.selfMutex.RLock()
+	defer bot.selfMutex.RUnlock()
+	return bot.fold(nick) == bot.fold(bot.self.Nick)
+}
+
+// addMembersCallbacks adds the callbacks tracking the members of the channels and their modes
+func (bot *Bot) addMembersCallbacks() {
+	// RPL_ISUPPORT, gives the membership modes supported by the server and the way it compares the names
+	bot.addCallback("005", func(event *Event) {
+		// event.Arguments => [nick, token, token, ..., message]
+		if len(event.Arguments) < 2 {
+			return
+		}
+		for _, token := range event.Arguments[1:] {
+			switch {
+			case strings.HasPrefix(token, "PREFIX="):
+				// PREFIX=(qaohv)~&@%+
+				value := strings.TrimPrefix(token, "PREFIX=")
+				end := strings.IndexByte(value, ')')
+				if !strings.HasPrefix(value, "(") || end == -1 || len(value[1:end]) != len(value[end+1:]) {
+					continue
+				}
+				bot.usersMutex.Lock()
+				bot.prefixModes, bot.prefixSymbols = value[1:end], value[end+1:]
+				bot.usersMutex.Unlock()
+			case strings.HasPrefix(token, "CHANMODES="):
+				bot.usersMutex.Lock()
+				bot.chanModes = strings.TrimPrefix(token, "CHANMODES=")
+				bot.usersMutex.Unlock()
+			case strings.HasPrefix(token, "CASEMAPPING="):
+				bot.setCaseMapping(ParseCaseMapping(strings.TrimPrefix(token, "CASEMAPPING=")))
+			}
+		}
+	})
+
+	// RPL_NAMREPLY, can be received several times for the same channel
+	bot.addCallback("353", func(event *Event) {
+		// event.Arguments => [nick, channel type, channel, names]
+		if len(event.Arguments) < 4 {
+			return
+		}
+		channel := bot.fold(event.Arguments[2])
+		bot.usersMutex.Lock()
+		defer bot.usersMutex.Unlock()
+		if bot.pendingNames[channel] == nil {
+			bot.pendingNames[channel] = make(channelMembers)
+		}
+		for _, name := range strings.Fields(event.Message()) {
+			member := bot.parseName(name)
+			bot.pendingNames[channel][bot.fold(member.Nick)] = member
+		}
+	})
+
+	// RPL_ENDOFNAMES, the received names replace the members of the channel
+	bot.addCallback("366", func(event *Event) {
+		// event.Arguments => [nick, channel, message]
+		if len(event.Arguments) < 2 {
+			return
+		}
+		channel := bot.fold(event.Arguments[1])
+		bot.usersMutex.Lock()
+		defer bot.usersMutex.Unlock()
+		if _, joined := bot.channels[channel]; joined {
+			members := bot.pendingNames[channel]
+			if members == nil {
+				members = make(channelMembers)
+			}
+			// Keep the user names, hosts and accounts seen in the JOIN messages
+			for key, member := range members {
+				if previous, present := bot.channels[channel][key]; present && member.Host == "" {
+					member.User, member.Host, member.Account = previous.User, previous.Host, previous.Account
+				}
+			}
+			bot.channels[channel] = members
+		}
+		delete(bot.pendingNames, channel)
+	})
+
+	bot.addCallback("JOIN", func(event *Event) {
+		// event.Arguments => [channel], or [channel, account, real name] with the extended-join capability
+		if len(event.Arguments) == 0 {
+			return
+		}
+		channel := bot.fold(event.Arguments[0])
+		bot.usersMutex.Lock()
+		defer bot.usersMutex.Unlock()
+		if bot.isSelf(event.Nick) {
+			bot.channels[channel] = make(channelMembers)
+		}
+		if members, joined := bot.channels[channel]; joined {
+			members[bot.fold(event.Nick)] = &Member{Nick: event.Nick, User: event.User, Host: event.Host, Account: event.Account}
+		}
+	})
+
+	// account-notify capability: a member logged in or out
+	bot.addCallback("ACCOUNT", func(event *Event) {
+		bot.usersMutex.Lock()
+		defer bot.usersMutex.Unlock()
+		for _, members := range bot.channels {
+			if member, present := members[bot.fold(event.Nick)]; present {
+				member.Account = event.Account
+			}
+		}
+	})
+
+	bot.addCallback("PART", func(event *Event) {
+		// event.Arguments => [channel, message]
+		if len(event.Arguments) == 0 {
+			return
+		}
+		bot.removeMember(event.Arguments[0], event.Nick)
+	})
+
+	bot.addCallback("KICK", func(event *Event) {
+		// event.Arguments => [channel, nick, message]
+		if len(event.Arguments) < 2 {
+			return
+		}
+		bot.removeMember(event.Arguments[0], event.Arguments[1])
+	})
+
+	bot.addCallback("QUIT", func(event *Event) {
+		bot.usersMutex.Lock()
+		defer bot.usersMutex.Unlock()
+		for _, members := range bot.channels {
+			delete(members, bot.fold(event.Nick))
+		}
+	})
+
+	bot.addCallback("NICK", func(event *Event) {
+		bot.usersMutex.Lock()
+		defer bot.usersMutex.Unlock()
+		for _, members := range bot.channels {
+			if member, present := members[bot.fold(event.Nick)]; present {
+				delete(members, bot.fold(event.Nick))
+				member.Nick = event.Message()
+				members[bot.fold(member.Nick)] = member
+			}
+		}
+	})
+
+	bot.addCallback("MODE", func(event *Event) {
+		// event.Arguments => [channel, modes, parameter, parameter, ...]
+		if len(event.Arguments) < 2 || !isChannel(event.Arguments[0]) {
+			return
+		}
+		bot.usersMutex.Lock()
+		defer bot.usersMutex.Unlock()
+		members, joined := bot.channels[bot.fold(event.Arguments[0])]
+		if !joined {
+			return
+		}
+		bot.applyModes(members, event.Arguments[1], event.Arguments[2:])
+	})
+}
+
+// parseName parses a name from a NAMES reply, with all its prefixes ("multi-prefix" capability)
+// and possibly its user name and host ("userhost-in-names" capability).
+// bot.usersMutex must be locked.
+func (bot *Bot) parseName(name string) *Member {
+	member := &Member{}
+	for name != "" {
+		index := strings.IndexByte(bot.prefixSymbols, name[0])
+		if index == -1 {
+			break
+		}
+		member.Modes += bot.prefixModes[index : index+1]
+		name = name[1:]
+	}
+	member.Modes = bot.sortModes(member.Modes)
+	member.Nick = name
+	if index := strings.IndexByte(name, '!'); index != -1 {
+		member.Nick = name[:index]
+		userHost := strings.SplitN(name[index+1:], "@", 2)
+		member.User = userHost[0]
+		if len(userHost) == 2 {
+			member.Host = userHost[1]
+		}
+	}
+	return member
+}
+
+// applyModes applies a MODE change to the members of a channel.
+// The parameters of the other modes are skipped according to the CHANMODES types.
+// bot.usersMutex must be locked.
+func (bot *Bot) applyModes(members channelMembers, modes string, parameters []string) {
+	types := strings.SplitN(bot.chanModes, ",", 4)
+	for len(types) < 4 {
+		types = append(types, "")
+	}
+	adding := true
+	nextParameter := func() string {
+		if len(parameters) == 0 {
+			return ""
+		}
+		parameter := parameters[0]
+		parameters = parameters[1:]
+		return parameter
+	}
+	for i := 0; i < len(modes); i++ {
+		mode := modes[i]
+		switch {
+		case mode == '+' || mode == '-':
+			adding = mode == '+'
+		case strings.IndexByte(bot.prefixModes, mode) != -1:
+			member, present := members[bot.fold(nextParameter())]
+			if !present {
+				continue
+			}
+			if adding && !member.HasMode(mode) {
+				member.Modes = bot.sortModes(member.Modes + string(mode))
+			} else if !adding {
+				member.Modes = strings.Replace(member.Modes, string(mode), "", -1)
+			}
+		case strings.IndexByte(types[0], mode) != -1, strings.IndexByte(types[1], mode) != -1:
+			nextParameter()
+		case adding && strings.IndexByte(types[2], mode) != -1:
+			nextParameter()
+		}
+	}
+}
+
+// sortModes sorts membership modes from the highest to the lowest.
+// bot.usersMutex must be locked.
+func (bot *Bot) sortModes(modes string) string {
+	var sorted []byte
+	for i := 0; i < len(bot.prefixModes); i++ {
+		if strings.IndexByte(modes, bot.prefixModes[i]) != -1 {
+			sorted = append(sorted, bot.prefixModes[i])
+		}
+	}
+	return string(sorted)
+}
+
+// removeMember removes a user from a channel, or forgets the channel if the user is the bot
+func (bot *Bot) removeMember(channel, nick string) {
+	bot.usersMutex.Lock()
+	defer bot.usersMutex.Unlock()
+	if bot.isSelf(nick) {
+		delete(bot.channels, bot.fold(channel))
+		return
+	}
+	if members, joined := bot.channels[bot.fold(channel)]; joined {
+		delete(members, bot.fold(nick))
+	}
+}
+
+// Members returns the members of a channel the bot is in, sorted by nick
+func (bot *Bot) Members(channel string) []Member {
+	bot.usersMutex.RLock()
+	defer bot.usersMutex.RUnlock()
+	var members []Member
+	for _, member := range bot.channels[bot.fold(channel)] {
+		members = append(members, *member)
+	}
+	sort.Slice(members, func(i, j int) bool { return bot.fold(members[i].Nick) < bot.fold(members[j].Nick) })
+	return members
+}
+
+// Member returns a member of a channel the bot is in, present is false if the user is not in the channel
+func (bot *Bot) Member(channel, nick string) (member Member, present bool) {
+	bot.usersMutex.RLock()
+	defer bot.usersMutex.RUnlock()
+	if found, ok := bot.channels[bot.fold(channel)][bot.fold(nick)]; ok {
+		return *found, true
+	}
+	return Member{}, false
+}
+
+// JoinedChannels returns the names of the channels the bot is in, sorted
+func (bot *Bot) JoinedChannels() []string {
+	bot.usersMutex.RLock()
+	defer bot.usersMutex.RUnlock()
+	var channels []string
+	for _, channel := range bot.network.Channels {
+		if _, joined := bot.channels[bot.fold(channel.Name)]; joined {
+			channels = append(channels, channel.Name)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// isUser checks if the sender of the event is present in the channel where the message was posted,
+// or in one of the bot's channels for a private message.
+func (bot *Bot) isUser(event *Event) bool {
+	bot.usersMutex.RLock()
+	defer bot.usersMutex.RUnlock()
+	if channel := GetChannelFromEvent(event); channel != "" {
+		_, present := bot.channels[bot.fold(channel)][bot.fold(event.Nick)]
+		return present
+	}
+	for _, members := range bot.channels {
+		if _, present := members[bot.fold(event.Nick)]; present {
+			return true
+		}
+	}
+	return false
+}
+
+// memberAccount returns the account of a user seen in one of the bot's channels, empty if unknown
+func (bot *Bot) memberAccount(nick string) string {
+	bot.usersMutex.RLock()
+	defer bot.usersMutex.RUnlock()
+	for _, members := range bot.channels {
+		if member, present := members[bot.fold(nick)]; present && member.Account != "" {
+			return member.Account
+		}
+	}
+	return ""
+}
+
+// GetMembers returns the members of the channel where the event was posted, nil for a private message
+func GetMembers(event *Event) []Member {
+	bot := getBot(event)
+	channel := GetChannelFromEvent(event)
+	if bot == nil || channel == "" {
+		return nil
+	}
+	return bot.Members(channel)
+}
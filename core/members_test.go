@@ -0,0 +1,82 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"testing"
+)
+
+// modesOf returns the nicks and modes of the members of a channel
+func modesOf(bot *Bot, channel string) map[string]string {
+	modes := make(map[string]string)
+	for _, member := range bot.Members(channel) {
+		modes[member.Nick] = member.Modes
+	}
+	return modes
+}
+
+func Test_MembersEvents(t *testing.T) {
+	bot := NewBotWithTransport(Network{Name: "test_members", Nick: "goxxx"}, newFakeTransport())
+	defer bot.Stop()
+
+	events := []*Event{
+		{Code: "005", Arguments: []string{"goxxx", "CHANMODES=beI,k,l,imnpst", "PREFIX=(qaohv)~&@%+", "are supported by this server"}},
+		{Code: "JOIN", Nick: "goxxx", User: "bot", Host: "example.org", Arguments: []string{"#channel"}},
+		{Code: "353", Arguments: []string{"goxxx", "=", "#channel", "goxxx ~@Owner &Admin %Half +Voiced"}},
+		{Code: "353", Arguments: []string{"goxxx", "=", "#channel", "User!user@example.org"}},
+		{Code: "366", Arguments: []string{"goxxx", "#channel", "End of /NAMES list."}},
+		{Code: "MODE", Arguments: []string{"#channel", "+kvb-q+l", "key", "User", "*!*@spam", "Owner", "10"}},
+		{Code: "MODE", Arguments: []string{"#channel", "-h+o", "Half", "Half"}},
+		{Code: "JOIN", Nick: "Latecomer", User: "late", Host: "example.org", Arguments: []string{"#CHANNEL"}},
+		{Code: "NICK", Nick: "voiced", Arguments: []string{"Renamed"}},
+		{Code: "KICK", Nick: "Owner", Arguments: []string{"#channel", "Admin", "Bye"}},
+	}
+	for _, event := range events {
+		bot.handleEvent(event)
+	}
+
+	expected := map[string]string{"goxxx": "", "Owner": "o", "Half": "o", "Renamed": "v", "User": "v", "Latecomer": ""}
+	modes := modesOf(bot, "#Channel")
+	if len(modes) != len(expected) {
+		t.Errorf("Unexpected members: %q", modes)
+	}
+	for nick, mode := range expected {
+		if current, present := modes[nick]; !present || current != mode {
+			t.Errorf("Unexpected modes for %s: %q (expected %q), members: %q", nick, current, mode, modes)
+		}
+	}
+	if member, present := bot.Member("#channel", "user"); !present || member.User != "user" || member.Host != "example.org" {
+		t.Errorf("Unexpected member: %+v", member)
+	}
+
+	bot.handleEvent(&Event{Code: "QUIT", Nick: "Latecomer", Arguments: []string{"Quit"}})
+	if _, present := bot.Member("#channel", "Latecomer"); present {
+		t.Error("User still in the channel after quitting")
+	}
+	// The bot is kicked out of the channel
+	bot.handleEvent(&Event{Code: "KICK", Nick: "Owner", Arguments: []string{"#channel", "goxxx", "Bye"}})
+	if members := bot.Members("#channel"); len(members) != 0 {
+		t.Errorf("Channel not forgotten after the bot was kicked: %+v", members)
+	}
+}
+
+func Test_parseName(t *testing.T) {
+	bot := &Bot{prefixModes: "ov", prefixSymbols: "@+"}
+	tests := []struct {
+		name   string
+		member Member
+	}{
+		{"Nick", Member{Nick: "Nick"}},
+		{"+@Nick", Member{Nick: "Nick", Modes: "ov"}},
+		{"%Nick", Member{Nick: "%Nick"}},
+		{"@Nick!user@host", Member{Nick: "Nick", User: "user", Host: "host", Modes: "o"}},
+	}
+	for _, test := range tests {
+		if member := bot.parseName(test.name); *member != test.member {
+			t.Errorf("Unexpected member for %q: %+v (expected %+v)", test.name, *member, test.member)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	sqlSelectModules = "SELECT name, enabled FROM Module WHERE network = $1"
+	sqlInsertModule  = "INSERT OR REPLACE INTO Module (network, name, enabled) VALUES ($1, $2, $3)"
+)
+
+var (
+	// Registered modules, by name
+	modules = make(map[string]Module)
+	// Modules already initialised, by name
+	initialisedModules = make(map[string]bool)
+	// Dependencies given to the modules when they are initialised
+	moduleDependencies *Dependencies
+	// Locks of the modules by name, read-locked by the running handlers of the module and locked while it is initialised again
+	moduleLocks = make(map[string]*sync.RWMutex)
+	// Protects modules, initialisedModules, moduleDependencies and moduleLocks
+	modulesMutex sync.RWMutex
+)
+
+// Module is implemented by the bot's modules.
+// Modules register themselves with RegisterModule, usually in an init function,
+// and are then enabled by name for each network.
+type Module interface {
+	// Name returns the name used to enable the module
+	Name() string
+	// Init initialises the module, it is called before the module is loaded by the first bot, and when it is reloaded
+	Init(dependencies *Dependencies) error
+	// Commands returns the commands of the module
+	Commands() []*Command
+	// MsgHandlers returns the handlers called on every message
+	MsgHandlers() []MsgHandler
+	// Subscriptions returns the handlers called on the other kinds of events (joins, nick changes, actions, ...)
+	Subscriptions() []Subscription
+	// Shutdown releases the resources used by the module
+	Shutdown()
+}
+
+// Dependencies structure that contains what the modules may need to be initialised
+type Dependencies struct {
+	DB    *sql.DB
+	Email EmailSettings
+}
+
+// EmailSettings structure that contains the SMTP server informations
+type EmailSettings struct {
+	Server   string
+	Port     int
+	Sender   string // Address used in the "From" header (optional, Account is used if empty)
+	Account  string
+	Password string
+}
+
+// MsgHandler structure that contains a message handler and the way its replies are sent
+type MsgHandler struct {
+	Handler    Handler
+	ReplyToAll bool // Send the replies to every channel when their target is not a channel
+}
+
+// RegisterModule makes a module available by its name.
+// It panics if a module with the same name is already registered.
+func RegisterModule(module Module) {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+	if _, present := modules[module.Name()]; present {
+		panic(fmt.Sprintf("core: module %q registered twice", module.Name()))
+	}
+	modules[module.Name()] = module
+}
+
+// GetModule returns the module registered with name, nil if not found
+func GetModule(name string) Module {
+	modulesMutex.RLock()
+	defer modulesMutex.RUnlock()
+	return modules[name]
+}
+
+// ModuleNames returns the sorted names of the registered modules
+func ModuleNames() []string {
+	modulesMutex.RLock()
+	defer modulesMutex.RUnlock()
+	var names []string
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetDependencies stores the dependencies given to the modules when they are initialised
+func SetDependencies(dependencies *Dependencies) {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+	moduleDependencies = dependencies
+}
+
+// initModule initialises a module if it was not already done
+func initModule(module Module) error {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+	if initialisedModules[module.Name()] {
+		return nil
+	}
+	dependencies := moduleDependencies
+	if dependencies == nil {
+		dependencies = &Dependencies{}
+	}
+	if err := module.Init(dependencies); err != nil {
+		return err
+	}
+	initialisedModules[module.Name()] = true
+	return nil
+}
+
+// moduleLock returns the lock of a module, see moduleLocks
+func moduleLock(name string) *sync.RWMutex {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+	if _, present := moduleLocks[name]; !present {
+		moduleLocks[name] = &sync.RWMutex{}
+	}
+	return moduleLocks[name]
+}
+
+// ShutdownModules calls the Shutdown method of every initialised module
+func ShutdownModules() {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+	for name := range initialisedModules {
+		modules[name].Shutdown()
+		delete(initialisedModules, name)
+	}
+}
+
+// StartModules initialises and loads the modules named in names.
+// The modules enabled or disabled at runtime with the !module command are added or removed from the list.
+func (bot *Bot) StartModules(names []string) {
+	states, err := loadModuleStates(bot.network.Name)
+	if err != nil {
+		log.Printf("Unable to read the enabled modules for network %q: %s\n", bot.network.Name, err)
+	}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if _, present := states[name]; !present && name != "" {
+			states[name] = true
+		}
+	}
+	var enabled []string
+	for name, state := range states {
+		if state {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+
+	for _, name := range enabled {
+		module := GetModule(name)
+		if module == nil {
+			log.Printf("Unknown module %q (available modules: %s)\n", name, strings.Join(ModuleNames(), ", "))
+			continue
+		}
+		if err := initModule(module); err != nil {
+			log.Printf("Error while initialising the %s module: %s\n", name, err)
+			continue
+		}
+		bot.LoadModule(module)
+		log.Printf("%s module loaded for network %q\n", strings.ToUpper(name[:1])+name[1:], bot.network.Name)
+	}
+}
+
+// LoadModule adds the commands, the message handlers and the subscriptions of a module to the bot.
+// The module must have been initialised.
+func (bot *Bot) LoadModule(module Module) {
+	name := module.Name()
+	for _, handler := range module.MsgHandlers() {
+		if handler.ReplyToAll {
+			bot.addMsgHandler(name, handler.Handler, bot.ReplyToAll)
+		} else {
+			bot.addMsgHandler(name, handler.Handler, bot.Reply)
+		}
+	}
+	for _, cmd := range module.Commands() {
+		bot.addCmdHandler(name, cmd, bot.Reply)
+	}
+	for _, subscription := range module.Subscriptions() {
+		if subscription.ReplyToAll {
+			bot.subscribe(name, subscription.Kind, subscription.Handler, bot.ReplyToAll)
+		} else {
+			bot.subscribe(name, subscription.Kind, subscription.Handler, bot.Reply)
+		}
+	}
+	bot.handlersMutex.Lock()
+	bot.modules = append(bot.modules, name)
+	bot.handlersMutex.Unlock()
+}
+
+// UnloadModule removes the commands, the message handlers and the subscriptions of a module from the bot
+func (bot *Bot) UnloadModule(name string) {
+	bot.handlersMutex.Lock()
+	defer bot.handlersMutex.Unlock()
+	// A new slice is built, mainHandler may be using the current one
+	var handlers []msgHandler
+	for _, handler := range bot.msgHandlers {
+		if handler.module != name {
+			handlers = append(handlers, handler)
+		}
+	}
+	bot.msgHandlers = handlers
+	for kind, subscriptions := range bot.subscriptions {
+		var kept []subscription
+		for _, subscription := range subscriptions {
+			if subscription.module != name {
+				kept = append(kept, subscription)
+			}
+		}
+		bot.subscriptions[kind] = kept
+	}
+	for trigger, command := range bot.commands {
+		if command.module == name {
+			delete(bot.commands, trigger)
+		}
+	}
+	var names []string
+	for _, module := range bot.modules {
+		if module != name {
+			names = append(names, module)
+		}
+	}
+	bot.modules = names
+}
+
+// Modules returns the names of the modules loaded by the bot
+func (bot *Bot) Modules() []string {
+	bot.handlersMutex.RLock()
+	defer bot.handlersMutex.RUnlock()
+	return append([]string(nil), bot.modules...)
+}
+
+// GetModules returns the names of the modules loaded by the bot which received the event
+func GetModules(event *Event) []string {
+	bot := getBot(event)
+	if bot == nil {
+		return nil
+	}
+	return bot.Modules()
+}
+
+// hasModule checks if a module is loaded by the bot
+func (bot *Bot) hasModule(name string) bool {
+	bot.handlersMutex.RLock()
+	defer bot.handlersMutex.RUnlock()
+	for _, module := range bot.modules {
+		if module == name {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableModule initialises the module if needed, loads it and stores it as enabled for the bot's network
+func (bot *Bot) EnableModule(name string) error {
+	module := GetModule(name)
+	if module == nil {
+		return fmt.Errorf("unknown module %q", name)
+	}
+	if bot.hasModule(name) {
+		return fmt.Errorf("module %q already enabled", name)
+	}
+	if err := initModule(module); err != nil {
+		return fmt.Errorf("unable to initialise module %q: %s", name, err)
+	}
+	bot.LoadModule(module)
+	return saveModuleState(bot.network.Name, name, true)
+}
+
+// DisableModule unloads the module and stores it as disabled for the bot's network
+func (bot *Bot) DisableModule(name string) error {
+	if !bot.hasModule(name) {
+		return fmt.Errorf("module %q not enabled", name)
+	}
+	bot.UnloadModule(name)
+	return saveModuleState(bot.network.Name, name, false)
+}
+
+// ReloadModule shuts the module down, initialises it again and reloads it in every bot where it is loaded.
+// The module is unloaded from the bots and its running handlers are waited for before shutting it down,
+// the handlers already queued for the workers run once the module is initialised again.
+func (bot *Bot) ReloadModule(name string) error {
+	module := GetModule(name)
+	if module == nil || !bot.hasModule(name) {
+		return fmt.Errorf("module %q not enabled", name)
+	}
+	botsMutex.RLock()
+	var loadedBy []*Bot
+	for _, other := range bots {
+		if other.hasModule(name) {
+			other.UnloadModule(name)
+			loadedBy = append(loadedBy, other)
+		}
+	}
+	botsMutex.RUnlock()
+
+	lock := moduleLock(name)
+	lock.Lock()
+	modulesMutex.Lock()
+	if initialisedModules[name] {
+		module.Shutdown()
+		delete(initialisedModules, name)
+	}
+	modulesMutex.Unlock()
+	err := initModule(module)
+	lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to initialise module %q: %s", name, err)
+	}
+
+	for _, other := range loadedBy {
+		other.LoadModule(module)
+	}
+	return nil
+}
+
+// loadModuleStates returns the modules enabled (true) or disabled (false) at runtime for a network
+func loadModuleStates(network string) (states map[string]bool, err error) {
+	states = make(map[string]bool)
+	db := getDB()
+	if db == nil {
+		return states, nil
+	}
+	rows, err := db.Query(sqlSelectModules, network)
+	if err != nil {
+		return states, err
+	}
+	defer rows.Close()
+	var (
+		name    string
+		enabled bool
+	)
+	for rows.Next() {
+		if err = rows.Scan(&name, &enabled); err != nil {
+			return states, err
+		}
+		states[name] = enabled
+	}
+	return states, rows.Err()
+}
+
+// saveModuleState stores a module as enabled or disabled for a network
+func saveModuleState(network, name string, enabled bool) error {
+	db := getDB()
+	if db == nil {
+		return nil
+	}
+	_, err := db.Exec(sqlInsertModule, network, name, enabled)
+	return err
+}
+
+// handleModuleCmd handles the !module command
+func (bot *Bot) handleModuleCmd(event *Event, callback func(*ReplyCallbackData)) error {
+	var (
+		target = GetTargetFromEvent(event)
+		name   = event.Args.String("module")
+		action string
+		err    error
+	)
+	command := strings.ToLower(event.Args.String("action"))
+	if command == "list" {
+		callback(&ReplyCallbackData{
+			Message: fmt.Sprintf("Enabled modules: %s (available modules: %s)", strings.Join(bot.Modules(), ", "), strings.Join(ModuleNames(), ", ")),
+			Target:  target})
+		return nil
+	}
+	if name == "" {
+		callback(&ReplyCallbackData{Message: fmt.Sprintf("Module command failed: the module to %s is missing", command), Target: target})
+		return nil
+	}
+
+	switch command {
+	case "enable":
+		action, err = "enabled", bot.EnableModule(name)
+	case "disable":
+		action, err = "disabled", bot.DisableModule(name)
+	case "reload":
+		action, err = "reloaded", bot.ReloadModule(name)
+	default:
+		callback(&ReplyCallbackData{Message: fmt.Sprintf("Module command failed: unknown action %q (list, enable, disable or reload)", command), Target: target})
+		return nil
+	}
+	if err != nil {
+		log.Printf("!module %s %s: %s\n", command, name, err)
+		callback(&ReplyCallbackData{Message: fmt.Sprintf("Module command failed: %s", err), Target: target})
+		return nil
+	}
+	log.Printf("Module %q %s by %s for network %q\n", name, action, event.Nick, bot.network.Name)
+	callback(&ReplyCallbackData{Message: fmt.Sprintf("Module %q %s", name, action), Target: target})
+	return nil
+}
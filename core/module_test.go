@@ -0,0 +1,166 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testModule is a module with a single command
+type testModule struct {
+	name string
+}
+
+func (module testModule) Name() string                          { return module.name }
+func (module testModule) Init(dependencies *Dependencies) error { return nil }
+func (module testModule) Commands() []*Command {
+	return []*Command{{
+		Module:   module.name,
+		Triggers: []string{module.name},
+		Handler:  func(*Event, func(*ReplyCallbackData)) error { return nil }}}
+}
+func (module testModule) MsgHandlers() []MsgHandler {
+	return []MsgHandler{{Handler: func(*Event, func(*ReplyCallbackData)) error { return nil }, ReplyToAll: true}}
+}
+func (module testModule) Subscriptions() []Subscription {
+	return []Subscription{{Kind: KindJoin, Handler: func(*Event, func(*ReplyCallbackData)) error { return nil }}}
+}
+func (module testModule) Shutdown() {}
+
+func Test_RegisterModule(t *testing.T) {
+	RegisterModule(testModule{name: "test_module_b"})
+	RegisterModule(testModule{name: "test_module_a"})
+	defer func() {
+		modulesMutex.Lock()
+		delete(modules, "test_module_a")
+		delete(modules, "test_module_b")
+		modulesMutex.Unlock()
+	}()
+
+	if module := GetModule("test_module_a"); module == nil || module.Name() != "test_module_a" {
+		t.Errorf("Registered module not found: %#v", module)
+	}
+	if module := GetModule("unknown_module"); module != nil {
+		t.Errorf("Unknown module found: %#v", module)
+	}
+	var names []string
+	for _, name := range ModuleNames() {
+		if strings.HasPrefix(name, "test_module_") {
+			names = append(names, name)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"test_module_a", "test_module_b"}) {
+		t.Errorf("Unexpected module names: %q", names)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("No panic when registering a module twice")
+		}
+	}()
+	RegisterModule(testModule{name: "test_module_a"})
+}
+
+func Test_LoadModule(t *testing.T) {
+	bot := NewBotWithTransport(Network{Name: "test_network"}, newFakeTransport())
+	defer bot.Stop()
+
+	bot.LoadModule(testModule{name: "test_module"})
+	if _, present := bot.commands["test_module"]; !present {
+		t.Errorf("Command of the module not added")
+	}
+	if len(bot.msgHandlers) != 1 {
+		t.Errorf("Message handler of the module not added")
+	}
+	if modules := bot.Modules(); !reflect.DeepEqual(modules, []string{"test_module"}) {
+		t.Errorf("Unexpected loaded modules: %q", modules)
+	}
+
+	bot.UnloadModule("test_module")
+	if _, present := bot.commands["test_module"]; present {
+		t.Errorf("Command of the module not removed")
+	}
+	if len(bot.msgHandlers) != 0 {
+		t.Errorf("Message handler of the module not removed")
+	}
+	if modules := bot.Modules(); len(modules) != 0 {
+		t.Errorf("Unexpected loaded modules after unloading: %q", modules)
+	}
+}
+
+// blockingModule is a module whose command blocks until release is closed
+type blockingModule struct {
+	testModule
+	started   chan struct{}
+	release   chan struct{}
+	running   int32 // Running handlers
+	shutdowns int32 // Calls of Shutdown while a handler was running
+}
+
+func (module *blockingModule) Commands() []*Command {
+	return []*Command{{
+		Module:   module.name,
+		Triggers: []string{module.name},
+		Handler: func(*Event, func(*ReplyCallbackData)) error {
+			atomic.AddInt32(&module.running, 1)
+			defer atomic.AddInt32(&module.running, -1)
+			close(module.started)
+			<-module.release
+			return nil
+		}}}
+}
+func (module *blockingModule) Shutdown() {
+	if atomic.LoadInt32(&module.running) != 0 {
+		atomic.AddInt32(&module.shutdowns, 1)
+	}
+}
+
+func Test_ReloadModule(t *testing.T) {
+	module := &blockingModule{testModule: testModule{name: "test_reload"}, started: make(chan struct{}), release: make(chan struct{})}
+	RegisterModule(module)
+	defer func() {
+		modulesMutex.Lock()
+		delete(modules, "test_reload")
+		delete(initialisedModules, "test_reload")
+		modulesMutex.Unlock()
+	}()
+	bot := NewBotWithTransport(Network{Name: "test_reload_network"}, newFakeTransport())
+	defer bot.Stop()
+	if err := initModule(module); err != nil {
+		t.Fatal(err)
+	}
+	bot.LoadModule(module)
+
+	bot.runCommand("test_reload", bot.commands["test_reload"].Command, &Event{Nick: "Sender", Arguments: []string{"#test_channel", "test_reload"}}, RoleUser, nil)
+	<-module.started
+	reloaded := make(chan error)
+	go func() { reloaded <- bot.ReloadModule("test_reload") }()
+
+	// The module is unloaded at once, but only shut down once its handler returned
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-reloaded:
+		t.Fatal("Module reloaded while its handler was running")
+	default:
+	}
+	if bot.hasModule("test_reload") {
+		t.Error("Module not unloaded before waiting for its handlers")
+	}
+	close(module.release)
+	if err := <-reloaded; err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&module.shutdowns) != 0 {
+		t.Error("Module shut down while its handler was running")
+	}
+	if !bot.hasModule("test_reload") {
+		t.Error("Module not loaded again")
+	}
+}
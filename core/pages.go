@@ -0,0 +1,97 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// Default number of results displayed at once
+	defaultPageSize = 4
+	// Time after which the remaining results of a command are forgotten
+	pageExpiry = 10 * time.Minute
+	// Trigger of the command displaying the next results
+	moreTrigger = "more"
+)
+
+// page stores the results not yet displayed to a user
+type page struct {
+	results []string
+	expires time.Time
+}
+
+// pageKey returns the key of the pages of the user who sent the event, in the channel or private conversation where it was sent
+func pageKey(event *Event) string {
+	mapping := caseMappingOf(event)
+	return mapping.Fold(GetTargetFromEvent(event)) + " " + mapping.Fold(event.Nick)
+}
+
+// pageSize returns the number of results displayed at once
+func (bot *Bot) pageSize() int {
+	if bot.network.PageSize > 0 {
+		return bot.network.PageSize
+	}
+	return defaultPageSize
+}
+
+// sendPage sends the first results of data.Results through callback, and stores the other ones for the !more command
+func (bot *Bot) sendPage(event *Event, data *ReplyCallbackData, callback func(*ReplyCallbackData)) {
+	results := data.Results.Lines
+	size := bot.pageSize()
+	if len(results) < size {
+		size = len(results)
+	}
+	for _, result := range results[:size] {
+		callback(&ReplyCallbackData{Message: result, Target: data.Target, Priority: data.Priority, Action: data.Action, group: data.group})
+	}
+
+	key := pageKey(event)
+	now := time.Now()
+	bot.pagesMutex.Lock()
+	for key, page := range bot.pages {
+		if now.After(page.expires) {
+			delete(bot.pages, key)
+		}
+	}
+	remaining := results[size:]
+	if len(remaining) == 0 {
+		delete(bot.pages, key)
+	} else {
+		bot.pages[key] = &page{results: remaining, expires: now.Add(pageExpiry)}
+	}
+	bot.pagesMutex.Unlock()
+
+	if len(remaining) != 0 {
+		callback(&ReplyCallbackData{
+			Message:  fmt.Sprintf("%d more result(s), type %s%s to display them", len(remaining), bot.Prefix(data.Target), moreTrigger),
+			Target:   data.Target,
+			Priority: data.Priority,
+			group:    data.group})
+	}
+}
+
+// handleMoreCmd displays the next results of the last command run by the user in this channel or private conversation.
+// The words following the trigger are ignored.
+func (bot *Bot) handleMoreCmd(event *Event, callback func(*ReplyCallbackData)) error {
+	key := pageKey(event)
+	bot.pagesMutex.Lock()
+	page, present := bot.pages[key]
+	if present && time.Now().After(page.expires) {
+		delete(bot.pages, key)
+		present = false
+	}
+	bot.pagesMutex.Unlock()
+
+	if !present {
+		callback(&ReplyCallbackData{Message: "No more results", Target: GetTargetFromEvent(event)})
+		return nil
+	}
+	callback(&ReplyCallbackData{Results: &ResultSet{Lines: page.results}, Target: GetTargetFromEvent(event)})
+	return nil
+}
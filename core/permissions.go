@@ -0,0 +1,319 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	sqlSelectPermissions = "SELECT network, mask, role FROM Permission WHERE network IN ($1, '')"
+	sqlInsertPermission  = "INSERT OR REPLACE INTO Permission (network, mask, role) VALUES ($1, $2, $3)"
+	sqlDeletePermission  = "DELETE FROM Permission WHERE network = $1 AND mask = $2"
+
+	// Prefix of the masks matching an account instead of a hostmask
+	accountMaskPrefix = "account:"
+)
+
+// Role of a user, which determines the commands the user can run
+type Role int
+
+// Roles, from the least to the most privileged
+const (
+	RoleBanned  Role = iota - 1 // Cannot run any command
+	RoleUser                    // Default role
+	RoleTrusted                 // Trusted user
+	RoleAdmin                   // Administrator, can manage the roles lower than admin
+	RoleOwner                   // Owner of the bot, set in the configuration
+)
+
+var roleNames = map[Role]string{
+	RoleBanned:  "banned",
+	RoleUser:    "user",
+	RoleTrusted: "trusted",
+	RoleAdmin:   "admin",
+	RoleOwner:   "owner",
+}
+
+// String returns the name of the role
+func (role Role) String() string {
+	if name, present := roleNames[role]; present {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(role))
+}
+
+// ParseRole returns the role corresponding to a name
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if strings.EqualFold(name, roleName) {
+			return role, nil
+		}
+	}
+	return RoleUser, fmt.Errorf("unknown role %q", name)
+}
+
+// MatchMask checks if a mask matches the sender of the event.
+// A mask is either "account:<account name>", or a hostmask where "*" matches any sequence of characters and "?" any character.
+// The case is ignored, following the case mapping of the network where the event was received.
+func MatchMask(mask string, event *Event) bool {
+	mapping := caseMappingOf(event)
+	if strings.HasPrefix(mask, accountMaskPrefix) {
+		return event.Account != "" && mapping.Fold(strings.TrimPrefix(mask, accountMaskPrefix)) == mapping.Fold(event.Account)
+	}
+	return matchGlob(mapping.Fold(mask), mapping.Fold(event.Nick+"!"+event.User+"@"+event.Host))
+}
+
+// matchGlob matches a string against a pattern where "*" matches any sequence of characters and "?" any character
+func matchGlob(pattern, str string) bool {
+	// Position in pattern and str after the last "*", to backtrack when a match fails
+	star, starStr := -1, 0
+	p, s := 0, 0
+	for s < len(str) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == str[s]):
+			p++
+			s++
+		case p < len(pattern) && pattern[p] == '*':
+			star, starStr = p, s
+			p++
+		case star != -1:
+			starStr++
+			p, s = star+1, starStr
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// permission is a role granted to a mask, stored in the database
+type permission struct {
+	mask   string // Folded mask
+	role   Role
+	global bool // Stored with an empty network, applies to every network
+}
+
+// loadPermissions loads the roles granted on the bot's network from the database
+func (bot *Bot) loadPermissions() {
+	db := getDB()
+	if db == nil {
+		return
+	}
+	rows, err := db.Query(sqlSelectPermissions, bot.network.Name)
+	if err != nil {
+		log.Printf("%q: %s\n", err, sqlSelectPermissions)
+		return
+	}
+	defer rows.Close()
+	var permissions []permission
+	var network, mask, roleName string
+	for rows.Next() {
+		if err = rows.Scan(&network, &mask, &roleName); err != nil {
+			log.Println(err)
+			return
+		}
+		role, err := ParseRole(roleName)
+		if err != nil {
+			log.Printf("Invalid role for mask %q: %s\n", mask, err)
+			continue
+		}
+		permissions = append(permissions, permission{mask: mask, role: role, global: network == ""})
+	}
+	if err = rows.Err(); err != nil {
+		log.Println(err)
+		return
+	}
+	bot.permissionsMutex.Lock()
+	bot.permissions = permissions
+	bot.permissionsMutex.Unlock()
+}
+
+// storedRole returns the role granted to a folded mask on the bot's network, false if the mask has no role
+func (bot *Bot) storedRole(mask string) (Role, bool) {
+	bot.permissionsMutex.RLock()
+	defer bot.permissionsMutex.RUnlock()
+	for _, permission := range bot.permissions {
+		if permission.mask == mask && !permission.global {
+			return permission.role, true
+		}
+	}
+	return RoleUser, false
+}
+
+// setRole changes the role granted to a folded mask on the bot's network, removing it if remove is true
+func (bot *Bot) setRole(mask string, role Role, remove bool) {
+	bot.permissionsMutex.Lock()
+	defer bot.permissionsMutex.Unlock()
+	permissions := bot.permissions[:0]
+	for _, permission := range bot.permissions {
+		if permission.mask != mask || permission.global {
+			permissions = append(permissions, permission)
+		}
+	}
+	if !remove {
+		permissions = append(permissions, permission{mask: mask, role: role})
+	}
+	bot.permissions = permissions
+}
+
+// GetRole returns the role of the sender of the event.
+// The owners always have the owner role. Otherwise, if several masks match, a banned mask takes precedence,
+// and the most privileged role is returned.
+func GetRole(event *Event) Role {
+	bot := getBot(event)
+	if bot == nil {
+		return RoleUser
+	}
+	return bot.getRole(event)
+}
+
+func (bot *Bot) getRole(event *Event) Role {
+	for _, mask := range bot.network.Owners {
+		if MatchMask(mask, event) {
+			return RoleOwner
+		}
+	}
+
+	role := RoleUser
+	bot.permissionsMutex.RLock()
+	defer bot.permissionsMutex.RUnlock()
+	for _, permission := range bot.permissions {
+		if !MatchMask(permission.mask, event) {
+			continue
+		}
+		if permission.role == RoleBanned {
+			return RoleBanned
+		}
+		if permission.role > role {
+			role = permission.role
+		}
+	}
+	return role
+}
+
+// checkRole checks if the sender of the event, who has the role role, can run the command, and tells the sender if not
+func (bot *Bot) checkRole(event *Event, cmd *Command, role Role, callback func(*ReplyCallbackData)) bool {
+	if role == RoleBanned {
+		return false
+	}
+	if role >= cmd.Role {
+		return true
+	}
+	if callback != nil {
+		callback(&ReplyCallbackData{
+			Message: fmt.Sprintf("You need the %q role to run this command", cmd.Role),
+			Target:  GetTargetFromEvent(event)})
+	}
+	return false
+}
+
+// handleGrantCmd handles the !grant command: "!grant <mask> <role>".
+// The masks are stored folded, following the case mapping of the network.
+// A role can only be granted to a mask by a user with a more privileged role, or by an owner.
+func (bot *Bot) handleGrantCmd(event *Event, callback func(*ReplyCallbackData)) error {
+	mask, target := event.Args.String("mask"), GetTargetFromEvent(event)
+	role, err := ParseRole(event.Args.String("role"))
+	if err != nil {
+		callback(&ReplyCallbackData{Message: fmt.Sprintf("Grant command failed: %s", err), Target: target})
+		return nil
+	}
+	if !bot.canManage(event, mask, role, callback) {
+		return nil
+	}
+	if _, err := getDB().Exec(sqlInsertPermission, bot.network.Name, bot.fold(mask), role.String()); err != nil {
+		log.Printf("%q: %s\n", err, sqlInsertPermission)
+		callback(&ReplyCallbackData{Message: "Grant command failed: unable to store the role", Target: target})
+		return nil
+	}
+	bot.setRole(bot.fold(mask), role, false)
+	log.Printf("Role %q granted to %q by %s for network %q\n", role, mask, event.Nick, bot.network.Name)
+	callback(&ReplyCallbackData{Message: fmt.Sprintf("Role %q granted to %q", role, mask), Target: target})
+	return nil
+}
+
+// handleRevokeCmd handles the !revoke command: "!revoke <mask>".
+func (bot *Bot) handleRevokeCmd(event *Event, callback func(*ReplyCallbackData)) error {
+	mask, target := event.Args.String("mask"), GetTargetFromEvent(event)
+
+	role, present := bot.storedRole(bot.fold(mask))
+	if getDB() == nil || !present {
+		callback(&ReplyCallbackData{Message: fmt.Sprintf("No role for %q", mask), Target: target})
+		return nil
+	}
+	if !bot.canManage(event, mask, role, callback) {
+		return nil
+	}
+	if _, err := getDB().Exec(sqlDeletePermission, bot.network.Name, bot.fold(mask)); err != nil {
+		log.Printf("%q: %s\n", err, sqlDeletePermission)
+		callback(&ReplyCallbackData{Message: "Revoke command failed: unable to remove the role", Target: target})
+		return nil
+	}
+	bot.setRole(bot.fold(mask), role, true)
+	log.Printf("Role %q revoked from %q by %s for network %q\n", role, mask, event.Nick, bot.network.Name)
+	callback(&ReplyCallbackData{Message: fmt.Sprintf("Role %q revoked from %q", role, mask), Target: target})
+	return nil
+}
+
+// canManage checks if the sender of the event can grant or revoke role for mask, and tells the sender if not.
+// The mask cannot match the owners, nor the masks of the roles as privileged as the sender's role,
+// so that "*!*@*" cannot ban the users managing the bot.
+func (bot *Bot) canManage(event *Event, mask string, role Role, callback func(*ReplyCallbackData)) bool {
+	target := GetTargetFromEvent(event)
+	if getDB() == nil {
+		callback(&ReplyCallbackData{Message: "Roles cannot be changed without a database", Target: target})
+		return false
+	}
+	own := bot.getRole(event)
+	if own == RoleOwner {
+		return true
+	}
+	folded := bot.fold(mask)
+	for _, owner := range bot.network.Owners {
+		if masksOverlap(folded, bot.fold(owner)) {
+			callback(&ReplyCallbackData{Message: fmt.Sprintf("%q matches an owner of the bot", mask), Target: target})
+			return false
+		}
+	}
+	// The roles of the masks matching the same users must also be less privileged than the sender's role
+	current := RoleUser
+	bot.permissionsMutex.RLock()
+	for _, permission := range bot.permissions {
+		if masksOverlap(folded, permission.mask) {
+			current = maxRole(current, permission.role)
+		}
+	}
+	bot.permissionsMutex.RUnlock()
+	if role >= own || current >= own {
+		callback(&ReplyCallbackData{
+			Message: fmt.Sprintf("You cannot manage the %q role", maxRole(role, current)),
+			Target:  target})
+		return false
+	}
+	return true
+}
+
+// masksOverlap checks if two folded masks can match the same user: an account mask only overlaps itself,
+// two hostmasks overlap when one of them matches the other
+func masksOverlap(first, second string) bool {
+	if strings.HasPrefix(first, accountMaskPrefix) || strings.HasPrefix(second, accountMaskPrefix) {
+		return first == second
+	}
+	return matchGlob(first, second) || matchGlob(second, first)
+}
+
+func maxRole(first, second Role) Role {
+	if first > second {
+		return first
+	}
+	return second
+}
@@ -0,0 +1,103 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"testing"
+)
+
+func Test_MatchMask(t *testing.T) {
+	event := &Event{Nick: "Sender", User: "~sender", Host: "user/sender", Account: "SenderAccount"}
+	tests := []struct {
+		mask     string
+		expected bool
+	}{
+		{"Sender!~sender@user/sender", true},
+		{"sender!*@*", true},
+		{"*!*@user/*", true},
+		{"S?nder!*", true},
+		{"*", true},
+		{"Other!*@*", false},
+		{"Sender!*@other", false},
+		{"Sender", false},
+		{"account:senderaccount", true},
+		{"account:other", false},
+	}
+	for _, test := range tests {
+		if result := MatchMask(test.mask, event); result != test.expected {
+			t.Errorf("MatchMask(%q) = %t instead of %t", test.mask, result, test.expected)
+		}
+	}
+
+	if MatchMask("account:", &Event{Nick: "Sender"}) {
+		t.Errorf("Empty account matched by an event without account")
+	}
+}
+
+func Test_masksOverlap(t *testing.T) {
+	tests := []struct {
+		first, second string
+		expected      bool
+	}{
+		{"*!*@*", "owner!*@*", true},
+		{"owner!~owner@example.org", "owner!*@*", true},
+		{"other!*@*", "owner!*@*", false},
+		{"account:owner", "account:owner", true},
+		{"account:owner", "*!*@*", false},
+	}
+	for _, test := range tests {
+		if overlap := masksOverlap(test.first, test.second); overlap != test.expected {
+			t.Errorf("masksOverlap(%q, %q) = %t instead of %t", test.first, test.second, overlap, test.expected)
+		}
+	}
+}
+
+func Test_ParseRole(t *testing.T) {
+	for _, role := range []Role{RoleBanned, RoleUser, RoleTrusted, RoleAdmin, RoleOwner} {
+		if parsed, err := ParseRole(role.String()); err != nil || parsed != role {
+			t.Errorf("ParseRole(%q) = %s, %v", role.String(), parsed, err)
+		}
+	}
+	if _, err := ParseRole("superuser"); err == nil {
+		t.Errorf("No error for an unknown role")
+	}
+	if !(RoleBanned < RoleUser && RoleUser < RoleTrusted && RoleTrusted < RoleAdmin && RoleAdmin < RoleOwner) {
+		t.Errorf("Roles not ordered by privilege")
+	}
+}
+
+func Test_getRole(t *testing.T) {
+	bot := NewBotWithTransport(Network{Name: "test_roles", Nick: "goxxx", Owners: []string{"Owner!*@*"}}, newFakeTransport())
+	defer bot.Stop()
+	bot.permissions = []permission{{mask: "*!*@example.org", role: RoleTrusted, global: true}}
+	bot.setRole("admin!*@*", RoleAdmin, false)
+	bot.setRole("banned!*@*", RoleBanned, false)
+	// The owners cannot be banned
+	bot.setRole("owner!*@*", RoleBanned, false)
+
+	tests := []struct {
+		nick     string
+		expected Role
+	}{
+		{"Owner", RoleOwner},
+		{"Admin", RoleAdmin},
+		{"Banned", RoleBanned},
+		{"Other", RoleTrusted},
+	}
+	for _, test := range tests {
+		if role := bot.getRole(&Event{Network: "test_roles", Nick: test.nick, User: "user", Host: "example.org"}); role != test.expected {
+			t.Errorf("Role %q for %s instead of %q", role, test.nick, test.expected)
+		}
+	}
+
+	bot.setRole("admin!*@*", RoleAdmin, true)
+	if role, present := bot.storedRole("admin!*@*"); present || role != RoleUser {
+		t.Errorf("Role not removed: %q", role)
+	}
+	if _, present := bot.storedRole("*!*@example.org"); present {
+		t.Error("Role of every network given as a role of the network")
+	}
+}
@@ -0,0 +1,87 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"strings"
+)
+
+// Prefix of the commands when none is configured
+const defaultPrefix = "!"
+
+// Prefix returns the prefix of the commands on a channel.
+// The network's prefix is used for the channels without their own prefix and for private messages.
+func (bot *Bot) Prefix(target string) string {
+	for _, channel := range bot.network.Channels {
+		if channel.Prefix != "" && bot.fold(channel.Name) == bot.fold(target) {
+			return channel.Prefix
+		}
+	}
+	if bot.network.Prefix != "" {
+		return bot.network.Prefix
+	}
+	return defaultPrefix
+}
+
+// GetPrefix returns the prefix of the commands where the event was received
+func GetPrefix(event *Event) string {
+	bot := getBot(event)
+	if bot == nil {
+		return defaultPrefix
+	}
+	return bot.Prefix(GetTargetFromEvent(event))
+}
+
+// Help returns the help message of the command, with its triggers preceded by prefix and its arguments:
+// "!memo/!m <nick> <message...> => Leave a memo for another user"
+func (cmd *Command) Help(prefix string) string {
+	var triggers []string
+	for _, trigger := range cmd.Triggers {
+		triggers = append(triggers, prefix+trigger)
+	}
+	help := strings.Join(triggers, "/")
+	if usage := cmd.Usage(); usage != "" {
+		help += " " + usage
+	}
+	if cmd.HelpMessage != "" {
+		help += " => " + cmd.HelpMessage
+	}
+	return help
+}
+
+// parseCommand returns the command line contained in a message, without the prefix: "memo bob hi".
+// In a channel, the message must start with the channel's prefix, or address the bot by its nick ("goxxx: memo bob hi").
+// In a private message, the prefix is optional.
+// ok is false if the message is not a command.
+func (bot *Bot) parseCommand(event *Event) (line string, ok bool) {
+	message := strings.TrimSpace(event.Message())
+	channel := GetChannelFromEvent(event)
+	prefix := bot.Prefix(GetTargetFromEvent(event))
+
+	if fields := strings.Fields(message); len(fields) > 1 {
+		// "goxxx: memo bob hi" or "goxxx, memo bob hi"
+		name := strings.TrimRight(fields[0], ":,")
+		if name != fields[0] && bot.isSelf(name) {
+			message = strings.TrimSpace(message[len(fields[0]):])
+			return strings.TrimSpace(strings.TrimPrefix(message, prefix)), true
+		}
+	}
+	if strings.HasPrefix(message, prefix) {
+		return strings.TrimSpace(message[len(prefix):]), true
+	}
+	return message, channel == ""
+}
+
+// commandEvent returns a copy of the event whose message is the command line, so that the first field is the trigger
+func commandEvent(event *Event, line string) *Event {
+	command := *event
+	command.Arguments = append([]string(nil), event.Arguments...)
+	if len(command.Arguments) != 0 {
+		command.Arguments[len(command.Arguments)-1] = line
+	}
+	return &command
+}
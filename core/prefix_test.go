@@ -0,0 +1,50 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"testing"
+)
+
+func Test_parseCommand(t *testing.T) {
+	bot := NewBotWithTransport(Network{
+		Name:     "test_prefix",
+		Nick:     "goxxx",
+		Channels: []Channel{{Name: "#default"}, {Name: "#other", Prefix: "?"}}}, newFakeTransport())
+	defer bot.Stop()
+
+	tests := []struct {
+		target, message, line string
+		ok                    bool
+	}{
+		{"#default", "!memo bob hi", "memo bob hi", true},
+		{"#default", "  !  memo bob hi", "memo bob hi", true},
+		{"#default", "memo bob hi", "memo bob hi", false},
+		{"#default", "goxxx: memo bob hi", "memo bob hi", true},
+		{"#default", "GOXXX, !memo bob hi", "memo bob hi", true},
+		{"#default", "goxxx is here", "goxxx is here", false},
+		{"#other", "?memo bob hi", "memo bob hi", true},
+		{"#OTHER", "!memo bob hi", "!memo bob hi", false},
+		{"goxxx", "memo bob hi", "memo bob hi", true},
+		{"goxxx", "!memo bob hi", "memo bob hi", true},
+	}
+	for _, test := range tests {
+		event := &Event{Code: "PRIVMSG", Nick: "Sender", Arguments: []string{test.target, test.message}}
+		if line, ok := bot.parseCommand(event); line != test.line || ok != test.ok {
+			t.Errorf("Unexpected result for %q on %s: %q, %t", test.message, test.target, line, ok)
+		}
+	}
+}
+
+func Test_CommandHelp(t *testing.T) {
+	cmd := &Command{
+		Triggers:    []string{"memo", "m"},
+		HelpMessage: "Leave a memo",
+		Args:        []Arg{{Name: "nick"}, {Name: "message", Rest: true}}}
+	if help := cmd.Help("!"); help != "!memo/!m <nick> <message...> => Leave a memo" {
+		t.Errorf("Unexpected help message: %q", help)
+	}
+}
@@ -0,0 +1,258 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Default flood control values: 4 lines can be sent at once, then one line every 2 seconds
+	defaultFloodBurst = 4
+	defaultFloodRate  = 2 * time.Second
+	// Replies shorter than this length (in bytes) are sent before the other replies
+	shortReplyLength = 50
+	// Interval between two checks of the queue while waiting for it to be empty
+	flushInterval = 10 * time.Millisecond
+)
+
+// outLine is a line waiting in the outbound queue
+type outLine struct {
+	target  string
+	message string
+	group   uint64 // Identifies the command invocation that produced the line, 0 if none
+}
+
+// outQueue is the outbound message queue.
+// Lines are sent by a single goroutine, at the pace allowed by a token bucket:
+// the bucket holds up to burst tokens, a token is added every rate and each line sent consumes one token.
+// Targets with pending lines are served in turn, and priority lines are sent before the other lines.
+type outQueue struct {
+	send      func(target, message string)
+	burst     float64
+	rate      time.Duration
+	tokens    float64   // Only used by the sending goroutine
+	lastFill  time.Time // Only used by the sending goroutine
+	priority  []*outLine
+	pending   map[string][]*outLine // Pending lines by target
+	order     []string              // Targets with pending lines, in the order they will be served
+	lastGroup uint64
+	sending   bool // A line was popped and is being sent
+	mutex     sync.Mutex
+	wake      chan struct{}
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// newOutQueue creates a queue and starts its sending goroutine.
+// send is called for each line, burst and rate configure the token bucket (default values are used if <= 0).
+func newOutQueue(send func(target, message string), burst int, rate time.Duration) *outQueue {
+	if burst <= 0 {
+		burst = defaultFloodBurst
+	}
+	if rate <= 0 {
+		rate = defaultFloodRate
+	}
+	queue := &outQueue{
+		send:     send,
+		burst:    float64(burst),
+		rate:     rate,
+		tokens:   float64(burst),
+		lastFill: time.Now(),
+		pending:  make(map[string][]*outLine),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{})}
+	go queue.run()
+	return queue
+}
+
+// newGroup returns a new identifier for the lines of a command invocation
+func (queue *outQueue) newGroup() uint64 {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.lastGroup++
+	return queue.lastGroup
+}
+
+// push adds a line to the queue
+func (queue *outQueue) push(line *outLine, priority bool) {
+	queue.mutex.Lock()
+	if priority {
+		queue.priority = append(queue.priority, line)
+	} else {
+		if len(queue.pending[line.target]) == 0 {
+			queue.order = append(queue.order, line.target)
+		}
+		queue.pending[line.target] = append(queue.pending[line.target], line)
+	}
+	queue.mutex.Unlock()
+
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// cancel removes the pending lines of a group from the queue
+func (queue *outQueue) cancel(group uint64) {
+	if group == 0 {
+		return
+	}
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.priority = filterGroup(queue.priority, group)
+	var order []string
+	for _, target := range queue.order {
+		if lines := filterGroup(queue.pending[target], group); len(lines) != 0 {
+			queue.pending[target] = lines
+			order = append(order, target)
+		} else {
+			delete(queue.pending, target)
+		}
+	}
+	queue.order = order
+}
+
+// hasGroup checks if lines of a group are waiting in the queue
+func (queue *outQueue) hasGroup(group uint64) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	for _, line := range queue.priority {
+		if line.group == group {
+			return true
+		}
+	}
+	for _, lines := range queue.pending {
+		for _, line := range lines {
+			if line.group == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterGroup returns the lines not belonging to group
+func filterGroup(lines []*outLine, group uint64) (result []*outLine) {
+	for _, line := range lines {
+		if line.group != group {
+			result = append(result, line)
+		}
+	}
+	return
+}
+
+// pop removes the next line to send from the queue, nil if the queue is empty
+func (queue *outQueue) pop() *outLine {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if len(queue.priority) != 0 {
+		line := queue.priority[0]
+		queue.priority = queue.priority[1:]
+		queue.sending = true
+		return line
+	}
+	if len(queue.order) == 0 {
+		return nil
+	}
+	target := queue.order[0]
+	queue.order = queue.order[1:]
+	lines := queue.pending[target]
+	if len(lines) > 1 {
+		queue.pending[target] = lines[1:]
+		// The target will be served again after the other targets
+		queue.order = append(queue.order, target)
+	} else {
+		delete(queue.pending, target)
+	}
+	queue.sending = true
+	return lines[0]
+}
+
+// waitForToken blocks until a token is available and consumes it, returns false if the queue was stopped
+func (queue *outQueue) waitForToken() bool {
+	for {
+		now := time.Now()
+		queue.tokens += float64(now.Sub(queue.lastFill)) / float64(queue.rate)
+		if queue.tokens > queue.burst {
+			queue.tokens = queue.burst
+		}
+		queue.lastFill = now
+		if queue.tokens >= 1 {
+			queue.tokens--
+			return true
+		}
+		select {
+		case <-time.After(time.Duration((1 - queue.tokens) * float64(queue.rate))):
+		case <-queue.stop:
+			return false
+		}
+	}
+}
+
+// run sends the queued lines until the queue is stopped.
+// The next line is chosen once a token is available, so that lines pushed or cancelled in the meantime are taken into account.
+func (queue *outQueue) run() {
+	for {
+		if queue.empty() {
+			select {
+			case <-queue.wake:
+				continue
+			case <-queue.stop:
+				return
+			}
+		}
+		if !queue.waitForToken() {
+			return
+		}
+		line := queue.pop()
+		if line == nil {
+			// The pending lines were cancelled, give the token back
+			queue.tokens++
+			continue
+		}
+		queue.send(line.target, line.message)
+		queue.mutex.Lock()
+		queue.sending = false
+		queue.mutex.Unlock()
+	}
+}
+
+// empty checks if there is no line waiting in the queue
+func (queue *outQueue) empty() bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return len(queue.priority) == 0 && len(queue.order) == 0
+}
+
+// flush waits until every queued line is sent, or until timeout.
+// It returns false if some lines were still waiting at the end of timeout.
+func (queue *outQueue) flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		queue.mutex.Lock()
+		idle := !queue.sending && len(queue.priority) == 0 && len(queue.order) == 0
+		queue.mutex.Unlock()
+		if idle {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(flushInterval)
+	}
+}
+
+// close stops the sending goroutine, the pending lines are dropped
+func (queue *outQueue) close() {
+	queue.stopOnce.Do(func() {
+		close(queue.stop)
+	})
+}
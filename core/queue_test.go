@@ -0,0 +1,132 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sentLines stores the lines sent by an outQueue
+type sentLines struct {
+	lines []string
+	times []time.Time
+	mutex sync.Mutex
+}
+
+func (sent *sentLines) send(target, message string) {
+	sent.mutex.Lock()
+	defer sent.mutex.Unlock()
+	sent.lines = append(sent.lines, target+" "+message)
+	sent.times = append(sent.times, time.Now())
+}
+
+// wait waits until count lines were sent and returns them
+func (sent *sentLines) wait(t *testing.T, count int) ([]string, []time.Time) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		sent.mutex.Lock()
+		if len(sent.lines) >= count {
+			defer sent.mutex.Unlock()
+			return sent.lines, sent.times
+		}
+		sent.mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Only %d lines sent instead of %d: %q", len(sent.lines), count, sent.lines)
+	return nil, nil
+}
+
+func Test_outQueue_rate(t *testing.T) {
+	var sent sentLines
+	queue := newOutQueue(sent.send, 2, 100*time.Millisecond)
+	defer queue.close()
+
+	for _, message := range []string{"1", "2", "3", "4"} {
+		queue.push(&outLine{target: "#test_channel", message: message}, false)
+	}
+	lines, times := sent.wait(t, 4)
+
+	expectedLines := []string{"#test_channel 1", "#test_channel 2", "#test_channel 3", "#test_channel 4"}
+	if !reflect.DeepEqual(lines, expectedLines) {
+		t.Errorf("Lines not sent in order: %q", lines)
+	}
+	// The burst is sent at once, then one line every 100ms
+	if delay := times[1].Sub(times[0]); delay > 50*time.Millisecond {
+		t.Errorf("Burst not sent at once, delay between the first two lines: %s", delay)
+	}
+	if delay := times[3].Sub(times[1]); delay < 180*time.Millisecond {
+		t.Errorf("Rate not respected, delay between the second and the fourth lines: %s", delay)
+	}
+}
+
+func Test_outQueue_fairness(t *testing.T) {
+	var sent sentLines
+	queue := newOutQueue(sent.send, 1, 50*time.Millisecond)
+	defer queue.close()
+
+	// Fill the queue before the first token is given back
+	queue.mutex.Lock()
+	for _, message := range []string{"1", "2", "3"} {
+		line := &outLine{target: "#first", message: message}
+		queue.pending[line.target] = append(queue.pending[line.target], line)
+	}
+	queue.pending["#second"] = []*outLine{{target: "#second", message: "1"}}
+	queue.order = []string{"#first", "#second"}
+	queue.mutex.Unlock()
+	queue.wake <- struct{}{}
+
+	lines, _ := sent.wait(t, 4)
+	expectedLines := []string{"#first 1", "#second 1", "#first 2", "#first 3"}
+	if !reflect.DeepEqual(lines, expectedLines) {
+		t.Errorf("Targets not served in turn: %q instead of %q", lines, expectedLines)
+	}
+}
+
+func Test_outQueue_priorityAndCancel(t *testing.T) {
+	var sent sentLines
+	queue := newOutQueue(sent.send, 1, 100*time.Millisecond)
+	defer queue.close()
+
+	group := queue.newGroup()
+	// The first line uses the only token
+	queue.push(&outLine{target: "#test_channel", message: "first"}, false)
+	sent.wait(t, 1)
+	queue.push(&outLine{target: "#test_channel", message: "cancelled 1", group: group}, false)
+	queue.push(&outLine{target: "#test_channel", message: "cancelled 2", group: group}, false)
+	queue.push(&outLine{target: "#test_channel", message: "normal"}, false)
+	queue.push(&outLine{target: "#test_channel", message: "priority"}, true)
+	queue.cancel(group)
+
+	lines, _ := sent.wait(t, 3)
+	expectedLines := []string{"#test_channel first", "#test_channel priority", "#test_channel normal"}
+	if !reflect.DeepEqual(lines, expectedLines) {
+		t.Errorf("Unexpected lines: %q instead of %q", lines, expectedLines)
+	}
+}
+
+func Test_outQueue_flush(t *testing.T) {
+	var sent sentLines
+	queue := newOutQueue(sent.send, 1, 50*time.Millisecond)
+	defer queue.close()
+
+	for _, message := range []string{"first", "second", "third"} {
+		queue.push(&outLine{target: "#channel", message: message}, false)
+	}
+	if queue.flush(10 * time.Millisecond) {
+		t.Error("Queue flushed before the rate allowed to send every line")
+	}
+	if !queue.flush(time.Second) {
+		t.Fatal("Queue not flushed")
+	}
+	sent.mutex.Lock()
+	defer sent.mutex.Unlock()
+	if len(sent.lines) != 3 {
+		t.Errorf("Lines sent when the queue was flushed: %q", sent.lines)
+	}
+}
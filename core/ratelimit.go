@@ -0,0 +1,194 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default rate limit: number of commands a user can run in a window, and duration of an automatic ignore
+	defaultRateLimit      = 5
+	defaultRateWindow     = 30 * time.Second
+	defaultIgnoreDuration = 5 * time.Minute
+)
+
+// rateVerdict is the decision of the rate limiter about a command
+type rateVerdict int
+
+const (
+	rateAllowed rateVerdict = iota // The command is run
+	rateWarned                     // The command is refused and the user is warned
+	rateIgnored                    // The command is refused and the user was warned already: the user is now ignored
+	rateDropped                    // The command is refused silently, the user is ignored
+)
+
+// userRate contains the recent commands of a user
+type userRate struct {
+	times        []time.Time          // Commands run in the current window
+	cooldowns    map[string]time.Time // End of the cooldown of the commands run recently, by first trigger
+	warned       time.Time            // Time of the last warning, zero if the user was not warned
+	ignoredUntil time.Time            // End of the automatic ignore, zero if the user is not ignored
+}
+
+// rateLimiter limits the number of commands run by each user in a sliding window, and enforces the commands' cooldowns.
+// A user going over a limit is warned once, then ignored for a while if the user goes over a limit again during the window.
+type rateLimiter struct {
+	limit     int           // Commands a user can run in a window, no limit if < 0
+	window    time.Duration // Duration of the window, also the time a warning is remembered
+	ignore    time.Duration // Duration of an automatic ignore
+	users     map[string]*userRate
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+// newRateLimiter creates a rate limiter, default values are used for the parameters equal to 0
+func newRateLimiter(limit int, window, ignore time.Duration) *rateLimiter {
+	if limit == 0 {
+		limit = defaultRateLimit
+	}
+	if window <= 0 {
+		window = defaultRateWindow
+	}
+	if ignore <= 0 {
+		ignore = defaultIgnoreDuration
+	}
+	return &rateLimiter{limit: limit, window: window, ignore: ignore, users: make(map[string]*userRate)}
+}
+
+// rateKey returns the key identifying the sender of an event in the rate limiter:
+// the account if known, the user name and host otherwise, so that changing nick does not reset the limits
+func rateKey(event *Event) string {
+	if event.Account != "" {
+		return accountMaskPrefix + NormalizeNick(event, event.Account)
+	}
+	if event.User == "" && event.Host == "" {
+		return NormalizeNick(event, event.Nick)
+	}
+	return strings.ToLower(event.User + "@" + event.Host)
+}
+
+// rateMask returns the mask matching the sender of an event identified by rateKey, used for the automatic ignores
+func rateMask(event *Event) string {
+	key := rateKey(event)
+	switch {
+	case strings.HasPrefix(key, accountMaskPrefix):
+		return key
+	case event.User == "" && event.Host == "":
+		return key + "!*@*"
+	}
+	return "*!" + key
+}
+
+// check records an invocation of cmd by the user identified by key at the time now, and tells if the command can run.
+// wait is the time the user has to wait before running the command again when it is refused.
+func (limiter *rateLimiter) check(key string, cmd *Command, now time.Time) (verdict rateVerdict, wait time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.prune(now)
+
+	user, present := limiter.users[key]
+	if !present {
+		user = &userRate{cooldowns: make(map[string]time.Time)}
+		limiter.users[key] = user
+	}
+	if now.Before(user.ignoredUntil) {
+		return rateDropped, user.ignoredUntil.Sub(now)
+	}
+
+	// Commands out of the window are forgotten
+	recent := user.times[:0]
+	for _, run := range user.times {
+		if now.Sub(run) < limiter.window {
+			recent = append(recent, run)
+		}
+	}
+	user.times = recent
+
+	if end, present := user.cooldowns[cmd.Triggers[0]]; present && now.Before(end) {
+		wait = end.Sub(now)
+	}
+	if limiter.limit > 0 && len(user.times) >= limiter.limit {
+		if limit := user.times[0].Add(limiter.window).Sub(now); limit > wait {
+			wait = limit
+		}
+	}
+	if wait == 0 {
+		user.times = append(user.times, now)
+		if cmd.Cooldown > 0 {
+			user.cooldowns[cmd.Triggers[0]] = now.Add(cmd.Cooldown)
+		}
+		return rateAllowed, 0
+	}
+
+	if !user.warned.IsZero() && now.Sub(user.warned) < limiter.window {
+		user.warned = time.Time{}
+		user.ignoredUntil = now.Add(limiter.ignore)
+		return rateIgnored, limiter.ignore
+	}
+	user.warned = now
+	return rateWarned, wait
+}
+
+// prune forgets the users without recent commands, warnings or ignores, at most once per window
+func (limiter *rateLimiter) prune(now time.Time) {
+	if now.Sub(limiter.lastPrune) < limiter.window {
+		return
+	}
+	limiter.lastPrune = now
+	for key, user := range limiter.users {
+		if now.Before(user.ignoredUntil) || now.Sub(user.warned) < limiter.window {
+			continue
+		}
+		idle := true
+		for trigger, end := range user.cooldowns {
+			if now.Before(end) {
+				idle = false
+			} else {
+				delete(user.cooldowns, trigger)
+			}
+		}
+		for _, run := range user.times {
+			idle = idle && now.Sub(run) >= limiter.window
+		}
+		if idle {
+			delete(limiter.users, key)
+		}
+	}
+}
+
+// allowCommand checks if the sender of the event can run the command now, with respect to the rate limits.
+// The sender is warned the first time a limit is reached, and ignored for a while if it happens again.
+// The owners and the administrators are not limited.
+func (bot *Bot) allowCommand(event *Event, cmd *Command, role Role, callback func(*ReplyCallbackData)) bool {
+	if role >= RoleAdmin {
+		return true
+	}
+	verdict, wait := bot.limiter.check(rateKey(event), cmd, time.Now())
+	switch verdict {
+	case rateWarned:
+		if callback != nil {
+			callback(&ReplyCallbackData{
+				Message:  fmt.Sprintf("%s: please slow down, you can run %s again in %s", event.Nick, bot.trigger(event), roundWait(wait)),
+				Target:   GetTargetFromEvent(event),
+				Priority: true})
+		}
+	case rateIgnored:
+		bot.ignoreAutomatically(event, wait)
+		log.Printf("%s ignored for %s on network %q: too many commands\n", event.Source, wait, bot.network.Name)
+	}
+	return verdict == rateAllowed
+}
+
+// roundWait rounds up a waiting time to the second, for the messages
+func roundWait(wait time.Duration) time.Duration {
+	return (wait + time.Second - 1).Truncate(time.Second)
+}
@@ -0,0 +1,88 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_rateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2, time.Minute, 5*time.Minute)
+	cmd := &Command{Triggers: []string{"echo"}}
+	start := time.Now()
+	tests := []struct {
+		elapsed time.Duration
+		verdict rateVerdict
+	}{
+		{0, rateAllowed},
+		{time.Second, rateAllowed},
+		{2 * time.Second, rateWarned},
+		// The first command is out of the window, the warning is forgotten after the window
+		{time.Minute, rateAllowed},
+		{2*time.Minute + 3*time.Second, rateAllowed},
+		{2*time.Minute + 4*time.Second, rateAllowed},
+		{2*time.Minute + 5*time.Second, rateWarned},
+		{2*time.Minute + 6*time.Second, rateIgnored},
+		{2*time.Minute + 7*time.Second, rateDropped},
+	}
+	for _, test := range tests {
+		if verdict, _ := limiter.check("sender", cmd, start.Add(test.elapsed)); verdict != test.verdict {
+			t.Errorf("Verdict %d after %s instead of %d", verdict, test.elapsed, test.verdict)
+		}
+	}
+	if verdict, _ := limiter.check("sender", cmd, start.Add(7*time.Minute)); verdict != rateDropped {
+		t.Errorf("Ignore shorter than its duration")
+	}
+	if verdict, _ := limiter.check("sender", cmd, start.Add(7*time.Minute+7*time.Second)); verdict != rateAllowed {
+		t.Errorf("Command refused at the end of the ignore")
+	}
+	if verdict, _ := limiter.check("other", cmd, start.Add(2*time.Minute+10*time.Second)); verdict != rateAllowed {
+		t.Errorf("Other user limited")
+	}
+}
+
+func Test_rateLimiterCooldown(t *testing.T) {
+	limiter := newRateLimiter(-1, time.Minute, time.Minute)
+	cmd := &Command{Triggers: []string{"search", "s"}, Cooldown: 10 * time.Second}
+	start := time.Now()
+
+	if verdict, _ := limiter.check("sender", cmd, start); verdict != rateAllowed {
+		t.Fatalf("First command refused")
+	}
+	if verdict, wait := limiter.check("sender", cmd, start.Add(4*time.Second)); verdict != rateWarned || wait != 6*time.Second {
+		t.Errorf("Command run during its cooldown: %d, %s", verdict, wait)
+	}
+	if verdict, _ := limiter.check("sender", &Command{Triggers: []string{"echo"}}, start.Add(5*time.Second)); verdict != rateAllowed {
+		t.Errorf("Command without cooldown refused")
+	}
+	if verdict, _ := limiter.check("sender", cmd, start.Add(10*time.Second)); verdict != rateAllowed {
+		t.Errorf("Command refused after its cooldown")
+	}
+	// No limit on the number of commands
+	for i := 0; i < 20; i++ {
+		if verdict, _ := limiter.check("sender", &Command{Triggers: []string{"echo"}}, start.Add(11*time.Second)); verdict != rateAllowed {
+			t.Fatalf("Command %d refused without rate limit", i)
+		}
+	}
+}
+
+func Test_rateKey(t *testing.T) {
+	tests := []struct {
+		event    *Event
+		expected string
+	}{
+		{&Event{Nick: "Sender", User: "~sender", Host: "Example.org"}, "~sender@example.org"},
+		{&Event{Nick: "Other", User: "~sender", Host: "Example.org"}, "~sender@example.org"},
+		{&Event{Nick: "Sender", User: "~sender", Host: "example.org", Account: "SenderAccount"}, "account:senderaccount"},
+		{&Event{Nick: "Sender"}, "sender"},
+	}
+	for _, test := range tests {
+		if key := rateKey(test.event); key != test.expected {
+			t.Errorf("rateKey(%#v) = %q instead of %q", test.event, key, test.expected)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	// Default delays between two connection attempts, the delay doubles after each failed attempt
+	defaultReconnectMinDelay = 2 * time.Second
+	defaultReconnectMaxDelay = 5 * time.Minute
+)
+
+// Interval between two attempts to get the configured nick back, when it was in use
+var nickReclaimInterval = time.Minute
+
+// ConnectionStatus structure that describes the state of the connection of a bot
+type ConnectionStatus struct {
+	Connected         bool      // Registered on the server
+	Reconnections     int       // Number of successful reconnections since the bot started
+	LastDisconnection time.Time // Time of the last lost connection
+	LastError         string    // Error that caused the last lost connection, or the last failed connection attempt
+}
+
+// Status returns the state of the bot's connection
+func (bot *Bot) Status() ConnectionStatus {
+	bot.statusMutex.Lock()
+	defer bot.statusMutex.Unlock()
+	return bot.status
+}
+
+// addReconnectCallbacks adds the callbacks keeping track of the connection and reclaiming the bot's nick
+func (bot *Bot) addReconnectCallbacks() {
+	// RPL_WELCOME: the connection is established
+	bot.addCallback("001", func(event *Event) {
+		bot.statusMutex.Lock()
+		reconnected := bot.connections > 0
+		if reconnected {
+			bot.status.Reconnections++
+		}
+		bot.status.Connected = true
+		bot.connections++
+		bot.failures = 0
+		reconnections := bot.status.Reconnections
+		bot.statusMutex.Unlock()
+		if reconnected {
+			log.Printf("Reconnected to network %q (%d reconnections)\n", bot.network.Name, reconnections)
+		}
+		bot.reclaimNick()
+	})
+
+	bot.addCallback(EventDisconnected, func(event *Event) {
+		bot.statusMutex.Lock()
+		bot.status.Connected = false
+		bot.status.LastDisconnection = time.Now()
+		bot.status.LastError = event.Message()
+		bot.statusMutex.Unlock()
+		log.Printf("Connection to network %q lost: %s\n", bot.network.Name, event.Message())
+		// Stops the attempts to reclaim the nick
+		bot.reclaimNick()
+		go bot.connect()
+	})
+
+	// The configured nick may be released by its holder changing nick or quitting
+	for _, code := range []string{"NICK", "QUIT"} {
+		bot.addCallback(code, func(event *Event) {
+			if bot.fold(event.Nick) == bot.fold(bot.network.Nick) {
+				bot.reclaimNick()
+			}
+		})
+	}
+}
+
+// connect connects to the server, and tries again with an increasing delay until the connection succeeds or the bot stops.
+// It returns false if the bot stopped before being connected.
+func (bot *Bot) connect() bool {
+	for {
+		bot.statusMutex.Lock()
+		failures, connections := bot.failures, bot.connections
+		bot.statusMutex.Unlock()
+		if failures > 0 || connections > 0 {
+			delay := bot.reconnectDelay(failures)
+			log.Printf("Connecting to network %q in %s\n", bot.network.Name, delay)
+			select {
+			case <-time.After(delay):
+			case <-bot.stop:
+				return false
+			}
+		}
+
+		bot.resetAuth()
+		bot.resetMembers()
+		err := bot.transport.Connect()
+		if err == nil {
+			return true
+		}
+		log.Printf("Connection to %q failed: %s\n", bot.network.Server, err)
+		bot.statusMutex.Lock()
+		bot.failures++
+		bot.status.LastError = err.Error()
+		bot.statusMutex.Unlock()
+	}
+}
+
+// reconnectDelay returns the delay before the next connection attempt.
+// The delay doubles after each failed attempt, up to the maximal delay, and half of it is random
+// so that several bots disconnected at the same time do not reconnect at the same time.
+func (bot *Bot) reconnectDelay(failures int) time.Duration {
+	minDelay, maxDelay := bot.network.ReconnectMinDelay, bot.network.ReconnectMaxDelay
+	if minDelay <= 0 {
+		minDelay = defaultReconnectMinDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultReconnectMaxDelay
+	}
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+	delay := minDelay
+	for i := 0; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// reclaimNick tries to change the bot's nick back to the configured one,
+// and tries again periodically until the nick is recovered or the connection is lost
+func (bot *Bot) reclaimNick() {
+	bot.selfMutex.RLock()
+	nick := bot.self.Nick
+	bot.selfMutex.RUnlock()
+
+	bot.statusMutex.Lock()
+	defer bot.statusMutex.Unlock()
+	if bot.reclaimTimer != nil {
+		bot.reclaimTimer.Stop()
+		bot.reclaimTimer = nil
+	}
+	if bot.fold(nick) == bot.fold(bot.network.Nick) || !bot.status.Connected {
+		return
+	}
+	bot.transport.SendRaw("NICK " + bot.network.Nick)
+	bot.reclaimTimer = time.AfterFunc(nickReclaimInterval, bot.reclaimNick)
+}
@@ -0,0 +1,38 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_reconnectDelay(t *testing.T) {
+	bot := &Bot{network: Network{ReconnectMinDelay: time.Second, ReconnectMaxDelay: 10 * time.Second}}
+	tests := []struct {
+		failures int
+		max      time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{4, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			// Half of the delay is random
+			if delay := bot.reconnectDelay(test.failures); delay < test.max/2 || delay > test.max {
+				t.Errorf("Delay after %d failures not between %s and %s: %s", test.failures, test.max/2, test.max, delay)
+			}
+		}
+	}
+
+	bot.network = Network{}
+	if delay := bot.reconnectDelay(0); delay < defaultReconnectMinDelay/2 || delay > defaultReconnectMinDelay {
+		t.Errorf("Unexpected default delay: %s", delay)
+	}
+}
@@ -0,0 +1,66 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Maximum length of an IRC line, CR-LF included (https://tools.ietf.org/html/rfc1459#section-2.3)
+	maxLineLength = 512
+	// Lengths assumed for the bot's user name and host until the server tells us the real ones
+	defaultUserLength = 10
+	defaultHostLength = 63
+	// Minimal length of a message part, so that a very long target does not prevent sending anything
+	minMessageLength = 64
+)
+
+// lineBreakReplacer replaces the characters that would end the IRC line, to prevent the injection of raw IRC commands
+var lineBreakReplacer = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ", "\x00", "")
+
+// sanitizeMessage removes the line breaks and the NUL characters from a message
+func sanitizeMessage(message string) string {
+	return lineBreakReplacer.Replace(message)
+}
+
+// messageLength returns the maximum length (in bytes) of a message sent to target,
+// given the prefix the server adds when relaying it: ":nick!user@host PRIVMSG target :message\r\n"
+func messageLength(source, target string) int {
+	length := maxLineLength - len(":"+source+" PRIVMSG "+target+" :\r\n")
+	if length < minMessageLength {
+		return minMessageLength
+	}
+	return length
+}
+
+// splitMessage splits a message in parts of at most maxLength bytes.
+// Messages are split on spaces when possible, and never inside a UTF-8 character.
+func splitMessage(message string, maxLength int) []string {
+	var parts []string
+	message = strings.TrimSpace(message)
+	for len(message) > maxLength {
+		cut := strings.LastIndex(message[:maxLength+1], " ")
+		if cut <= 0 {
+			// No space to split on: cut the word at the last rune boundary
+			cut = maxLength
+			for cut > 0 && !utf8.RuneStart(message[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				cut = maxLength
+			}
+		}
+		parts = append(parts, strings.TrimRight(message[:cut], " "))
+		message = strings.TrimLeft(message[cut:], " ")
+	}
+	if message != "" || len(parts) == 0 {
+		parts = append(parts, message)
+	}
+	return parts
+}
@@ -0,0 +1,61 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func Test_sanitizeMessage(t *testing.T) {
+	message := sanitizeMessage("Title\r\nQUIT :injected\rline\nend\x00")
+	if expected := "Title QUIT :injected line end"; message != expected {
+		t.Errorf("Incorrect sanitized message: %q instead of %q", message, expected)
+	}
+}
+
+func Test_messageLength(t *testing.T) {
+	length := messageLength("goxxx!goxxx@example.com", "#test_channel")
+	// ":goxxx!goxxx@example.com PRIVMSG #test_channel :" + "\r\n"
+	if expected := 512 - 48 - 2; length != expected {
+		t.Errorf("Incorrect message length: %d instead of %d", length, expected)
+	}
+	if length := messageLength("goxxx!goxxx@example.com", strings.Repeat("#", 500)); length != minMessageLength {
+		t.Errorf("Incorrect message length for a long target: %d instead of %d", length, minMessageLength)
+	}
+}
+
+func Test_splitMessage(t *testing.T) {
+	tests := []struct {
+		message   string
+		maxLength int
+		expected  []string
+	}{
+		{"short message", 20, []string{"short message"}},
+		{"one two three four", 9, []string{"one two", "three", "four"}},
+		{"one  two", 3, []string{"one", "two"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"", 10, []string{""}},
+	}
+	for _, test := range tests {
+		if parts := splitMessage(test.message, test.maxLength); !reflect.DeepEqual(parts, test.expected) {
+			t.Errorf("Incorrect split of %q: %q instead of %q", test.message, parts, test.expected)
+		}
+	}
+
+	// Multi-byte characters must not be cut
+	parts := splitMessage(strings.Repeat("é", 10), 5)
+	for _, part := range parts {
+		if !utf8.ValidString(part) || len(part) > 5 {
+			t.Errorf("Invalid part %q in %q", part, parts)
+		}
+	}
+	if joined := strings.Join(parts, ""); joined != strings.Repeat("é", 10) {
+		t.Errorf("Characters lost while splitting: %q", joined)
+	}
+}
@@ -0,0 +1,29 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+// EventDisconnected is the code of the event sent by a transport when the connection to the server is lost,
+// its only argument is the error that caused the disconnection
+const EventDisconnected = "DISCONNECTED"
+
+// Transport is the interface used by the bot to communicate with an IRC server
+type Transport interface {
+	// Connect opens the connection to the server and registers the bot's nick.
+	// It is called again to reconnect after an EventDisconnected event.
+	Connect() error
+	// Join joins a channel, key can be empty
+	Join(channel, key string)
+	// Privmsg sends a message to a channel or a nick
+	Privmsg(target, message string)
+	// SendRaw sends a raw IRC line to the server
+	SendRaw(line string)
+	// Events returns the channel on which the received events are sent.
+	// The channel is closed once the transport has quit.
+	Events() <-chan *Event
+	// Quit disconnects from the server
+	Quit()
+}
@@ -0,0 +1,131 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// Default size of the worker pool: number of handlers running at once, and number of handler calls waiting for a worker
+	defaultWorkers     = 8
+	defaultWorkerQueue = 64
+	// Default time given to a handler before its context is cancelled
+	defaultHandlerTimeout = 30 * time.Second
+)
+
+// job is a handler call waiting for a worker
+type job struct {
+	run     func(ctx context.Context)
+	timeout time.Duration
+}
+
+// workerPool runs the handlers on a fixed number of goroutines.
+// The calls wait for a worker in a bounded queue, new calls are refused when the queue is full.
+// Each call gets a context cancelled when its deadline is reached, or when the pool is closed.
+type workerPool struct {
+	jobs     chan job
+	ctx      context.Context // Cancelled when the pool is closed
+	cancel   context.CancelFunc
+	pending  int           // Calls queued or running
+	draining bool          // New calls are refused, idle is closed once the pending calls are done
+	idle     chan struct{} // Closed when the pool is draining and no call is pending
+	mutex    sync.Mutex    // Protects pending, draining and idle
+}
+
+// newWorkerPool creates a pool and starts its workers.
+// workers is the number of calls running at once, queueSize the number of calls waiting for a worker (default values are used if <= 0).
+func newWorkerPool(workers, queueSize int) *workerPool {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultWorkerQueue
+	}
+	pool := &workerPool{jobs: make(chan job, queueSize), idle: make(chan struct{})}
+	pool.ctx, pool.cancel = context.WithCancel(context.Background())
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+// submit queues a call, run is given a context cancelled after timeout.
+// It returns false if the call was refused: the queue is full, or the pool is draining or closed.
+func (pool *workerPool) submit(timeout time.Duration, run func(ctx context.Context)) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.draining || pool.ctx.Err() != nil {
+		return false
+	}
+	select {
+	case pool.jobs <- job{run: run, timeout: timeout}:
+		pool.pending++
+		return true
+	default:
+		return false
+	}
+}
+
+// stopping checks if the pool refuses the new calls because it is draining or closed
+func (pool *workerPool) stopping() bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return pool.draining || pool.ctx.Err() != nil
+}
+
+// done is called when a call returns
+func (pool *workerPool) done() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.pending--
+	if pool.draining && pool.pending == 0 {
+		close(pool.idle)
+	}
+}
+
+// drain refuses the new calls and waits until the queued and running calls are done, or until timeout.
+// It returns false if some calls were still pending at the end of timeout.
+func (pool *workerPool) drain(timeout time.Duration) bool {
+	pool.mutex.Lock()
+	if !pool.draining {
+		pool.draining = true
+		if pool.pending == 0 {
+			close(pool.idle)
+		}
+	}
+	pool.mutex.Unlock()
+
+	select {
+	case <-pool.idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// work runs the queued calls until the pool is closed
+func (pool *workerPool) work() {
+	for {
+		select {
+		case <-pool.ctx.Done():
+			return
+		case job := <-pool.jobs:
+			ctx, cancel := context.WithTimeout(pool.ctx, job.timeout)
+			job.run(ctx)
+			cancel()
+			pool.done()
+		}
+	}
+}
+
+// close cancels the running calls and drops the queued ones, the workers exit once their current call returns
+func (pool *workerPool) close() {
+	pool.cancel()
+}
@@ -0,0 +1,112 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package core
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_workerPool(t *testing.T) {
+	pool := newWorkerPool(1, 1)
+	defer pool.close()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	if !pool.submit(time.Minute, func(ctx context.Context) {
+		close(started)
+		<-release
+	}) {
+		t.Fatal("Call refused by an idle pool")
+	}
+	<-started
+
+	// The worker is busy, one call can wait in the queue
+	done := make(chan struct{})
+	if !pool.submit(time.Minute, func(ctx context.Context) { close(done) }) {
+		t.Fatal("Call refused while the queue is not full")
+	}
+	if pool.submit(time.Minute, func(ctx context.Context) {}) {
+		t.Error("Call accepted while the queue is full")
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Queued call not run")
+	}
+}
+
+func Test_workerPoolTimeout(t *testing.T) {
+	pool := newWorkerPool(1, 1)
+	defer pool.close()
+
+	result := make(chan error)
+	pool.submit(10*time.Millisecond, func(ctx context.Context) {
+		<-ctx.Done()
+		result <- ctx.Err()
+	})
+	select {
+	case err := <-result:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Unexpected context error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Context not cancelled at the deadline")
+	}
+}
+
+func Test_workerPoolClose(t *testing.T) {
+	pool := newWorkerPool(1, 1)
+
+	started, result := make(chan struct{}), make(chan error)
+	pool.submit(time.Minute, func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		result <- ctx.Err()
+	})
+	<-started
+	pool.close()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("Unexpected context error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Running call not cancelled when the pool is closed")
+	}
+	if pool.submit(time.Minute, func(ctx context.Context) {}) {
+		t.Error("Call accepted by a closed pool")
+	}
+}
+
+func Test_workerPoolDrain(t *testing.T) {
+	pool := newWorkerPool(1, 2)
+	defer pool.close()
+
+	release := make(chan struct{})
+	var finished int32
+	for i := 0; i < 2; i++ {
+		pool.submit(time.Minute, func(ctx context.Context) {
+			<-release
+			atomic.AddInt32(&finished, 1)
+		})
+	}
+	if pool.drain(20 * time.Millisecond) {
+		t.Error("Pool drained while calls are pending")
+	}
+	if pool.submit(time.Minute, func(ctx context.Context) {}) {
+		t.Error("Call accepted by a draining pool")
+	}
+	close(release)
+	if !pool.drain(time.Second) {
+		t.Fatal("Pool not drained once the calls returned")
+	}
+	if count := atomic.LoadInt32(&finished); count != 2 {
+		t.Errorf("%d calls finished instead of 2, the queued calls must run while the pool drains", count)
+	}
+}
@@ -59,7 +59,7 @@ func NewDatabase(databaseName string, migrationsFolder string, reset bool) *sql.
 	return db
 }
 
-// AddUser adds an user to the database.
+// AddUser adds an user to the database, nick being normalized (see core.NormalizeNick).
 func AddUser(nick, email string) (err error) {
 	if dbPtr == nil {
 		return errors.New("Database pointer is nil")
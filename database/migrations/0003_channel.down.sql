@@ -0,0 +1,27 @@
+
+CREATE TABLE link_backup (
+    id integer NOT NULL PRIMARY KEY,
+    user TEXT,
+    url TEXT,
+    date DATETIME DEFAULT CURRENT_TIMESTAMP,
+    title TEXT);
+
+INSERT INTO link_backup SELECT id, user, url, date, title FROM Link;
+
+DROP TABLE Link;
+
+ALTER TABLE link_backup RENAME TO Link;
+
+
+CREATE TABLE quote_backup (
+    id integer NOT NULL PRIMARY KEY,
+    user TEXT,
+    content TEXT,
+    date DATETIME DEFAULT CURRENT_TIMESTAMP,
+    sender TEXT DEFAULT "?");
+
+INSERT INTO quote_backup SELECT id, user, content, date, sender FROM Quote;
+
+DROP TABLE Quote;
+
+ALTER TABLE quote_backup RENAME TO Quote;
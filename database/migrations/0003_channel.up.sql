@@ -0,0 +1,5 @@
+
+-- Rows created before multi-channel support have an empty channel and are shared by all channels
+ALTER TABLE Link ADD COLUMN channel TEXT DEFAULT "";
+
+ALTER TABLE Quote ADD COLUMN channel TEXT DEFAULT "";
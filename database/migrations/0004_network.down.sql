@@ -0,0 +1,43 @@
+
+CREATE TABLE link_backup (
+    id integer NOT NULL PRIMARY KEY,
+    user TEXT,
+    url TEXT,
+    date DATETIME DEFAULT CURRENT_TIMESTAMP,
+    title TEXT,
+    channel TEXT DEFAULT "");
+
+INSERT INTO link_backup SELECT id, user, url, date, title, channel FROM Link;
+
+DROP TABLE Link;
+
+ALTER TABLE link_backup RENAME TO Link;
+
+
+CREATE TABLE memo_backup (
+    id integer NOT NULL PRIMARY KEY,
+    user_to TEXT,
+    user_from TEXT,
+    message TEXT,
+    date DATETIME DEFAULT CURRENT_TIMESTAMP);
+
+INSERT INTO memo_backup SELECT id, user_to, user_from, message, date FROM Memo;
+
+DROP TABLE Memo;
+
+ALTER TABLE memo_backup RENAME TO Memo;
+
+
+CREATE TABLE quote_backup (
+    id integer NOT NULL PRIMARY KEY,
+    user TEXT,
+    content TEXT,
+    date DATETIME DEFAULT CURRENT_TIMESTAMP,
+    sender TEXT DEFAULT "?",
+    channel TEXT DEFAULT "");
+
+INSERT INTO quote_backup SELECT id, user, content, date, sender, channel FROM Quote;
+
+DROP TABLE Quote;
+
+ALTER TABLE quote_backup RENAME TO Quote;
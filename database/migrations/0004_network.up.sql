@@ -0,0 +1,7 @@
+
+-- Rows created before multi-network support have an empty network and are shared by all networks
+ALTER TABLE Link ADD COLUMN network TEXT DEFAULT "";
+
+ALTER TABLE Memo ADD COLUMN network TEXT DEFAULT "";
+
+ALTER TABLE Quote ADD COLUMN network TEXT DEFAULT "";
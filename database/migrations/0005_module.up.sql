@@ -0,0 +1,6 @@
+-- Modules enabled or disabled at runtime with the !module command, by network
+CREATE TABLE IF NOT EXISTS Module (
+    network TEXT NOT NULL,
+    name TEXT NOT NULL,
+    enabled INTEGER NOT NULL,
+    PRIMARY KEY (network, name));
@@ -0,0 +1,6 @@
+-- Roles bound to hostmasks or accounts, an empty network applies to every network
+CREATE TABLE IF NOT EXISTS Permission (
+    network TEXT NOT NULL,
+    mask TEXT NOT NULL,
+    role TEXT NOT NULL,
+    PRIMARY KEY (network, mask));
@@ -0,0 +1,6 @@
+-- Users ignored by the bot, by hostmask or account
+CREATE TABLE IF NOT EXISTS Ignore (
+    network TEXT NOT NULL,
+    mask TEXT NOT NULL,
+    added_by TEXT NOT NULL,
+    PRIMARY KEY (network, mask));
@@ -0,0 +1,34 @@
+-- The nicks of the memos and the quotes are restored as they were typed, the other normalized nicks are kept
+UPDATE Memo SET user_to = user_to_display, user_from = user_from_display;
+
+UPDATE Quote SET user = user_display;
+
+CREATE TABLE memo_backup (
+    id integer NOT NULL PRIMARY KEY,
+    user_to TEXT,
+    user_from TEXT,
+    message TEXT,
+    date DATETIME DEFAULT CURRENT_TIMESTAMP,
+    network TEXT DEFAULT "");
+
+INSERT INTO memo_backup SELECT id, user_to, user_from, message, date, network FROM Memo;
+
+DROP TABLE Memo;
+
+ALTER TABLE memo_backup RENAME TO Memo;
+
+
+CREATE TABLE quote_backup (
+    id integer NOT NULL PRIMARY KEY,
+    user TEXT,
+    content TEXT,
+    date DATETIME DEFAULT CURRENT_TIMESTAMP,
+    sender TEXT DEFAULT "?",
+    channel TEXT DEFAULT "",
+    network TEXT DEFAULT "");
+
+INSERT INTO quote_backup SELECT id, user, content, date, sender, channel, network FROM Quote;
+
+DROP TABLE Quote;
+
+ALTER TABLE quote_backup RENAME TO Quote;
@@ -0,0 +1,26 @@
+-- The nicks used as keys are lowercased ("Bob" => "bob"). The case mapping of each network is only known once connected,
+-- so the special characters folded by the RFC 1459 case mappings ("[]\~" => "{}|^") are kept as they are:
+-- the rows with these characters in their nick are not found on the networks using these case mappings, until they are stored again.
+-- When two rows of a table differ only by the case of a nick, one of them is kept.
+-- The nicks displayed by the memos and the quotes are kept as they were typed in separate columns.
+ALTER TABLE Memo ADD COLUMN user_to_display TEXT DEFAULT "";
+
+ALTER TABLE Memo ADD COLUMN user_from_display TEXT DEFAULT "";
+
+ALTER TABLE Quote ADD COLUMN user_display TEXT DEFAULT "";
+
+UPDATE Memo SET user_to_display = user_to, user_from_display = user_from;
+
+UPDATE Quote SET user_display = user;
+
+UPDATE Memo SET user_to = lower(user_to), user_from = lower(user_from);
+
+UPDATE Quote SET user = lower(user);
+
+UPDATE OR REPLACE Invoke SET nick = lower(nick);
+
+UPDATE OR REPLACE User SET nick = lower(nick);
+
+UPDATE OR REPLACE Permission SET mask = lower(mask);
+
+UPDATE OR REPLACE Ignore SET mask = lower(mask);
@@ -10,24 +10,28 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
-	"github.com/vaz-ar/cfgFlags"
 	"github.com/vaz-ar/goxxx/core"
 	"github.com/vaz-ar/goxxx/database"
 	"github.com/vaz-ar/goxxx/modules/help"
-	// "github.com/vaz-ar/goxxx/modules/invoke"
-	"github.com/vaz-ar/goxxx/modules/memo"
-	"github.com/vaz-ar/goxxx/modules/pictures"
-	"github.com/vaz-ar/goxxx/modules/quote"
-	"github.com/vaz-ar/goxxx/modules/search"
-	"github.com/vaz-ar/goxxx/modules/webinfo"
-	"github.com/vaz-ar/goxxx/modules/xkcd"
+	// Modules register themselves when their package is imported
+	_ "github.com/vaz-ar/goxxx/modules/invoke"
+	_ "github.com/vaz-ar/goxxx/modules/memo"
+	_ "github.com/vaz-ar/goxxx/modules/pictures"
+	_ "github.com/vaz-ar/goxxx/modules/quote"
+	_ "github.com/vaz-ar/goxxx/modules/search"
+	_ "github.com/vaz-ar/goxxx/modules/webinfo"
+	_ "github.com/vaz-ar/goxxx/modules/xkcd"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 // Version and build time
@@ -46,27 +50,52 @@ const (
 
 // Config struct
 type configData struct {
-	channel       string
-	channelKey    string
-	nick          string
-	server        string
-	modules       []string
-	debug         bool
-	useLogfile    bool
-	emailServer   string
-	emailPort     int
-	emailSender   string
-	emailAccount  string
-	emailPassword string
+	networks        []networkConfig
+	shutdownTimeout time.Duration
+	debug           bool
+	useLogfile      bool
+	emailServer     string
+	emailPort       int
+	emailSender     string
+	emailAccount    string
+	emailPassword   string
+}
+
+// Network configuration: connection informations and enabled modules
+type networkConfig struct {
+	core.Network
+	modules []string
 }
 
 // getOptions processes the command line arguments
 func getOptions() (config configData, returnCode int) {
 	// IRC
-	flag.StringVar(&config.channel, "channel", "", "IRC channel name")
-	flag.StringVar(&config.channelKey, "key", "", "IRC channel key (optional)")
-	flag.StringVar(&config.nick, "nick", "goxxx", "the bot's nickname (optional)")
-	flag.StringVar(&config.server, "server", "chat.freenode.net:6697", "IRC_SERVER[:PORT] (optional)")
+	channels := flag.String("channel", "", "IRC channel names (separated by commas)")
+	channelKeys := flag.String("key", "", "IRC channel keys, in the same order as the channels (separated by commas, optional)")
+	nick := flag.String("nick", "goxxx", "the bot's nickname (optional)")
+	prefix := flag.String("prefix", "!", "Prefix of the commands (optional)")
+	server := flag.String("server", "chat.freenode.net:6697", "IRC_SERVER[:PORT] (optional)")
+	useTLS := flag.Bool("tls", true, "Use a TLS connection to the IRC server (optional)")
+	network := flag.String("network", "default", "Name of the IRC network (optional)")
+	floodBurst := flag.Int("flood_burst", 4, "Number of messages the bot can send at once (optional)")
+	floodRate := flag.Duration("flood_rate", 2*time.Second, "Delay between two messages once the burst is spent (optional)")
+	auth := flag.String("auth", "", "Authentication method: \"sasl_plain\", \"sasl_external\" or \"nickserv\" (optional)")
+	account := flag.String("account", "", "Account used for the authentication, the nick is used if empty (optional)")
+	password := flag.String("password", "", "Password used for the authentication (optional)")
+	tlsCert := flag.String("tls_cert", "", "Client certificate file (PEM), for the \"sasl_external\" authentication (optional)")
+	tlsKey := flag.String("tls_key", "", "Private key file of the client certificate (PEM), for the \"sasl_external\" authentication (optional)")
+	owners := flag.String("owners", "", "Masks of the bot's owners, \"nick!user@host\" with wildcards or \"account:<name>\" (separated by commas, optional)")
+	reconnectDelay := flag.Duration("reconnect_delay", 2*time.Second, "Delay before reconnecting, doubled after each failed attempt (optional)")
+	reconnectMaxDelay := flag.Duration("reconnect_max_delay", 5*time.Minute, "Maximal delay between two connection attempts (optional)")
+	workers := flag.Int("workers", 8, "Number of command and message handlers running at once (optional)")
+	workerQueue := flag.Int("worker_queue", 64, "Number of handler calls waiting for a worker, the next ones are refused (optional)")
+	handlerTimeout := flag.Duration("handler_timeout", 30*time.Second, "Time given to a handler before it is cancelled (optional)")
+	rateLimit := flag.Int("rate_limit", 5, "Number of commands a user can run in rate_window, no limit if negative (optional)")
+	rateWindow := flag.Duration("rate_window", 30*time.Second, "Window of the rate limit, users going over the limit twice in a window are ignored (optional)")
+	ignoreDuration := flag.Duration("ignore_duration", 5*time.Minute, "Time users going over the rate limit are ignored (optional)")
+	quitMessage := flag.String("quit_message", "", "Message sent when the bot quits the server (optional)")
+	plainText := flag.Bool("plain_text", false, "Send the messages without formatting (bold, colors, ...), for the networks refusing it (optional)")
+	pageSize := flag.Int("page_size", 4, "Number of results displayed at once, the others are displayed with !more (optional)")
 	modules := flag.String("modules", "memo,webinfo,invoke,search,xkcd,pictures,quote", "Modules to enable (separated by commas)")
 	// Email
 	flag.StringVar(&config.emailServer, "email_server", "", "SMTP server address")
@@ -75,12 +104,15 @@ func getOptions() (config configData, returnCode int) {
 	flag.StringVar(&config.emailAccount, "email_account", "", "Email address from which to send emails")
 	flag.StringVar(&config.emailPassword, "email_pwd", "", "password for the SMTP server")
 	// Application
+	flag.DurationVar(&config.shutdownTimeout, "shutdown_timeout", 10*time.Second, "Time given to the running commands and the queued messages when goxxx stops")
 	flag.BoolVar(&config.debug, "debug", false, "Debug mode")
 	flag.BoolVar(&config.useLogfile, "use_logfile", true, "If true logs will go to the logfile, else to the standard output")
 	version := flag.Bool("version", false, "Display goxxx version")
+	configPath := flag.String("config", "goxxx.ini", "Configuration file (optional)")
 
 	flag.Usage = func() {
-		fmt.Println("Usage:", os.Args[0], "-channel CHANNEL [ARGUMENTS]")
+		fmt.Println("Usage:", os.Args[0], "-channel CHANNEL[,CHANNEL...] [ARGUMENTS]")
+		fmt.Println("(-channel is not needed if networks are declared in the configuration file)")
 		fmt.Println()
 		fmt.Println("Arguments description:")
 		flag.PrintDefaults()
@@ -90,12 +122,63 @@ func getOptions() (config configData, returnCode int) {
 
 	// Hybrid config: use flags and INI file
 	// Command line flags take precedence on INI values
-	if err := cfgFlags.Parse(); err != nil {
+	flag.Parse()
+	configFile, err := readConfigFile(*configPath)
+	if err == nil {
+		err = setFlags(flag.CommandLine, configFile)
+	}
+	if err != nil {
 		flag.Usage()
 		log.Fatal(err)
 	}
 
-	config.modules = strings.Split(*modules, ",")
+	// Network used when no network is declared in the configuration file, also used for the default values
+	defaultNetwork := networkConfig{
+		Network: core.Network{
+			Name:              *network,
+			Server:            *server,
+			UseTLS:            *useTLS,
+			Nick:              *nick,
+			Channels:          parseChannels(*channels, *channelKeys, ""),
+			Prefix:            *prefix,
+			QuitMessage:       *quitMessage,
+			PlainText:         *plainText,
+			FloodBurst:        *floodBurst,
+			FloodRate:         *floodRate,
+			PageSize:          *pageSize,
+			Owners:            parseList(*owners),
+			ReconnectMinDelay: *reconnectDelay,
+			ReconnectMaxDelay: *reconnectMaxDelay,
+			Workers:           *workers,
+			WorkerQueue:       *workerQueue,
+			HandlerTimeout:    *handlerTimeout,
+			RateLimit:         *rateLimit,
+			RateWindow:        *rateWindow,
+			IgnoreDuration:    *ignoreDuration,
+			Auth: core.Authentication{
+				Method:   *auth,
+				Account:  *account,
+				Password: *password,
+				CertFile: *tlsCert,
+				KeyFile:  *tlsKey}},
+		modules: strings.Split(*modules, ",")}
+
+	networks, err := readNetworks(configFile, defaultNetwork)
+	if err != nil {
+		flag.Usage()
+		log.Fatal(err)
+	}
+	if len(networks) != 0 {
+		config.networks = networks
+	} else if len(defaultNetwork.Channels) != 0 {
+		config.networks = []networkConfig{defaultNetwork}
+	}
+	for _, network := range config.networks {
+		if err := network.Auth.Check(); err != nil {
+			flag.Usage()
+			log.Fatalf("Network %q: %s", network.Name, err)
+		}
+	}
 
 	if *version {
 		fmt.Printf("\nGoxxx version: %s\n\n", GlobalVersion)
@@ -112,7 +195,7 @@ func getOptions() (config configData, returnCode int) {
 			return
 		}
 		returnCode = flagsAddUser
-	} else if config.channel == "" {
+	} else if len(config.networks) == 0 {
 		flag.Usage()
 		returnCode = flagsFailure
 	} else {
@@ -121,6 +204,229 @@ func getOptions() (config configData, returnCode int) {
 	return
 }
 
+// parseChannels builds the channel list from the comma separated lists of channel names, keys and command prefixes.
+// Keys and prefixes are matched to the channels by their position, an empty key means that the channel has no key
+// and an empty prefix that the network's prefix is used.
+func parseChannels(names, keys, prefixes string) (channels []core.Channel) {
+	keyList := strings.Split(keys, ",")
+	prefixList := strings.Split(prefixes, ",")
+	for i, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		channel := core.Channel{Name: name}
+		if i < len(keyList) {
+			channel.Key = strings.TrimSpace(keyList[i])
+		}
+		if i < len(prefixList) {
+			channel.Prefix = strings.TrimSpace(prefixList[i])
+		}
+		channels = append(channels, channel)
+	}
+	return
+}
+
+// parseList splits a comma separated list, empty elements are removed
+func parseList(list string) (elements []string) {
+	for _, element := range strings.Split(list, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return
+}
+
+// configValue is a "key = value" line of the configuration file
+type configValue struct {
+	key, value string
+	line       int
+}
+
+// configSection is a "[network.<name>]" section of the configuration file
+type configSection struct {
+	name   string
+	values []configValue
+}
+
+// configFile holds the content of the INI configuration file
+type configFile struct {
+	path     string
+	globals  []configValue // Keys outside of a section, they set the command line flags
+	networks []configSection
+}
+
+// readConfigFile reads the INI configuration file, a missing file is considered empty.
+// Lines starting with ";" or "#" are comments, the values can be surrounded by double quotes.
+func readConfigFile(path string) (config configFile, err error) {
+	config.path = path
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+	defer file.Close()
+
+	var (
+		section    *configSection
+		lineNumber int
+		scanner    = bufio.NewScanner(file)
+	)
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if !strings.HasPrefix(name, "network.") || name == "network." {
+				return config, fmt.Errorf("%s:%d: unknown section %q", path, lineNumber, name)
+			}
+			config.networks = append(config.networks, configSection{name: strings.TrimPrefix(name, "network.")})
+			section = &config.networks[len(config.networks)-1]
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return config, fmt.Errorf("%s:%d: invalid line %q", path, lineNumber, line)
+		}
+		value := configValue{
+			key:   strings.TrimSpace(parts[0]),
+			value: strings.Trim(strings.TrimSpace(parts[1]), `"`),
+			line:  lineNumber}
+		if section != nil {
+			section.values = append(section.values, value)
+		} else {
+			config.globals = append(config.globals, value)
+		}
+	}
+	return config, scanner.Err()
+}
+
+// setFlags sets the flags with the keys outside of the sections of the configuration file.
+// The flags given on the command line are kept.
+func setFlags(flags *flag.FlagSet, config configFile) error {
+	fromCommandLine := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { fromCommandLine[f.Name] = true })
+	for _, value := range config.globals {
+		if flags.Lookup(value.key) == nil || value.key == "config" {
+			return fmt.Errorf("%s:%d: unknown key %q", config.path, value.line, value.key)
+		}
+		if fromCommandLine[value.key] {
+			continue
+		}
+		if err := flags.Set(value.key, value.value); err != nil {
+			return fmt.Errorf("%s:%d: invalid %s %q", config.path, value.line, value.key, value.value)
+		}
+	}
+	return nil
+}
+
+// readNetworks builds the networks declared in the configuration file.
+// A network section is named "[network.<name>]" and can contain the keys "server", "tls", "nick",
+// "channels", "keys", "prefix", "prefixes", "quit_message", "plain_text", "modules", "flood_burst", "flood_rate", "page_size", "owners",
+// "reconnect_delay", "reconnect_max_delay", "workers", "worker_queue", "handler_timeout", "rate_limit", "rate_window", "ignore_duration", "auth", "account", "password", "tls_cert" and "tls_key" (same formats as the corresponding command line flags).
+// Missing keys take their value from defaultNetwork.
+func readNetworks(config configFile, defaultNetwork networkConfig) (networks []networkConfig, err error) {
+	path := config.path
+	for _, section := range config.networks {
+		var channels, keys, prefixes string
+		current := networkConfig{Network: defaultNetwork.Network, modules: defaultNetwork.modules}
+		current.Name = section.name
+		for _, entry := range section.values {
+			key, value, lineNumber := entry.key, entry.value, entry.line
+			switch key {
+			case "server":
+				current.Server = value
+			case "tls":
+				current.UseTLS = value == "true" || value == "1"
+			case "nick":
+				current.Nick = value
+			case "channels":
+				channels = value
+			case "keys":
+				keys = value
+			case "prefix":
+				current.Prefix = value
+			case "prefixes":
+				prefixes = value
+			case "quit_message":
+				current.QuitMessage = value
+			case "plain_text":
+				current.PlainText = value == "true" || value == "1"
+			case "modules":
+				current.modules = strings.Split(value, ",")
+			case "flood_burst":
+				if current.FloodBurst, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid flood_burst %q", path, lineNumber, value)
+				}
+			case "flood_rate":
+				if current.FloodRate, err = time.ParseDuration(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid flood_rate %q", path, lineNumber, value)
+				}
+			case "reconnect_delay":
+				if current.ReconnectMinDelay, err = time.ParseDuration(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid reconnect_delay %q", path, lineNumber, value)
+				}
+			case "reconnect_max_delay":
+				if current.ReconnectMaxDelay, err = time.ParseDuration(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid reconnect_max_delay %q", path, lineNumber, value)
+				}
+			case "workers":
+				if current.Workers, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid workers %q", path, lineNumber, value)
+				}
+			case "worker_queue":
+				if current.WorkerQueue, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid worker_queue %q", path, lineNumber, value)
+				}
+			case "handler_timeout":
+				if current.HandlerTimeout, err = time.ParseDuration(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid handler_timeout %q", path, lineNumber, value)
+				}
+			case "rate_limit":
+				if current.RateLimit, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid rate_limit %q", path, lineNumber, value)
+				}
+			case "rate_window":
+				if current.RateWindow, err = time.ParseDuration(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid rate_window %q", path, lineNumber, value)
+				}
+			case "ignore_duration":
+				if current.IgnoreDuration, err = time.ParseDuration(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid ignore_duration %q", path, lineNumber, value)
+				}
+			case "auth":
+				current.Auth.Method = value
+			case "account":
+				current.Auth.Account = value
+			case "password":
+				current.Auth.Password = value
+			case "tls_cert":
+				current.Auth.CertFile = value
+			case "tls_key":
+				current.Auth.KeyFile = value
+			case "owners":
+				current.Owners = parseList(value)
+			case "page_size":
+				if current.PageSize, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid page_size %q", path, lineNumber, value)
+				}
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown key %q for network %q", path, lineNumber, key, current.Name)
+			}
+		}
+		current.Channels = parseChannels(channels, keys, prefixes)
+		if len(current.Channels) == 0 {
+			return nil, fmt.Errorf("%s: no channel for network %q", path, current.Name)
+		}
+		networks = append(networks, current)
+	}
+	return networks, nil
+}
+
 func main() {
 	config, returnCode := getOptions()
 	if returnCode == flagsExit {
@@ -152,7 +458,8 @@ func main() {
 
 	// Process commands if necessary
 	if returnCode == flagsAddUser {
-		if err := database.AddUser(flag.Args()[1], flag.Args()[2]); err == nil {
+		// The nick is stored normalized, with the case mapping of most networks
+		if err := database.AddUser(core.CaseMappingRFC1459.Fold(flag.Args()[1]), flag.Args()[2]); err == nil {
 			fmt.Println("User added to the database")
 		} else {
 			fmt.Printf("\nadd_user error: %s\n", err)
@@ -160,126 +467,24 @@ func main() {
 		return
 	}
 
-	// Create the bot
-	bot := core.NewBot(config.nick, config.server, config.channel, config.channelKey)
-
-	// Initialise packages
-	for _, module := range config.modules {
-		switch strings.TrimSpace(module) {
-		// case "invoke":
-		// 	if !invoke.Init(db,
-		// 		config.emailSender,
-		// 		config.emailAccount,
-		// 		config.emailPassword,
-		// 		config.emailServer,
-		// 		config.channel,
-		// 		config.emailPort) {
-		// 		log.Println("Error while initialising invoke package")
-		// 		continue
-		// 	}
-		// 	cmd := invoke.GetCommand()
-		// 	bot.AddCmdHandler(cmd, bot.Reply)
-		// 	help.AddMessages(cmd)
-		// 	log.Println("Invoke module loaded")
-
-		case "memo":
-			memo.Init(db)
-			bot.AddMsgHandler(memo.SendMemo, bot.Reply)
-
-			cmd := memo.GetMemoCommand()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-
-			cmd = memo.GetMemoStatCommand()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-			log.Println("Memo module loaded")
-
-		case "search":
-			cmd := search.GetDuckduckGoCmd()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-
-			cmd = search.GetWikipediaCmd()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-
-			cmd = search.GetWikipediaFRCmd()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-
-			cmd = search.GetUrbanDictionnaryCmd()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-			log.Println("Search module loaded")
-
-		case "webinfo":
-			webinfo.Init(db)
-			bot.AddMsgHandler(webinfo.HandleURLs, bot.ReplyToAll)
-
-			cmd := webinfo.GetTitleCommand()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-
-			cmd = webinfo.GetURLCommand()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-
-			log.Println("Webinfo module loaded")
-
-		case "xkcd":
-			cmd := xkcd.GetCommand()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-			log.Println("XKCD module loaded")
-
-		case "pictures":
-			pictures.Init(db, bot.Admins)
-
-			cmd := pictures.GetPicCommand()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-
-			cmd = pictures.GetAddPicCommand()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-
-			cmd = pictures.GetRmPicCommand()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-			log.Println("Pictures module loaded")
-
-		case "quote":
-			quote.Init(db, bot.Admins)
-			bot.AddMsgHandler(quote.HandleMessages, nil)
-
-			cmd := quote.GetQuoteCommand()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-
-			cmd = quote.GetQuoteFromAllCommand()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-
-			cmd = quote.GetAddQuoteCommand()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-
-			cmd = quote.GetRmQuoteCommand()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-
-			cmd = quote.GetDailyQuoteCommand()
-			bot.AddCmdHandler(cmd, bot.Reply)
-			help.AddMessages(cmd)
-			log.Println("Quote module loaded")
-
-		default:
-
-		}
+	// Create one bot per network, modules are initialised once and shared by all the bots
+	core.SetVersion(GlobalVersion, BuildTime)
+	core.SetDependencies(&core.Dependencies{
+		DB: db,
+		Email: core.EmailSettings{
+			Server:   config.emailServer,
+			Port:     config.emailPort,
+			Sender:   config.emailSender,
+			Account:  config.emailAccount,
+			Password: config.emailPassword}})
+	var bots []*core.Bot
+	for _, network := range config.networks {
+		bot := core.NewBot(network.Network)
+		bot.StartModules(network.modules)
+		bot.AddCmdHandler(help.GetCommand(), bot.Reply)
+		log.Printf("Help module loaded for network %q\n", network.Name)
+		bots = append(bots, bot)
 	}
-	bot.AddCmdHandler(help.GetCommand(), bot.Reply)
-	log.Println("Help module loaded")
 
 	log.Println("Goxxx started")
 
@@ -300,14 +505,26 @@ func main() {
 		done <- true
 	}()
 
-	// Start the bot
-	go bot.Run()
+	// Start the bots
+	for _, bot := range bots {
+		go bot.Run()
+	}
 
 	// The current routine will be blocked here until done is true
 	<-done
 
-	// Close the bot connection and the database
-	bot.Stop()
+	// Stop the bots, letting them finish the running commands and send the queued messages,
+	// then shut the modules down and close the database once nothing uses them anymore
+	var stopped sync.WaitGroup
+	for _, bot := range bots {
+		stopped.Add(1)
+		go func(bot *core.Bot) {
+			defer stopped.Done()
+			bot.Shutdown(config.shutdownTimeout)
+		}(bot)
+	}
+	stopped.Wait()
+	core.ShutdownModules()
 	db.Close()
 
 	log.Println("Goxxx exiting")
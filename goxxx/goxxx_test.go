@@ -0,0 +1,147 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Arnaud Vazard
+//
+// See LICENSE file.
+package main
+
+import (
+	"flag"
+	"github.com/vaz-ar/goxxx/core"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+; Global keys, used for the flags
+nick = goxxx_ini
+flood_burst = 6
+tls = false
+
+[network.first]
+server = irc.first.org:6697
+tls = true
+channels = #first_channel,#second_channel
+keys = ,second_key
+prefixes = ,?
+modules = memo,webinfo
+
+# Comment
+[network.second]
+server = "irc.second.org:6667"
+nick = other_nick
+channels = #other_channel
+flood_rate = 5s
+`
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "goxxx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "goxxx.ini")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_readConfigFile(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags: the command line takes precedence on the configuration file
+	flags := flag.NewFlagSet("goxxx", flag.ContinueOnError)
+	nick := flags.String("nick", "goxxx", "")
+	floodBurst := flags.Int("flood_burst", 4, "")
+	useTLS := flags.Bool("tls", true, "")
+	flags.String("config", "goxxx.ini", "")
+	if err := flags.Parse([]string{"-config", path, "-flood_burst", "8"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setFlags(flags, config); err != nil {
+		t.Fatal(err)
+	}
+	if *nick != "goxxx_ini" || *floodBurst != 8 || *useTLS {
+		t.Errorf("setFlags: nick = %q, flood_burst = %d, tls = %t", *nick, *floodBurst, *useTLS)
+	}
+
+	// Networks
+	defaultNetwork := networkConfig{
+		Network: core.Network{Name: "default", Server: "chat.freenode.net:6697", UseTLS: *useTLS, Nick: *nick, FloodBurst: *floodBurst, FloodRate: 2 * time.Second},
+		modules: []string{"memo", "quote"}}
+	networks, err := readNetworks(config, defaultNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []networkConfig{
+		{
+			Network: core.Network{
+				Name:   "first",
+				Server: "irc.first.org:6697",
+				UseTLS: true,
+				Nick:   "goxxx_ini",
+				Channels: []core.Channel{
+					{Name: "#first_channel"},
+					{Name: "#second_channel", Key: "second_key", Prefix: "?"}},
+				FloodBurst: 8,
+				FloodRate:  2 * time.Second},
+			modules: []string{"memo", "webinfo"}},
+		{
+			Network: core.Network{
+				Name:       "second",
+				Server:     "irc.second.org:6667",
+				Nick:       "other_nick",
+				Channels:   []core.Channel{{Name: "#other_channel"}},
+				FloodBurst: 8,
+				FloodRate:  5 * time.Second},
+			modules: []string{"memo", "quote"}}}
+	if !reflect.DeepEqual(networks, expected) {
+		t.Errorf("readNetworks:\n got %+v\nwant %+v", networks, expected)
+	}
+}
+
+func Test_readConfigFileErrors(t *testing.T) {
+	if config, err := readConfigFile(filepath.Join(os.TempDir(), "goxxx_missing.ini")); err != nil || len(config.globals) != 0 || len(config.networks) != 0 {
+		t.Errorf("missing file: %+v, %v", config, err)
+	}
+
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"[other]\nnick = goxxx", `unknown section "other"`},
+		{"nick", `invalid line "nick"`},
+		{"unknown = 1", `unknown key "unknown"`},
+		{"flood_burst = many", `invalid flood_burst "many"`},
+		{"[network.first]\nserver = irc.first.org", `no channel for network "first"`},
+		{"[network.first]\nchannels = #channel\nunknown = 1", `unknown key "unknown" for network "first"`},
+		{"[network.first]\nchannels = #channel\nflood_rate = 5", `invalid flood_rate "5"`},
+	}
+	for _, test := range tests {
+		path := writeConfig(t, test.content)
+		config, err := readConfigFile(path)
+		if err == nil {
+			flags := flag.NewFlagSet("goxxx", flag.ContinueOnError)
+			flags.String("nick", "goxxx", "")
+			flags.Int("flood_burst", 4, "")
+			if err = setFlags(flags, config); err == nil {
+				_, err = readNetworks(config, networkConfig{})
+			}
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: expected the error %q, got %v", test.content, test.err, err)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
@@ -4,13 +4,12 @@
 //
 // See LICENSE file.
 
-// Package help manages the help messages
+// Package help manages the help messages, built from the commands of the enabled modules
 package help
 
 import (
 	"fmt"
 	"github.com/emirozer/go-helpers"
-	"github.com/thoj/go-ircevent"
 	"github.com/vaz-ar/goxxx/core"
 	"log"
 	"strings"
@@ -20,50 +19,43 @@ const (
 	defaultMessage = "You need to specify a module for which you want help. Currently loaded modules are \"%s\"."
 )
 
-var (
-	helpMessages = map[string][]string{}
-	modules      []string
-)
-
-// AddMessages stores messages to display them later via the help command
-func AddMessages(cmd *core.Command) {
-	if cmd.Module == "" || cmd.HelpMessage == "" {
-		return
-	}
-	helpMessages[cmd.Module] = append(helpMessages[cmd.Module], cmd.HelpMessage)
-	if !helpers.StringInSlice(cmd.Module, modules) {
-		modules = append(modules, cmd.Module)
+// getMessages returns the help messages of a module, with the triggers preceded by prefix
+func getMessages(module core.Module, prefix string) (messages []string) {
+	for _, cmd := range module.Commands() {
+		if cmd.HelpMessage != "" {
+			messages = append(messages, cmd.Help(prefix))
+		}
 	}
-	log.Printf("Help: added message \"%s\" for module \"%s\"\n", cmd.HelpMessage, cmd.Module)
+	return messages
 }
 
 // GetCommand returns a Command structure for the help command
 func GetCommand() *core.Command {
 	return &core.Command{
-		Triggers: []string{"!h", "!help"},
+		Triggers: []string{"h", "help"},
+		Args:     []core.Arg{{Name: "module", Optional: true}},
 		Handler:  handleHelpCmd}
 }
 
-// handleHelpCmd handles the !help command
-func handleHelpCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1] => module
-	if len(fields) < 2 {
+// handleHelpCmd handles the !help command, only the modules enabled for the event's network are listed
+func handleHelpCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+	modules := core.GetModules(event)
+	name := event.Args.String("module")
+	if name == "" {
 		log.Println("Help command received: not enough arguments")
 		callback(&core.ReplyCallbackData{Message: fmt.Sprintf(defaultMessage, strings.Join(modules, ", ")), Target: event.Nick})
-		return true
+		return nil
 	}
-	list, ok := helpMessages[fields[1]]
-	if !ok {
+	module := core.GetModule(name)
+	if module == nil || !helpers.StringInSlice(name, modules) {
 		log.Println("Help command received: module not in the help list")
 		callback(&core.ReplyCallbackData{Message: fmt.Sprintf(defaultMessage, strings.Join(modules, ", ")), Target: event.Nick})
-		return true
+		return nil
 	}
 
-	log.Printf("Help command received for module %s\n", fields[1])
-	for _, message := range list {
+	log.Printf("Help command received for module %s\n", name)
+	for _, message := range getMessages(module, core.GetPrefix(event)) {
 		callback(&core.ReplyCallbackData{Message: message, Target: event.Nick})
 	}
-	return true
+	return nil
 }
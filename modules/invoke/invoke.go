@@ -9,12 +9,11 @@ package invoke
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
-	"github.com/thoj/go-ircevent"
 	"github.com/vaz-ar/goxxx/core"
 	"log"
 	"net/smtp"
-	"strings"
 )
 
 const (
@@ -29,14 +28,13 @@ var (
 		sender  string
 		server  string
 	}
-	dbPtr          *sql.DB // Database pointer
-	initialised    bool
-	currentChannel string
+	dbPtr       *sql.DB // Database pointer
+	initialised bool
 )
 
 // Init initialises the connection for the SMTP server, the database table and stores the database pointer for later use.
-func Init(db *sql.DB, sender, account, password, server, channel string, port int) bool {
-	if account == "" || password == "" || server == "" || port == 0 || channel == "" {
+func Init(db *sql.DB, sender, account, password, server string, port int) bool {
+	if account == "" || password == "" || server == "" || port == 0 {
 		return false
 	}
 	if sender == "" {
@@ -47,17 +45,50 @@ func Init(db *sql.DB, sender, account, password, server, channel string, port in
 	connection.sender = sender
 	connection.server = fmt.Sprint(server, ":", port)
 	connection.auth = smtp.PlainAuth("", account, password, server)
-	currentChannel = channel
 	initialised = true
 	return true
 }
 
+func init() {
+	core.RegisterModule(module{})
+}
+
+// module implements core.Module for the invoke package
+type module struct{}
+
+func (module) Name() string {
+	return "invoke"
+}
+
+func (module) Init(dependencies *core.Dependencies) error {
+	email := dependencies.Email
+	if !Init(dependencies.DB, email.Sender, email.Account, email.Password, email.Server, email.Port) {
+		return errors.New("the email settings are incomplete")
+	}
+	return nil
+}
+
+func (module) Commands() []*core.Command {
+	return []*core.Command{GetCommand()}
+}
+
+func (module) MsgHandlers() []core.MsgHandler {
+	return nil
+}
+
+func (module) Subscriptions() []core.Subscription {
+	return nil
+}
+
+func (module) Shutdown() {}
+
 // GetCommand returns a Command structure for the invoke command
 func GetCommand() *core.Command {
 	return &core.Command{
 		Module:      "invoke",
-		HelpMessage: "!invoke <nick> [<message>] => Send an email to an user, with an optionnal message",
-		Triggers:    []string{"!invoke"},
+		HelpMessage: "Send an email to an user, with an optionnal message",
+		Triggers:    []string{"invoke"},
+		Args:        []core.Arg{{Name: "nick"}, {Name: "message", Optional: true, Rest: true}},
 		Handler:     handleInvokeCmd}
 }
 
@@ -84,64 +115,65 @@ func generateMessage(headers map[string]string, body string) string {
 }
 
 // handleInvokeCmd handles the invoke command
-func handleInvokeCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1]  => User
-	// fields[2:]  => Optionnal message
-	if len(fields) < 2 {
-		return false
-	}
+func handleInvokeCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
 	log.Println("Invoke command detected")
-	recipient := fields[1]
+	recipient := event.Args.String("nick")
+	// The nicks are stored normalized in the Invoke and User tables
+	key := core.NormalizeNick(event, recipient)
 
 	sqlQuery := "SELECT ((strftime('%s', datetime('now', 'localtime')) - strftime('%s', date))/60) as delta FROM Invoke WHERE nick = $1"
 	var delta int
-	err := dbPtr.QueryRow(sqlQuery, recipient).Scan(&delta)
+	err := dbPtr.QueryRow(sqlQuery, key).Scan(&delta)
 	switch {
 	case err == sql.ErrNoRows:
 		log.Printf("No line for \"%s\" in the Invoke table", recipient)
 	case err != nil:
-		log.Fatalf("%q: %s\n", err, sqlQuery)
+		return fmt.Errorf("%q: %s", err, sqlQuery)
 	default:
 		if delta < minDelta {
 			message := fmt.Sprintf("The user \"%s\" was already invoked less than %d minutes ago", recipient, minDelta)
 			log.Println(message)
 			callback(&core.ReplyCallbackData{Message: message, Target: event.Nick})
-			return true
+			return nil
 		}
 	}
 
 	sqlQuery = "SELECT email FROM User WHERE nick = $1"
 	var email string
-	err = dbPtr.QueryRow(sqlQuery, recipient).Scan(&email)
+	err = dbPtr.QueryRow(sqlQuery, key).Scan(&email)
 	switch {
 	case err == sql.ErrNoRows:
 		message := fmt.Sprintf("No user in the datbase with \"%s\" for nick, call the cops! (or maybe just the bot admin)", recipient)
 		log.Println(message)
 		callback(&core.ReplyCallbackData{Message: message, Target: event.Nick})
-		return true
+		return nil
 
 	case err != nil:
-		log.Fatalf("%q: %s\n", err, sqlQuery)
+		return fmt.Errorf("%q: %s", err, sqlQuery)
 
 	default:
 	}
 
+	// The email names the first channel of the network when the command is sent in a private message
+	currentChannel := core.GetChannelFromEvent(event)
+	if currentChannel == "" {
+		currentChannel = core.GetDefaultChannel(event)
+	}
+
 	headers := map[string]string{
 		"From":    connection.sender,
 		"To":      email,
 		"Subject": "Goxxx: Your presence is requested on " + currentChannel}
 
 	var message string
-	if len(fields) < 3 {
+	if !event.Args.Has("message") {
 		message = fmt.Sprintf("Your presence has been requested by %s on the %s channel.\n Hurry up!\n", event.Nick, currentChannel)
 	} else {
 		message = fmt.Sprintf(
 			"Your presence has been requested by %s on the %s channel.\n Here is a message from him/her:\n\n\"%s\"\n",
 			event.Nick,
 			currentChannel,
-			strings.Join(fields[2:], " "))
+			event.Args.String("message"))
 	}
 
 	if !sendMail(generateMessage(headers, message), &email) {
@@ -149,19 +181,19 @@ func handleInvokeCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) b
 		callback(&core.ReplyCallbackData{
 			Message: "The invoke command failed, the email was not sent",
 			Target:  event.Nick})
-		return true
+		return nil
 	}
 	log.Println("Invoke command: email sent")
 
 	sqlQuery = "INSERT OR REPLACE INTO Invoke (nick) VALUES ($1)"
-	_, err = dbPtr.Exec(sqlQuery, recipient)
+	_, err = dbPtr.Exec(sqlQuery, key)
 	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlQuery)
+		return fmt.Errorf("%q: %s", err, sqlQuery)
 	}
 
 	callback(&core.ReplyCallbackData{
 		Message: fmt.Sprintf("Email sent to %s", recipient),
 		Target:  event.Nick})
 
-	return true
+	return nil
 }
@@ -10,16 +10,14 @@ package memo
 import (
 	"database/sql"
 	"fmt"
-	"github.com/thoj/go-ircevent"
 	"github.com/vaz-ar/goxxx/core"
 	"log"
-	"strings"
 )
 
 var (
-	memoCmd     = []string{"!memo", "!m"}      // Slice containing the possible memo commands
-	memostatCmd = []string{"!memostat", "!ms"} // Slice containing the possible memo status commands
-	dbPtr       *sql.DB                        // Database pointer
+	memoCmd     = []string{"memo", "m"}      // Slice containing the possible memo commands
+	memostatCmd = []string{"memostat", "ms"} // Slice containing the possible memo status commands
+	dbPtr       *sql.DB                      // Database pointer
 )
 
 // data stores memo informations, based on the database table "Memo".
@@ -31,12 +29,44 @@ type data struct {
 	userTo   string
 }
 
+func init() {
+	core.RegisterModule(module{})
+}
+
+// module implements core.Module for the memo package
+type module struct{}
+
+func (module) Name() string {
+	return "memo"
+}
+
+func (module) Init(dependencies *core.Dependencies) error {
+	Init(dependencies.DB)
+	return nil
+}
+
+func (module) Commands() []*core.Command {
+	return []*core.Command{GetMemoCommand(), GetMemoStatCommand()}
+}
+
+func (module) MsgHandlers() []core.MsgHandler {
+	return []core.MsgHandler{{Handler: SendMemo}}
+}
+
+func (module) Subscriptions() []core.Subscription {
+	// Memos are also delivered when their recipient joins a channel
+	return []core.Subscription{{Kind: core.KindJoin, Handler: SendMemo}}
+}
+
+func (module) Shutdown() {}
+
 // GetMemoCommand returns a Command structure for the memo command
 func GetMemoCommand() *core.Command {
 	return &core.Command{
 		Module:      "memo",
-		HelpMessage: "!memo/!m <nick> <message> => Leave a memo for another user",
-		Triggers:    []string{"!memo", "!m"},
+		HelpMessage: "Leave a memo for another user",
+		Triggers:    memoCmd,
+		Args:        []core.Arg{{Name: "nick"}, {Name: "message", Rest: true}},
 		Handler:     handleMemoCmd}
 }
 
@@ -44,9 +74,9 @@ func GetMemoCommand() *core.Command {
 func GetMemoStatCommand() *core.Command {
 	return &core.Command{
 		Module:      "memo",
-		HelpMessage: "!memostat/!ms => Get the list of the unread memos (List only the memos you left)",
-		Triggers:    []string{"!memostat", "!ms"},
-		Handler:     handleMemoCmd}
+		HelpMessage: "Get the list of the unread memos (List only the memos you left)",
+		Triggers:    memostatCmd,
+		Handler:     handleMemoStatusCmd}
 }
 
 // Init stores the database pointer.
@@ -55,24 +85,17 @@ func Init(db *sql.DB) {
 }
 
 // handleMemoCmd handles memo commands.
-func handleMemoCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1]  => recipient's nick
-	// fields[2:] => message
-	if len(fields) < 3 {
-		log.Println("Memo command received: not enough arguments")
-		return false
-	}
+func handleMemoCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
 	memo := data{
-		userTo:   fields[1],
+		userTo:   event.Args.String("nick"),
 		userFrom: event.Nick,
-		message:  strings.Join(fields[2:], " ")}
+		message:  event.Args.String("message")}
 
-	sqlStmt := "INSERT INTO Memo (user_to, user_from, message) VALUES ($1, $2, $3)"
-	_, err := dbPtr.Exec(sqlStmt, memo.userTo, memo.userFrom, memo.message)
+	// The normalized nicks are used to find the memos, the nicks as typed are displayed
+	sqlStmt := "INSERT INTO Memo (user_to, user_from, user_to_display, user_from_display, message, network, date) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	_, err := dbPtr.Exec(sqlStmt, core.NormalizeNick(event, memo.userTo), core.NormalizeNick(event, memo.userFrom), memo.userTo, memo.userFrom, memo.message, event.Network, core.DBTime(event.Time))
 	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlStmt)
+		return fmt.Errorf("%q: %s", err, sqlStmt)
 	}
 
 	if callback != nil {
@@ -81,46 +104,76 @@ func handleMemoCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) boo
 			Target:  memo.userFrom})
 		log.Printf("Memo command received: \"%s\" for %s from %s\n", memo.message, memo.userTo, memo.userFrom)
 	}
-	return true
+	return nil
 }
 
 // SendMemo is a message handler that will send memo(s) to an user when he post a message for the first time after a memo for him was created.
-func SendMemo(event *irc.Event, callback func(*core.ReplyCallbackData)) {
-	user := event.Nick
-	sqlQuery := "SELECT id, user_from, message, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')) FROM Memo WHERE user_to = $1;"
-	rows, err := dbPtr.Query(sqlQuery, user)
+// It also runs when the user joins a channel: the memos are claimed in a transaction, and only the memos deleted by this call are sent,
+// so that a memo is never sent twice.
+func SendMemo(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+	memoList, err := claimMemos(core.NormalizeNick(event, event.Nick), event.Network)
 	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlQuery)
+		return err
 	}
-	defer rows.Close()
-
 	userTo := event.Nick
-	var memoList []data
-	for rows.Next() {
-		var memo data
-		rows.Scan(&memo.id, &memo.userFrom, &memo.message, &memo.date)
-		memoList = append(memoList, memo)
+	for _, memo := range memoList {
 		callback(&core.ReplyCallbackData{
 			Message: fmt.Sprintf("%s: memo from %s => \"%s\" (%s)", userTo, memo.userFrom, memo.message, memo.date),
 			Target:  userTo})
 	}
+	return nil
+}
+
+// claimMemos deletes the memos for user and returns them, the memos deleted meanwhile by another call are left out
+func claimMemos(user, network string) (memoList []data, err error) {
+	tx, err := dbPtr.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	sqlQuery := "SELECT id, user_from_display, message, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')) FROM Memo WHERE user_to = $1 AND network IN ($2, '');"
+	rows, err := tx.Query(sqlQuery, user, network)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %s", err, sqlQuery)
+	}
+	var selected []data
+	for rows.Next() {
+		var memo data
+		if err = rows.Scan(&memo.id, &memo.userFrom, &memo.message, &memo.date); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		selected = append(selected, memo)
+	}
 	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 
-	for _, memo := range memoList {
-		sqlQuery = "DELETE FROM Memo WHERE id = $1"
-		_, err = dbPtr.Exec(sqlQuery, memo.id)
+	sqlQuery = "DELETE FROM Memo WHERE id = $1"
+	for _, memo := range selected {
+		result, err := tx.Exec(sqlQuery, memo.id)
 		if err != nil {
-			log.Fatalf("%q: %s\n", err, sqlQuery)
+			return nil, fmt.Errorf("%q: %s", err, sqlQuery)
+		}
+		if deleted, _ := result.RowsAffected(); deleted > 0 {
+			memoList = append(memoList, memo)
 		}
 	}
+	return memoList, tx.Commit()
 }
 
 // handleMemoStatusCmd handles memo status commands.
-func handleMemoStatusCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	sqlQuery := "SELECT id, user_to, message, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')) FROM Memo WHERE user_from = $1 ORDER BY id"
-	rows, err := dbPtr.Query(sqlQuery, event.Nick)
+func handleMemoStatusCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+	sqlQuery := "SELECT id, user_to_display, message, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')) FROM Memo WHERE user_from = $1 AND network IN ($2, '') ORDER BY id"
+	rows, err := dbPtr.Query(sqlQuery, core.NormalizeNick(event, event.Nick), event.Network)
 	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlQuery)
+		return fmt.Errorf("%q: %s", err, sqlQuery)
 	}
 	defer rows.Close()
 
@@ -135,5 +188,5 @@ func handleMemoStatusCmd(event *irc.Event, callback func(*core.ReplyCallbackData
 	if memo.id == 0 {
 		callback(&core.ReplyCallbackData{Message: "No memo saved", Target: event.Nick})
 	}
-	return true
+	return nil
 }
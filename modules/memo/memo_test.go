@@ -7,26 +7,30 @@ package memo
 
 import (
 	"fmt"
-	"github.com/thoj/go-ircevent"
 	"github.com/vaz-ar/goxxx/core"
 	"github.com/vaz-ar/goxxx/database"
 	"regexp"
+	"strings"
 	"testing"
 )
 
 var (
-	validMessage   = "  \t  !memo   Receiver this is a memo      "
+	validMessage   = "  \t  !memo   receiver this is a memo      "
 	invalidMessage = "this is not a memo command"
 	expectedNick   = "Receiver"
 
 	// For the Arguments field I checked how it worked from a real function call (Not documented)
-	validEvent = irc.Event{
+	validEvent = core.Event{
 		Nick:      "Sender",
 		Arguments: []string{"#test_channel", validMessage}}
 
-	replyCallbackDataReference = core.ReplyCallbackData{Target: "Sender", Message: "Sender: memo for Receiver saved"}
+	replyCallbackDataReference = core.ReplyCallbackData{Target: "Sender", Message: "Sender: memo for receiver saved"}
 )
 
+func init() {
+	validEvent.Args, _ = GetMemoCommand().Parse(validEvent.Message())
+}
+
 func Test_handleMemoCmd(t *testing.T) {
 
 	db := database.NewDatabase("./tests.sqlite", "../../database/migrations", true)
@@ -53,8 +57,18 @@ func Test_SendMemo(t *testing.T) {
 	// Create Memo
 	handleMemoCmd(&validEvent, nil)
 
+	// The recipients are displayed as typed
+	var status core.ReplyCallbackData
+	handleMemoStatusCmd(&core.Event{Nick: "SENDER", Arguments: []string{"#test_channel", "memostat"}}, func(data *core.ReplyCallbackData) {
+		status = *data
+	})
+	if !strings.HasPrefix(status.Message, `Memo for receiver: "this is a memo"`) {
+		t.Errorf("Unexpected memo status: %q", status.Message)
+	}
+
 	message := " this is a message to trigger the memo "
-	event := irc.Event{Nick: expectedNick, Arguments: []string{"#test_channel", message}}
+	event := core.Event{Nick: expectedNick, Arguments: []string{"#test_channel", message}}
+	// The nicks are compared without case, and stored normalized
 	re := regexp.MustCompile(fmt.Sprintf(`^%s: memo from Sender => "this is a memo" \(\d{2}/\d{2}/\d{4} @ \d{2}:\d{2}\)$`, expectedNick))
 
 	var testReply core.ReplyCallbackData
@@ -68,4 +82,9 @@ func Test_SendMemo(t *testing.T) {
 	if testReply.Target != expectedNick {
 		t.Errorf("Incorrect Nick: should be %q, is %q", expectedNick, testReply.Target)
 	}
+
+	// The memo is deleted once sent, it is not sent again when the user joins a channel
+	SendMemo(&event, func(data *core.ReplyCallbackData) {
+		t.Errorf("Memo sent twice: %q", data.Message)
+	})
 }
@@ -13,9 +13,7 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/emirozer/go-helpers"
-	"github.com/thoj/go-ircevent"
 	"github.com/vaz-ar/goxxx/core"
-	"log"
 	"path"
 	"regexp"
 	"strings"
@@ -32,20 +30,53 @@ const (
 )
 
 var (
-	dbPtr          *sql.DB // Database pointer
-	extList        = []string{".png", ".jpg", ".jpeg"}
-	administrators *[]string
+	dbPtr   *sql.DB // Database pointer
+	extList = []string{".png", ".jpg", ".jpeg"}
 	// Source of the regular expression: http://daringfireball.net/2010/07/improved_regex_for_matching_urls
 	reURL      = regexp.MustCompile("(?:https?://|www\\d{0,3}[.]|[a-z0-9.\\-]+[.][a-z]{2,4}/)(?:[^\\s()<>]+|\\(([^\\s()<>]+|(\\([^\\s()<>]+\\)))*\\))+(?:\\(([^\\s()<>]+|(\\([^\\s()<>]+\\)))*\\)|[^\\s`!()\\[\\]{};:'\".,<>?«»“”‘’])")
 	reSanitize = regexp.MustCompile(`[%?_$:@]`)
 )
 
+func init() {
+	core.RegisterModule(module{})
+}
+
+// module implements core.Module for the pictures package
+type module struct{}
+
+func (module) Name() string {
+	return "pictures"
+}
+
+func (module) Init(dependencies *core.Dependencies) error {
+	Init(dependencies.DB)
+	return nil
+}
+
+func (module) Commands() []*core.Command {
+	return []*core.Command{
+		GetPicCommand(),
+		GetAddPicCommand(),
+		GetRmPicCommand()}
+}
+
+func (module) MsgHandlers() []core.MsgHandler {
+	return nil
+}
+
+func (module) Subscriptions() []core.Subscription {
+	return nil
+}
+
+func (module) Shutdown() {}
+
 // GetPicCommand returns a Command structure for the picture command
 func GetPicCommand() *core.Command {
 	return &core.Command{
 		Module:      "pictures",
-		HelpMessage: "!p/!pic <search terms> => Search in the database for pictures matching <search terms>",
-		Triggers:    []string{"!p", "!pic"},
+		HelpMessage: "Search in the database for pictures matching <search terms>",
+		Triggers:    []string{"p", "pic"},
+		Args:        []core.Arg{{Name: "search terms", Rest: true}},
 		Handler:     handlePictureCmd}
 }
 
@@ -53,8 +84,10 @@ func GetPicCommand() *core.Command {
 func GetAddPicCommand() *core.Command {
 	return &core.Command{
 		Module:      "pictures",
-		HelpMessage: "!ap/!addpic <url> <tag> [#NSFW] => Add a picture in the database for <tag> (<url> must have an image extension)",
-		Triggers:    []string{"!ap", "!addpic"},
+		HelpMessage: "Add a picture in the database for <tag> (<url> must have an image extension)",
+		Triggers:    []string{"ap", "addpic"},
+		Args:        []core.Arg{{Name: "url"}, {Name: "tag", Rest: true}},
+		Flags:       []core.Flag{{Name: "nsfw"}},
 		Handler:     handleAddPictureCmd}
 }
 
@@ -62,28 +95,22 @@ func GetAddPicCommand() *core.Command {
 func GetRmPicCommand() *core.Command {
 	return &core.Command{
 		Module:      "pictures",
-		HelpMessage: "!rmpic <url> <tag> => Remove a picture in the database for <tag> (Admin only command)",
-		Triggers:    []string{"!rmpic"},
+		HelpMessage: "Remove a picture in the database for <tag> (Admin only command)",
+		Triggers:    []string{"rmpic"},
+		Args:        []core.Arg{{Name: "url"}, {Name: "tag", Rest: true}},
+		Role:        core.RoleAdmin,
 		Handler:     handleRmPictureCmd}
 }
 
-// Init stores the database pointer and the administrators list.
-func Init(db *sql.DB, admins *[]string) {
+// Init stores the database pointer.
+func Init(db *sql.DB) {
 	dbPtr = db
-	administrators = admins
 }
 
 // handlePictureCmd returns the pictures associated with a tag
-func handlePictureCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1:] => Tag to search for
-	if len(fields) < 2 {
-		return false
-	}
-
+func handlePictureCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
 	var (
-		requestedTag = prepareTagString(strings.Join(fields[1:], " "))
+		requestedTag = prepareTagString(event.Args.String("search terms"))
 		rows         *sql.Rows
 		err          error
 	)
@@ -91,81 +118,76 @@ func handlePictureCmd(event *irc.Event, callback func(*core.ReplyCallbackData))
 		callback(&core.ReplyCallbackData{
 			Message: "Picture command: No data remaining for the tag value after sanitization.",
 			Target:  core.GetTargetFromEvent(event)})
-		return true
+		return nil
 	}
 
 	rows, err = dbPtr.Query(sqlSelectWhereTagLike, "%"+requestedTag+"%")
 	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlSelectWhereTagLike)
+		return fmt.Errorf("%q: %s", err, sqlSelectWhereTagLike)
 	}
 
 	defer rows.Close()
 
 	var (
 		message, tag, url string
-		resultCount, nsfw int
+		nsfw              int
+		results           core.ResultSet
 	)
 	for rows.Next() {
-		resultCount++
 		rows.Scan(&tag, &url, &nsfw)
 		if nsfw == 0 {
 			message = "Picture for \"%s\" : %s"
 		} else {
 			message = "Picture for \"%s\" (#NSFW) : %s"
 		}
+		results.Lines = append(results.Lines, fmt.Sprintf(message, tag, url))
+	}
+	if len(results.Lines) != 0 {
 		callback(&core.ReplyCallbackData{
-			Message: fmt.Sprintf(message, tag, url),
+			Results: &results,
 			Target:  core.GetTargetFromEvent(event)})
-	}
-	if resultCount == 0 {
+	} else {
 		callback(&core.ReplyCallbackData{
 			Message: fmt.Sprintf("No picture found for tag \"%s\"", requestedTag),
 			Target:  core.GetTargetFromEvent(event)})
 	}
 
-	return true
+	return nil
 }
 
 // handleAddPictureCmd add a picture for a given tag to the database
-func handleAddPictureCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1] => url for the picture
-	// fields[2:] => Tag for the picture
-	if len(fields) < 3 {
-		return false
-	}
-	url := fields[1]
+func handleAddPictureCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+	url := event.Args.String("url")
 	if !reURL.MatchString(url) || !helpers.StringInSlice(strings.ToLower(path.Ext(url)), extList) {
 		callback(&core.ReplyCallbackData{
 			Message: "Incorrect format for the \"Add Picture\" command (see !help)",
 			Target:  core.GetTargetFromEvent(event)})
-		return true
+		return nil
 	}
 
 	var (
-		tag   = prepareTagString(strings.Join(fields[2:], " "))
-		nsfw  = prepareTagString(fields[len(fields)-1]) == "#nsfw"
+		tag   = prepareTagString(event.Args.String("tag"))
+		nsfw  = event.Args.Flag("nsfw")
 		count int
 	)
-	// Check if last element from fields is NSFW tag
-	if nsfw {
-		tag = strings.TrimSpace(strings.TrimSuffix(tag, "#nsfw"))
+	// The former syntax, a "#NSFW" tag at the end of the line, is still accepted
+	if strings.HasSuffix(tag, "#nsfw") {
+		tag, nsfw = strings.TrimSpace(strings.TrimSuffix(tag, "#nsfw")), true
 	}
 	err := dbPtr.QueryRow(sqlCount, tag).Scan(&count)
 	if err != sql.ErrNoRows && err != nil {
-		log.Fatalf("%q: %s\n", err, sqlCount)
+		return fmt.Errorf("%q: %s", err, sqlCount)
 	}
 	if count >= maxPictures {
 		callback(&core.ReplyCallbackData{
 			Message: fmt.Sprintf("There is already too much pictures for the tag \"%s\"", tag),
 			Target:  core.GetTargetFromEvent(event)})
-		return true
+		return nil
 	}
 
 	rows, err := dbPtr.Query(sqlSelectTagWhereURL, url, tag)
 	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlSelectTagWhereURL)
+		return fmt.Errorf("%q: %s", err, sqlSelectTagWhereURL)
 	}
 	defer rows.Close()
 
@@ -173,67 +195,39 @@ func handleAddPictureCmd(event *irc.Event, callback func(*core.ReplyCallbackData
 		callback(&core.ReplyCallbackData{
 			Message: fmt.Sprintf("This picture is already present for the tag \"%s\"", tag),
 			Target:  core.GetTargetFromEvent(event)})
-		return true
+		return nil
 	}
 
 	_, err = dbPtr.Exec(sqlInsert, tag, url, event.Nick, nsfw)
 	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlInsert)
+		return fmt.Errorf("%q: %s", err, sqlInsert)
 	}
 	callback(&core.ReplyCallbackData{
 		Message: fmt.Sprintf("Picture \"%s\" added for tag \"%s\"", url, tag),
 		Target:  core.GetTargetFromEvent(event)})
 
-	return true
+	return nil
 }
 
 // handleRmPictureCmd remove a picture for a given tag to the database
-func handleRmPictureCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1] => url for the picture
-	// fields[2:] => Tag for the picture
-	if len(fields) < 3 {
-		return false
-	}
-
-	// update the administrators list
-	core.UpdateUserList(event)
-
-	if !helpers.StringInSlice(event.Nick, *administrators) {
-		if len(*administrators) > 1 {
-			callback(&core.ReplyCallbackData{
-				Message: fmt.Sprintf("You need to be an administrator to run this command (Admins: \"%s\")", strings.Join(*administrators, ", ")),
-				Target:  core.GetTargetFromEvent(event)})
-		} else if len(*administrators) == 1 {
-			callback(&core.ReplyCallbackData{
-				Message: fmt.Sprintf("You need to be an administrator to run this command (Admin: \"%s\")", (*administrators)[0]),
-				Target:  core.GetTargetFromEvent(event)})
-		} else {
-			callback(&core.ReplyCallbackData{
-				Message: fmt.Sprintln("You need to be an administrator to run this command (No admin set!)"),
-				Target:  core.GetTargetFromEvent(event)})
-		}
-		return true
-	}
-
-	url := fields[1]
-	tag := strings.ToLower(strings.Join(fields[2:], " "))
+func handleRmPictureCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+	url := event.Args.String("url")
+	tag := strings.ToLower(event.Args.String("tag"))
 
 	result, err := dbPtr.Exec(sqlDelete, tag, url)
 	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlDelete)
+		return fmt.Errorf("%q: %s", err, sqlDelete)
 	}
 	rowCount, err := result.RowsAffected()
 	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlDelete)
+		return fmt.Errorf("%q: %s", err, sqlDelete)
 	}
 	if rowCount != 0 {
 		callback(&core.ReplyCallbackData{
 			Message: fmt.Sprintf("Picture \"%s\" removed for tag \"%s\"", url, tag),
 			Target:  core.GetTargetFromEvent(event)})
 	}
-	return true
+	return nil
 }
 
 func prepareTagString(str string) string {
@@ -12,38 +12,85 @@ package quote
 import (
 	"database/sql"
 	"fmt"
-	"github.com/emirozer/go-helpers"
-	"github.com/thoj/go-ircevent"
 	"github.com/vaz-ar/goxxx/core"
-	"log"
+	"github.com/vaz-ar/goxxx/core/format"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	maxMessages           = 20
-	sqlInsert             = "INSERT INTO Quote (user, content, sender) VALUES ($1, $2, $3)"
-	sqlSelect             = "SELECT content, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')), sender FROM Quote WHERE user = $1 AND content LIKE $2"
-	sqlSelectFromAll      = "SELECT content, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')), sender, user FROM Quote WHERE content LIKE $1"
-	sqlSelectExactContent = "SELECT sender FROM Quote WHERE user = $1 AND content = $2"
-	sqlSelectAll          = "SELECT content, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')), sender FROM Quote WHERE user = $1"
-	sqlSelectFromDay      = "SELECT content, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')), sender, user FROM Quote WHERE date(date, 'localtime') = date('now', '-1 year', 'localtime') ORDER BY RANDOM() LIMIT 1"
-	sqlDelete             = "DELETE FROM Quote where user = $1 AND content LIKE $2"
+	maxMessages = 20
+	// In the queries below an empty channel (private message) matches quotes from every channel of the network,
+	// and quotes saved before the multi-channel/multi-network support (empty columns) are shared by all channels.
+	sqlInsert             = "INSERT INTO Quote (user, user_display, content, sender, channel, network, date) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	sqlSelect             = "SELECT content, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')), sender, user_display FROM Quote WHERE user = $1 AND content LIKE $2 AND ($3 = '' OR channel IN ($3, '')) AND network IN ($4, '')"
+	sqlSelectFromAll      = "SELECT content, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')), sender, user_display FROM Quote WHERE content LIKE $1 AND ($2 = '' OR channel IN ($2, '')) AND network IN ($3, '')"
+	sqlSelectExactContent = "SELECT sender FROM Quote WHERE user = $1 AND content = $2 AND ($3 = '' OR channel IN ($3, '')) AND network IN ($4, '')"
+	sqlSelectAll          = "SELECT content, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')), sender, user_display FROM Quote WHERE user = $1 AND ($2 = '' OR channel IN ($2, '')) AND network IN ($3, '')"
+	sqlSelectFromDay      = "SELECT content, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')), sender, user_display FROM Quote WHERE date(date, 'localtime') = date('now', '-1 year', 'localtime') AND ($1 = '' OR channel IN ($1, '')) AND network IN ($2, '') ORDER BY RANDOM() LIMIT 1"
+	sqlDelete             = "DELETE FROM Quote where user = $1 AND content LIKE $2 AND ($3 = '' OR channel IN ($3, '')) AND network IN ($4, '')"
 )
 
 var (
-	dbPtr          *sql.DB // Database pointer
-	lastMessages   map[string][]string
-	reMsg          = `.*%s.*`
-	administrators *[]string
+	dbPtr             *sql.DB                         // Database pointer
+	lastMessages      map[string]map[string][]message // Last messages by channel (prefixed by the network) and by nick
+	lastMessagesMutex sync.Mutex
+	reMsg             = `.*%s.*`
 )
 
+// message is one of the last messages posted by a user
+type message struct {
+	nick string // Nick of the user as it was displayed, stored with the quote
+	text string
+	sent time.Time // Time the message was sent, stored as the date of the quote
+}
+
+func init() {
+	core.RegisterModule(module{})
+}
+
+// module implements core.Module for the quote package
+type module struct{}
+
+func (module) Name() string {
+	return "quote"
+}
+
+func (module) Init(dependencies *core.Dependencies) error {
+	Init(dependencies.DB)
+	return nil
+}
+
+func (module) Commands() []*core.Command {
+	return []*core.Command{
+		GetQuoteCommand(),
+		GetQuoteFromAllCommand(),
+		GetAddQuoteCommand(),
+		GetRmQuoteCommand(),
+		GetDailyQuoteCommand()}
+}
+
+func (module) MsgHandlers() []core.MsgHandler {
+	return nil
+}
+
+func (module) Subscriptions() []core.Subscription {
+	return []core.Subscription{
+		{Kind: core.KindMessage, Handler: HandleMessages},
+		{Kind: core.KindAction, Handler: HandleActions}}
+}
+
+func (module) Shutdown() {}
+
 // GetQuoteCommand returns a Command structure for the quote command
 func GetQuoteCommand() *core.Command {
 	return &core.Command{
 		Module:      "quote",
-		HelpMessage: "!q/!quote <nick> [<part of message>]",
-		Triggers:    []string{"!q", "!quote"},
+		HelpMessage: "Return the quotes of <nick>, optionally only the ones containing <part of message>",
+		Triggers:    []string{"q", "quote"},
+		Args:        []core.Arg{{Name: "nick"}, {Name: "part of message", Optional: true, Rest: true}},
 		Handler:     handleQuoteCmd}
 }
 
@@ -51,8 +98,9 @@ func GetQuoteCommand() *core.Command {
 func GetQuoteFromAllCommand() *core.Command {
 	return &core.Command{
 		Module:      "quote",
-		HelpMessage: "!qa/!quoteall [<part of message>]",
-		Triggers:    []string{"!qa", "!quoteall"},
+		HelpMessage: "Return the quotes of every user containing <part of message>",
+		Triggers:    []string{"qa", "quoteall"},
+		Args:        []core.Arg{{Name: "part of message", Rest: true}},
 		Handler:     handleQuoteAllCmd}
 }
 
@@ -60,8 +108,9 @@ func GetQuoteFromAllCommand() *core.Command {
 func GetAddQuoteCommand() *core.Command {
 	return &core.Command{
 		Module:      "quote",
-		HelpMessage: "!aq/!addquote <nick> <part of message>",
-		Triggers:    []string{"!aq", "!addquote"},
+		HelpMessage: "Save as a quote the last message of <nick> containing <part of message>",
+		Triggers:    []string{"aq", "addquote"},
+		Args:        []core.Arg{{Name: "nick"}, {Name: "part of message", Rest: true}},
 		Handler:     handleAddQuoteCmd}
 }
 
@@ -69,8 +118,10 @@ func GetAddQuoteCommand() *core.Command {
 func GetRmQuoteCommand() *core.Command {
 	return &core.Command{
 		Module:      "quote",
-		HelpMessage: "!rmq/!rmquote <nick> <part of the quote> (Admins only)",
-		Triggers:    []string{"!rmq", "!rmquote"},
+		HelpMessage: "Remove the quotes of <nick> containing <part of the quote> (Admins only)",
+		Triggers:    []string{"rmq", "rmquote"},
+		Args:        []core.Arg{{Name: "nick"}, {Name: "part of the quote", Rest: true}},
+		Role:        core.RoleAdmin,
 		Handler:     handleRmQuoteCmd}
 }
 
@@ -78,98 +129,94 @@ func GetRmQuoteCommand() *core.Command {
 func GetDailyQuoteCommand() *core.Command {
 	return &core.Command{
 		Module:      "quote",
-		HelpMessage: "!dq (No parameter needed)",
-		Triggers:    []string{"!dq"},
+		HelpMessage: "Return the quote of the day",
+		Triggers:    []string{"dq"},
 		Handler:     handleDailyQuoteCmd}
 }
 
-// Init stores the database pointer and the administrators list.
-func Init(db *sql.DB, admins *[]string) {
-	lastMessages = make(map[string][]string)
+// Init stores the database pointer.
+// The last messages already received are kept, so that reloading the module does not lose them.
+func Init(db *sql.DB) {
+	lastMessagesMutex.Lock()
+	if lastMessages == nil {
+		lastMessages = make(map[string]map[string][]message)
+	}
+	lastMessagesMutex.Unlock()
 	dbPtr = db
-	administrators = admins
 }
 
 // handleQuoteCmd
-func handleQuoteCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1] => Nick
-	// fields[2:] => part of the message to search for
-	if len(fields) == 1 {
-		return true
-	}
-
+func handleQuoteCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
 	var (
+		nick = core.NormalizeNick(event, event.Args.String("nick"))
 		rows *sql.Rows
 		err  error
 	)
-	if len(fields) >= 3 {
+	if event.Args.Has("part of message") {
 		// Search with part of the message
-		messagePart := prepareForSearch(strings.Join(fields[2:], " "))
-		rows, err = dbPtr.Query(sqlSelect, fields[1], "%"+messagePart+"%")
+		messagePart := prepareForSearch(event.Args.String("part of message"))
+		rows, err = dbPtr.Query(sqlSelect, nick, "%"+messagePart+"%", core.GetChannelFromEvent(event), event.Network)
 	} else {
 		// Search without part of the message
-		rows, err = dbPtr.Query(sqlSelectAll, fields[1])
+		rows, err = dbPtr.Query(sqlSelectAll, nick, core.GetChannelFromEvent(event), event.Network)
 	}
 	if err != nil {
-		log.Fatalf("\"%s\": %s\n", err, sqlSelect)
+		return fmt.Errorf("\"%s\": %s", err, sqlSelect)
 	}
 	defer rows.Close()
 
-	var content, date, sender string
+	var (
+		content, date, sender, user string
+		results                     core.ResultSet
+	)
 	for rows.Next() {
-		rows.Scan(&content, &date, &sender)
-		callback(&core.ReplyCallbackData{
-			Message: fmt.Sprintf("%s [%s, %s, quoted by %s]", content, fields[1], date, sender),
-			Target:  core.GetTargetFromEvent(event)})
+		rows.Scan(&content, &date, &sender, &user)
+		results.Lines = append(results.Lines, fmt.Sprintf("%s [%s, %s, quoted by %s]", content, user, date, sender))
 	}
+	callback(&core.ReplyCallbackData{
+		Results: &results,
+		Target:  core.GetTargetFromEvent(event)})
 
-	return true
+	return nil
 }
 
 // handleQuoteAllCmd
-func handleQuoteAllCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1:] => part of the message to search for
-	if len(fields) == 1 {
-		return true
-	}
-
+func handleQuoteAllCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
 	// Search with part of the message
-	messagePart := prepareForSearch(strings.Join(fields[1:], " "))
-	rows, err := dbPtr.Query(sqlSelectFromAll, "%"+messagePart+"%")
+	messagePart := prepareForSearch(event.Args.String("part of message"))
+	rows, err := dbPtr.Query(sqlSelectFromAll, "%"+messagePart+"%", core.GetChannelFromEvent(event), event.Network)
 
 	if err != nil {
-		log.Fatalf("\"%s\": %s\n", err, sqlSelectFromAll)
+		return fmt.Errorf("\"%s\": %s", err, sqlSelectFromAll)
 	}
 	defer rows.Close()
 
-	var content, date, sender, user string
+	var (
+		content, date, sender, user string
+		results                     core.ResultSet
+	)
 	for rows.Next() {
 		rows.Scan(&content, &date, &sender, &user)
-		callback(&core.ReplyCallbackData{
-			Message: fmt.Sprintf("%s [%s, %s, quoted by %s]", content, user, date, sender),
-			Target:  core.GetTargetFromEvent(event)})
+		results.Lines = append(results.Lines, fmt.Sprintf("%s [%s, %s, quoted by %s]", content, user, date, sender))
 	}
+	callback(&core.ReplyCallbackData{
+		Results: &results,
+		Target:  core.GetTargetFromEvent(event)})
 
-	return true
+	return nil
 }
 
-func handleAddQuoteCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-
-	if len(fields) < 3 {
-		return false
-	}
-
-	nick := fields[1]
-	size := len(lastMessages[nick])
+func handleAddQuoteCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+	nick := event.Args.String("nick")
+	user := core.NormalizeNick(event, nick)
+	channel := core.GetChannelFromEvent(event)
+	network := event.Network
+	messages := getLastMessages(network, channel, user)
+	size := len(messages)
 	max := maxMessages
 
 	if size == 0 {
-		return true
+		return nil
 	} else if size < max {
 		max = size
 	}
@@ -177,98 +224,70 @@ func handleAddQuoteCmd(event *irc.Event, callback func(*core.ReplyCallbackData))
 	var (
 		rawMsg   string
 		cleanMsg string
-		pattern  = prepareForSearch(strings.Join(fields[2:], " "))
+		pattern  = prepareForSearch(event.Args.String("part of message"))
 	)
 	// Look for the search pattern in one of the last messages from "nick"
 	for i := max; i >= 1; {
 		i--
-		rawMsg = lastMessages[nick][i]
+		rawMsg = messages[i].text
 		cleanMsg = prepareForSearch(rawMsg)
 		if !strings.Contains(cleanMsg, pattern) {
 			continue
 		}
 
 		// Check if quote already exists in the database
-		rows, err := dbPtr.Query(sqlSelectExactContent, nick, rawMsg)
+		rows, err := dbPtr.Query(sqlSelectExactContent, user, rawMsg, channel, network)
 		if err != nil {
-			log.Fatalf("%q: %s\n", err, sqlSelectExactContent)
+			return fmt.Errorf("%q: %s", err, sqlSelectExactContent)
 		}
 		defer rows.Close()
 		if rows.Next() {
 			callback(&core.ReplyCallbackData{
 				Message: fmt.Sprintf("This quote is already present for the user \"%s\"", nick),
 				Target:  core.GetTargetFromEvent(event)})
-			return true
+			return nil
 		}
 
 		// Insert quote in the database
-		_, err = dbPtr.Exec(sqlInsert, nick, rawMsg, event.Nick)
+		_, err = dbPtr.Exec(sqlInsert, user, messages[i].nick, rawMsg, event.Nick, channel, network, core.DBTime(messages[i].sent))
 		if err != nil {
-			log.Fatalf("%q: %s\n", err, sqlInsert)
+			return fmt.Errorf("%q: %s", err, sqlInsert)
 		}
 		callback(&core.ReplyCallbackData{
 			Message: fmt.Sprintf("Quote \"%s\" added for nick \"%s\"", rawMsg, nick),
 			Target:  core.GetTargetFromEvent(event)})
 		break
 	}
-	return true
+	return nil
 }
 
 // handleRmQuoteCmd
-func handleRmQuoteCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1] => Nick
-	// fields[2:] => part of the quote to search for
-	if len(fields) < 3 {
-		return false
-	}
-
-	// update the administrators list
-	core.UpdateUserList(event)
-
-	if !helpers.StringInSlice(event.Nick, *administrators) {
-		if len(*administrators) > 1 {
-			callback(&core.ReplyCallbackData{
-				Message: fmt.Sprintf("You need to be an administrator to run this command (Admins: \"%s\")", strings.Join(*administrators, ", ")),
-				Target:  core.GetTargetFromEvent(event)})
-		} else if len(*administrators) == 1 {
-			callback(&core.ReplyCallbackData{
-				Message: fmt.Sprintf("You need to be an administrator to run this command (Admin: \"%s\")", (*administrators)[0]),
-				Target:  core.GetTargetFromEvent(event)})
-		} else {
-			callback(&core.ReplyCallbackData{
-				Message: fmt.Sprintln("You need to be an administrator to run this command (No admin set!)"),
-				Target:  core.GetTargetFromEvent(event)})
-		}
-		return true
-	}
-
-	quote := strings.Join(fields[2:], " ")
-	user := fields[1]
-	result, err := dbPtr.Exec(sqlDelete, user, "%"+quote+"%")
+func handleRmQuoteCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+	quote := event.Args.String("part of the quote")
+	user := event.Args.String("nick")
+	result, err := dbPtr.Exec(sqlDelete, core.NormalizeNick(event, user), "%"+quote+"%", core.GetChannelFromEvent(event), event.Network)
 	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlDelete)
+		return fmt.Errorf("%q: %s", err, sqlDelete)
 	}
 	rows, err := result.RowsAffected()
 	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlDelete)
+		return fmt.Errorf("%q: %s", err, sqlDelete)
 	}
 	if rows != 0 {
 		callback(&core.ReplyCallbackData{
 			Message: fmt.Sprintf("Quote(s) matching \"%%%s%%\" removed for user \"%s\"", quote, user),
 			Target:  core.GetTargetFromEvent(event)})
 	}
-	return true
+	return nil
 }
 
 // handleDailyQuoteCmd
-func handleDailyQuoteCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
+func handleDailyQuoteCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
 
-	rows, err := dbPtr.Query(sqlSelectFromDay)
+	rows, err := dbPtr.Query(sqlSelectFromDay, core.GetChannelFromEvent(event), event.Network)
 
 	if err != nil {
-		log.Fatalf("\"%s\": %s\n", err, sqlSelectFromDay)
+		return fmt.Errorf("\"%s\": %s", err, sqlSelectFromDay)
 	}
 	defer rows.Close()
 
@@ -278,17 +297,20 @@ func handleDailyQuoteCmd(event *irc.Event, callback func(*core.ReplyCallbackData
 		callback(&core.ReplyCallbackData{
 			Message: fmt.Sprintf("%s [%s, %s, quoted by %s]", content, user, date, sender),
 			Target:  core.GetTargetFromEvent(event)})
-		return true
+		return nil
 	}
 
 	callback(&core.ReplyCallbackData{
 		Message: "There was no quote 1 year ago, losers!",
 		Target:  core.GetTargetFromEvent(event)})
 
-	return true
+	return nil
 }
 
 func prepareForSearch(message string) string {
+	// Remove the formatting, the quotes saved before it was stripped by the core can contain control codes
+	message = format.Strip(message)
+
 	// Replace basic punctuation with a single space
 	re := regexp.MustCompile(`[.,;:!'"-]`)
 	message = re.ReplaceAllString(message, " ")
@@ -301,12 +323,41 @@ func prepareForSearch(message string) string {
 	return strings.TrimSpace(strings.ToLower(message))
 }
 
-// HandleMessages is a message handler that stores the last messages by users
-func HandleMessages(event *irc.Event, callback func(*core.ReplyCallbackData)) {
-	if len(lastMessages[event.Nick]) < maxMessages {
-		lastMessages[event.Nick] = append(lastMessages[event.Nick], event.Message())
+// getLastMessages returns a copy of the last messages posted by nick on channel, nick being normalized (see core.NormalizeNick)
+func getLastMessages(network, channel, nick string) []message {
+	lastMessagesMutex.Lock()
+	defer lastMessagesMutex.Unlock()
+	return append([]message(nil), lastMessages[network+" "+channel][nick]...)
+}
+
+// HandleMessages is a message handler that stores the last messages by channel and by users
+func HandleMessages(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+	addLastMessage(event, event.Message())
+	return nil
+}
+
+// HandleActions stores the actions (/me) with the last messages, as "* nick action"
+func HandleActions(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+	addLastMessage(event, fmt.Sprintf("* %s %s", event.Nick, event.Message()))
+	return nil
+}
+
+// addLastMessage stores a message as one of the last messages posted by the sender of the event, with the time the event was sent
+func addLastMessage(event *core.Event, text string) {
+	lastMessagesMutex.Lock()
+	defer lastMessagesMutex.Unlock()
+
+	channel := event.Network + " " + core.GetChannelFromEvent(event)
+	if lastMessages[channel] == nil {
+		lastMessages[channel] = make(map[string][]message)
+	}
+	messages := lastMessages[channel]
+	nick := core.NormalizeNick(event, event.Nick)
+	last := message{nick: event.Nick, text: text, sent: event.Time}
+	if len(messages[nick]) < maxMessages {
+		messages[nick] = append(messages[nick], last)
 	} else {
-		lastMessages[event.Nick] = append(lastMessages[event.Nick][:0], lastMessages[event.Nick][1:]...)
-		lastMessages[event.Nick] = append(lastMessages[event.Nick], event.Message())
+		messages[nick] = append(messages[nick][:0], messages[nick][1:]...)
+		messages[nick] = append(messages[nick], last)
 	}
 }
@@ -6,7 +6,11 @@
 package quote
 
 import (
+	"github.com/vaz-ar/goxxx/core"
+	"github.com/vaz-ar/goxxx/database"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_prepareForSearch(t *testing.T) {
@@ -16,4 +20,69 @@ func Test_prepareForSearch(t *testing.T) {
 	if result != expectedResult {
 		t.Errorf("Test result differ from expected result: \n Test result:\t%#v\nExpected result: %#v\n\n", result, expectedResult)
 	}
+
+	// Formatting
+	str = "\x02Bold\x02 and \x0304,12colored\x03 text"
+	expectedResult = "bold and colored text"
+	if result = prepareForSearch(str); result != expectedResult {
+		t.Errorf("Test result differ from expected result: \n Test result:\t%#v\nExpected result: %#v\n\n", result, expectedResult)
+	}
+}
+
+func Test_HandleMessages(t *testing.T) {
+	Init(nil)
+
+	HandleMessages(&core.Event{Nick: "Sender", Arguments: []string{"#first_channel", "first message"}}, nil)
+	HandleMessages(&core.Event{Nick: "Sender", Arguments: []string{"#second_channel", "second message"}}, nil)
+
+	if messages := getLastMessages("", "#first_channel", "sender"); len(messages) != 1 || messages[0].text != "first message" {
+		t.Errorf("Unexpected messages for the first channel: %#v", messages)
+	}
+	if messages := getLastMessages("", "#second_channel", "sender"); len(messages) != 1 || messages[0].text != "second message" {
+		t.Errorf("Unexpected messages for the second channel: %#v", messages)
+	}
+}
+
+func Test_HandleActions(t *testing.T) {
+	Init(nil)
+
+	HandleActions(&core.Event{Nick: "Actor", Arguments: []string{"#action_channel", "waves"}}, nil)
+
+	if messages := getLastMessages("", "#action_channel", "actor"); len(messages) != 1 || messages[0].text != "* Actor waves" {
+		t.Errorf("Unexpected messages: %#v", messages)
+	}
+}
+
+func Test_handleAddQuoteCmd(t *testing.T) {
+	db := database.NewDatabase("./tests.sqlite", "../../database/migrations", true)
+	defer db.Close()
+	Init(db)
+
+	// The quote is stored with the time the message was sent
+	sent := time.Date(2016, time.May, 1, 12, 30, 0, 0, time.UTC)
+	HandleMessages(&core.Event{Nick: "Quoted", Time: sent, Arguments: []string{"#test_channel", "something worth quoting"}}, nil)
+	event := &core.Event{Nick: "Sender", Arguments: []string{"#test_channel", "aq Quoted worth"}}
+	event.Args, _ = GetAddQuoteCommand().Parse(event.Message())
+	if err := handleAddQuoteCmd(event, func(*core.ReplyCallbackData) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	var content, date string
+	if err := db.QueryRow("SELECT content, strftime('%Y-%m-%d %H:%M', date) FROM Quote WHERE user = 'quoted'").Scan(&content, &date); err != nil {
+		t.Fatal(err)
+	}
+	if content != "something worth quoting" || date != "2016-05-01 12:30" {
+		t.Errorf("Unexpected quote: %q (%s)", content, date)
+	}
+
+	// The quotes are found with the normalized nick, and displayed with the nick of the quoted user
+	event = &core.Event{Nick: "Sender", Arguments: []string{"#test_channel", "q QUOTED"}}
+	event.Args, _ = GetQuoteCommand().Parse(event.Message())
+	var results *core.ResultSet
+	if err := handleQuoteCmd(event, func(data *core.ReplyCallbackData) { results = data.Results }); err != nil {
+		t.Fatal(err)
+	}
+	if results == nil || len(results.Lines) == 0 || !strings.HasPrefix(results.Lines[0], "something worth quoting [Quoted, ") {
+		t.Errorf("Unexpected results: %#v", results)
+	}
 }
@@ -7,23 +7,24 @@
 /*
 Package search allow to do web searches
 Current sources:
-	- DuckduckGo
-	- Urban Dictionnary
-	- Wikipedia EN
-	- Wikipedia FR
+  - DuckduckGo
+  - Urban Dictionnary
+  - Wikipedia EN
+  - Wikipedia FR
 */
 package search
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/thoj/go-ircevent"
 	"github.com/vaz-ar/goxxx/core"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 )
 
 const (
@@ -33,8 +34,13 @@ const (
 	wikipediaURL = "https://%s.wikipedia.org/w/api.php?format=json&action=query&prop=extracts|info&exintro=&explaintext=&inprop=url&titles=%s"
 	// Urban Dictionnary URL format string
 	urbanDictionnaryURL = "http://api.urbandictionary.com/v0/define?term=%s"
+	// Time a user must wait between two searches on the same site
+	searchCooldown = 5 * time.Second
 )
 
+// HTTP client used for the searches, its timeout applies when the request's context has no deadline
+var client = &http.Client{Timeout: 10 * time.Second}
+
 // Wikipedia JSON struct
 type wikipedia struct {
 	Query struct {
@@ -55,12 +61,47 @@ type urbanDictionnary struct {
 	} `json:"list"`
 }
 
+func init() {
+	core.RegisterModule(module{})
+}
+
+// module implements core.Module for the search package
+type module struct{}
+
+func (module) Name() string {
+	return "search"
+}
+
+func (module) Init(dependencies *core.Dependencies) error {
+	return nil
+}
+
+func (module) Commands() []*core.Command {
+	return []*core.Command{
+		GetDuckduckGoCmd(),
+		GetWikipediaCmd(),
+		GetWikipediaFRCmd(),
+		GetUrbanDictionnaryCmd()}
+}
+
+func (module) MsgHandlers() []core.MsgHandler {
+	return nil
+}
+
+func (module) Subscriptions() []core.Subscription {
+	return nil
+}
+
+func (module) Shutdown() {}
+
 // GetDuckduckGoCmd returns a Command structure for the duckduckGo command
 func GetDuckduckGoCmd() *core.Command {
 	return &core.Command{
 		Module:      "search",
-		HelpMessage: "!d/!dg/!ddg <terms to search> => Search on DuckduckGo",
-		Triggers:    []string{"!d", "!dg", "!ddg"},
+		HelpMessage: "Search on DuckduckGo",
+		Triggers:    []string{"d", "dg", "ddg"},
+		Args:        []core.Arg{{Name: "terms to search", Rest: true}},
+		Cooldown:    searchCooldown,
 		Handler:     handleDuckduckGoCmd}
 }
 
@@ -68,8 +109,10 @@ func GetDuckduckGoCmd() *core.Command {
 func GetWikipediaCmd() *core.Command {
 	return &core.Command{
 		Module:      "search",
-		HelpMessage: "!w/!wiki <terms to search> => Search on Wikipedia EN",
-		Triggers:    []string{"!w", "!wiki"},
+		HelpMessage: "Search on Wikipedia EN",
+		Triggers:    []string{"w", "wiki"},
+		Args:        []core.Arg{{Name: "terms to search", Rest: true}},
+		Cooldown:    searchCooldown,
 		Handler:     handleWikipediaCmd}
 }
 
@@ -77,8 +120,10 @@ func GetWikipediaCmd() *core.Command {
 func GetWikipediaFRCmd() *core.Command {
 	return &core.Command{
 		Module:      "search",
-		HelpMessage: "!wf/!wfr <terms to search> => Search on Wikipedia FR",
-		Triggers:    []string{"!wf", "!wfr"},
+		HelpMessage: "Search on Wikipedia FR",
+		Triggers:    []string{"wf", "wfr"},
+		Args:        []core.Arg{{Name: "terms to search", Rest: true}},
+		Cooldown:    searchCooldown,
 		Handler:     handleWikipediaCmd}
 }
 
@@ -86,29 +131,22 @@ func GetWikipediaFRCmd() *core.Command {
 func GetUrbanDictionnaryCmd() *core.Command {
 	return &core.Command{
 		Module:      "search",
-		HelpMessage: "!u/!ud <terms to search> => Search on Urban Dictionnary",
-		Triggers:    []string{"!u", "!ud"},
+		HelpMessage: "Search on Urban Dictionnary",
+		Triggers:    []string{"u", "ud"},
+		Args:        []core.Arg{{Name: "terms to search", Rest: true}},
+		Cooldown:    searchCooldown,
 		Handler:     handleUrbanDictionnaryCmd}
 }
 
 // handleDuckduckGoCmd handles the duckduckGo search command
-func handleDuckduckGoCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1:] => terms to search for
-	if len(fields) < 2 {
-		callback(&core.ReplyCallbackData{
-			Message: fmt.Sprintf("Search usage: %s \"terms to search for\"", fields[0]),
-			Target:  core.GetTargetFromEvent(event)})
-		return false
-	}
-	message := strings.Join(fields[1:], " ")
-	results := getDuckduckgoSearchResult(message)
+func handleDuckduckGoCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+	message := event.Args.String("terms to search")
+	results := getDuckduckgoSearchResult(event.Context(), message)
 	if results == nil {
 		callback(&core.ReplyCallbackData{
 			Message: fmt.Sprintf("DuckDuckGo: No result for \"%s\"", message),
 			Target:  core.GetTargetFromEvent(event)})
-		return true
+		return nil
 	}
 	for index, item := range results {
 		if index == 0 {
@@ -121,28 +159,19 @@ func handleDuckduckGoCmd(event *irc.Event, callback func(*core.ReplyCallbackData
 			callback(&core.ReplyCallbackData{Target: event.Nick, Message: item})
 		}
 	}
-	return true
+	return nil
 }
 
 // handleUrbanDictionnaryCmd handles the urban dictionnary search command
-func handleUrbanDictionnaryCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1:] => terms to search for
-	if len(fields) < 2 {
-		callback(&core.ReplyCallbackData{
-			Message: fmt.Sprintf("Search usage: %s \"terms to search for\"", fields[0]),
-			Target:  core.GetTargetFromEvent(event)})
-		return false
-	}
-	message := strings.Join(fields[1:], " ")
-	results := getUrbanDictionnarySearchResult(message)
+func handleUrbanDictionnaryCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+	message := event.Args.String("terms to search")
+	results := getUrbanDictionnarySearchResult(event.Context(), message)
 
 	if results == nil {
 		callback(&core.ReplyCallbackData{
 			Message: fmt.Sprintf("Urban Dictionnary: No result for \"%s\"", message),
 			Target:  core.GetTargetFromEvent(event)})
-		return true
+		return nil
 	}
 	for index, item := range results {
 		if index == 0 {
@@ -157,27 +186,18 @@ func handleUrbanDictionnaryCmd(event *irc.Event, callback func(*core.ReplyCallba
 				Message: fmt.Sprintf("Definition: %s", item)})
 		}
 	}
-	return true
+	return nil
 }
 
 // handleWikipediaCmd handles the wikipedia command
-func handleWikipediaCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1:] => terms to search for
-	if len(fields) < 2 {
-		callback(&core.ReplyCallbackData{
-			Message: fmt.Sprintf("Search usage: %s \"terms to search for\"", fields[0]),
-			Target:  core.GetTargetFromEvent(event)})
-		return false
-	}
-	message := strings.Join(fields[1:], " ")
-	results := getWikipediaSearchResult(message, "en")
+func handleWikipediaCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+	message := event.Args.String("terms to search")
+	results := getWikipediaSearchResult(event.Context(), message, "en")
 	if results == nil {
 		callback(&core.ReplyCallbackData{
 			Message: fmt.Sprintf("Wikipedia: No result for \"%s\"", message),
 			Target:  core.GetTargetFromEvent(event)})
-		return true
+		return nil
 	}
 	for index, item := range results {
 		if index == 0 {
@@ -190,27 +210,18 @@ func handleWikipediaCmd(event *irc.Event, callback func(*core.ReplyCallbackData)
 			callback(&core.ReplyCallbackData{Target: event.Nick, Message: item})
 		}
 	}
-	return true
+	return nil
 }
 
 // handleWikipediaFRCmd handles the wikipedia FR command
-func handleWikipediaFRCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1:] => terms to search for
-	if len(fields) < 2 {
-		callback(&core.ReplyCallbackData{
-			Message: fmt.Sprintf("Search usage: %s \"terms to search for\"", fields[0]),
-			Target:  core.GetTargetFromEvent(event)})
-		return false
-	}
-	message := strings.Join(fields[1:], " ")
-	results := getWikipediaSearchResult(message, "fr")
+func handleWikipediaFRCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
+	message := event.Args.String("terms to search")
+	results := getWikipediaSearchResult(event.Context(), message, "fr")
 	if results == nil {
 		callback(&core.ReplyCallbackData{
 			Message: fmt.Sprintf("Wikipedia: No result for \"%s\"", message),
 			Target:  core.GetTargetFromEvent(event)})
-		return true
+		return nil
 	}
 	for index, item := range results {
 		if index == 0 {
@@ -223,14 +234,19 @@ func handleWikipediaFRCmd(event *irc.Event, callback func(*core.ReplyCallbackDat
 			callback(&core.ReplyCallbackData{Target: event.Nick, Message: item})
 		}
 	}
-	return true
+	return nil
 }
 
 // --- --- --- HTTP Functions --- --- ---
 
 // Function to get text content from an url
-func getResponseAsText(url string) []byte {
-	response, err := http.Get(url)
+func getResponseAsText(ctx context.Context, url string) []byte {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	response, err := client.Do(request.WithContext(ctx))
 	if err != nil {
 		log.Println(err)
 		return nil
@@ -258,8 +274,8 @@ func getDuckduckgoResultFromHTML(page []byte) string {
 	return ""
 }
 
-func getDuckduckgoSearchResult(searchTerms string) []string {
-	webPage := getResponseAsText(fmt.Sprintf(duckduckgoURL, searchTerms))
+func getDuckduckgoSearchResult(ctx context.Context, searchTerms string) []string {
+	webPage := getResponseAsText(ctx, fmt.Sprintf(duckduckgoURL, searchTerms))
 	if webPage == nil {
 		return nil
 	}
@@ -289,9 +305,9 @@ func getWikipediaResultFromJSON(jsonDataFromHTTP []byte) []string {
 	return returnValues
 }
 
-func getWikipediaSearchResult(searchTerms string, extraParameter string) []string {
+func getWikipediaSearchResult(ctx context.Context, searchTerms string, extraParameter string) []string {
 	searchTerms = strings.Replace(strings.Title(searchTerms), " ", "%20", -1)
-	jsonDataFromHTTP := getResponseAsText(fmt.Sprintf(wikipediaURL, extraParameter, searchTerms))
+	jsonDataFromHTTP := getResponseAsText(ctx, fmt.Sprintf(wikipediaURL, extraParameter, searchTerms))
 	if jsonDataFromHTTP == nil {
 		return nil
 	}
@@ -319,9 +335,9 @@ func getUrbanDictionnaryResultFromJSON(jsonDataFromHTTP []byte) []string {
 	return returnValues
 }
 
-func getUrbanDictionnarySearchResult(searchTerms string) []string {
+func getUrbanDictionnarySearchResult(ctx context.Context, searchTerms string) []string {
 	searchTerms = strings.Replace(strings.Title(searchTerms), " ", "%20", -1)
-	jsonDataFromHTTP := getResponseAsText(fmt.Sprintf(urbanDictionnaryURL, searchTerms))
+	jsonDataFromHTTP := getResponseAsText(ctx, fmt.Sprintf(urbanDictionnaryURL, searchTerms))
 	if jsonDataFromHTTP == nil {
 		return nil
 	}
@@ -6,8 +6,8 @@
 package search
 
 import (
+	"context"
 	"fmt"
-	"github.com/thoj/go-ircevent"
 	"github.com/vaz-ar/goxxx/core"
 	"io/ioutil"
 	"testing"
@@ -30,39 +30,39 @@ var (
 	urbanDictionnaryExpectedResult = "http://smh.urbanup.com/507685"
 
 	// IRC Events - DuckduckGo
-	ddgValidEvent = irc.Event{
+	ddgValidEvent = core.Event{
 		Nick: "Sender",
 		Arguments: []string{
 			"#test_channel",
 			fmt.Sprintf(" \t  !dg   %s      ", searchTerms)}}
 
-	ddgValidEventNoResults = irc.Event{
+	ddgValidEventNoResults = core.Event{
 		Nick: "Sender",
 		Arguments: []string{
 			"#test_channel",
 			fmt.Sprintf("!dg %s", searchTermsNoResults)}}
 
 	// IRC Events - Wikipedia
-	wikipediaValidEvent = irc.Event{
+	wikipediaValidEvent = core.Event{
 		Nick: "Sender",
 		Arguments: []string{
 			"#test_channel",
 			fmt.Sprintf(" \t  !w   %s      ", searchTerms)}}
 
-	wikipediaValidEventNoResults = irc.Event{
+	wikipediaValidEventNoResults = core.Event{
 		Nick: "Sender",
 		Arguments: []string{
 			"#test_channel",
 			fmt.Sprintf("!w %s", searchTermsNoResults)}}
 
 	// IRC Events - Urban Dictionnary
-	urbanDictionnaryValidEvent = irc.Event{
+	urbanDictionnaryValidEvent = core.Event{
 		Nick: "Sender",
 		Arguments: []string{
 			"#test_channel",
 			fmt.Sprintf(" \t  !u   %s      ", urbanDictionnarySearchTerms)}}
 
-	urbanDictionnaryValidEventNoResults = irc.Event{
+	urbanDictionnaryValidEventNoResults = core.Event{
 		Nick: "Sender",
 		Arguments: []string{
 			"#test_channel",
@@ -96,9 +96,19 @@ var (
 		Message: fmt.Sprintf("Urban Dictionnary: No result for %q", searchTermsNoResults)}
 )
 
+func init() {
+	// The core parses the arguments before calling the handlers
+	for _, event := range []*core.Event{&ddgValidEvent, &ddgValidEventNoResults, &wikipediaValidEvent, &wikipediaValidEventNoResults} {
+		event.Args, _ = GetDuckduckGoCmd().Parse(event.Message())
+	}
+	for _, event := range []*core.Event{&urbanDictionnaryValidEvent, &urbanDictionnaryValidEventNoResults} {
+		event.Args, _ = GetUrbanDictionnaryCmd().Parse(event.Message())
+	}
+}
+
 // --- --- --- General --- --- ---
 func Test_getResponseAsText(t *testing.T) {
-	if getResponseAsText(fmt.Sprintf(duckduckgoURL, searchTerms)) == nil {
+	if getResponseAsText(context.Background(), fmt.Sprintf(duckduckgoURL, searchTerms)) == nil {
 		t.Errorf("getResponseAsText: No data returned for the search terms %q", searchTerms)
 	}
 }
@@ -119,7 +129,7 @@ func Test_getDuckduckgoResultFromHtml(t *testing.T) {
 }
 
 func Test_getDuckduckgoSearchResult(t *testing.T) {
-	if result := getDuckduckgoSearchResult(searchTerms); result == nil {
+	if result := getDuckduckgoSearchResult(context.Background(), searchTerms); result == nil {
 		t.Error("No result returned by getDuckduckgoSearchResult")
 	} else if result[0] != ddgExpectedResult {
 		t.Errorf("Expected result: %q, got %q instead\n", ddgExpectedResult, result[0])
@@ -142,7 +152,7 @@ func Test_getWikipediaResultFromJson(t *testing.T) {
 }
 
 func Test_getWikipediaSearchResult(t *testing.T) {
-	if result := getWikipediaSearchResult(searchTerms, "en"); result == nil {
+	if result := getWikipediaSearchResult(context.Background(), searchTerms, "en"); result == nil {
 		t.Error("No result returned by getWikipediaSearchResult")
 	} else if result[0] != wikipediaExpectedResult {
 		t.Errorf("Expected result: %q, got %q instead\n", wikipediaExpectedResult, result[0])
@@ -187,7 +197,7 @@ func Test_getUrbanDictionnaryResultFromJson(t *testing.T) {
 }
 
 func Test_getUrbanDictionnarySearchResult(t *testing.T) {
-	if result := getUrbanDictionnarySearchResult(urbanDictionnarySearchTerms); result == nil {
+	if result := getUrbanDictionnarySearchResult(context.Background(), urbanDictionnarySearchTerms); result == nil {
 		t.Error("No result returned by getUrbanDictionnarySearchResult")
 	} else if result[0] != urbanDictionnaryExpectedResult {
 		t.Errorf("Expected result: %q, got %q instead\n", urbanDictionnaryExpectedResult, result[0])
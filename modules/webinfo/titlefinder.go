@@ -13,8 +13,8 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/emirozer/go-helpers"
-	"github.com/thoj/go-ircevent"
 	"github.com/vaz-ar/goxxx/core"
+	"github.com/vaz-ar/goxxx/core/format"
 	"golang.org/x/net/html"
 	"golang.org/x/net/idna"
 	"io"
@@ -23,29 +23,66 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+	"time"
 )
 
 const (
 	// maxUrlsCount Maximun number of URLs to search in one message
-	maxUrlsCount        = 10
-	sqlSelectExist      = "SELECT user, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')) FROM Link WHERE url = $1"
-	sqlSelectWhereTitle = "SELECT user, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')), title, url FROM Link WHERE title LIKE $1"
-	sqlSelectWhereURL   = "SELECT user, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')), title, url FROM Link WHERE url LIKE $1"
-	sqlInsert           = "INSERT INTO Link (user, url, title) VALUES ($1, $2, $3)"
+	maxUrlsCount = 10
+	// In the queries below the channel is the scope of the links (see linkScope),
+	// and links saved before the multi-channel/multi-network support (empty columns) are shared by all channels.
+	sqlSelectExist      = "SELECT user, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')) FROM Link WHERE url = $1 AND channel IN ($2, '') AND network IN ($3, '')"
+	sqlSelectWhereTitle = "SELECT user, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')), title, url FROM Link WHERE title LIKE $1 AND channel IN ($2, '') AND network IN ($3, '')"
+	sqlSelectWhereURL   = "SELECT user, strftime('%d/%m/%Y @ %H:%M', datetime(date, 'localtime')), title, url FROM Link WHERE url LIKE $1 AND channel IN ($2, '') AND network IN ($3, '')"
+	sqlInsert           = "INSERT INTO Link (user, url, title, channel, network, date) VALUES ($1, $2, $3, $4, $5, $6)"
 )
 
 var (
 	dbPtr        *sql.DB                                           // Database pointer
 	urlShortener = []string{"t.co", "bit.ly", "goo.gl", "buff.ly"} // URL shorteners base URL
 	zlibHosts    = []string{"twitter.com"}                         // Host that needs forced zlib decoding
+	// HTTP client used to get the pages' titles, its timeout applies when the request's context has no deadline
+	client = &http.Client{Timeout: 10 * time.Second}
 )
 
+func init() {
+	core.RegisterModule(module{})
+}
+
+// module implements core.Module for the webinfo package
+type module struct{}
+
+func (module) Name() string {
+	return "webinfo"
+}
+
+func (module) Init(dependencies *core.Dependencies) error {
+	Init(dependencies.DB)
+	return nil
+}
+
+func (module) Commands() []*core.Command {
+	return []*core.Command{GetTitleCommand(), GetURLCommand()}
+}
+
+func (module) MsgHandlers() []core.MsgHandler {
+	// The titles of the links sent in private are only given to their sender
+	return []core.MsgHandler{{Handler: HandleURLs}}
+}
+
+func (module) Subscriptions() []core.Subscription {
+	return nil
+}
+
+func (module) Shutdown() {}
+
 // GetTitleCommand returns a Command structure for the search by title command
 func GetTitleCommand() *core.Command {
 	return &core.Command{
 		Module:      "url",
-		HelpMessage: "!urlt <search terms>=> Return links with titles matching <search terms>",
-		Triggers:    []string{"!urlt"},
+		HelpMessage: "Return links with titles matching <search terms>",
+		Args:        []core.Arg{{Name: "search terms", Rest: true}},
+		Triggers:    []string{"urlt"},
 		Handler:     handleSearchTitlesCmd}
 }
 
@@ -53,8 +90,9 @@ func GetTitleCommand() *core.Command {
 func GetURLCommand() *core.Command {
 	return &core.Command{
 		Module:      "url",
-		HelpMessage: "!url <search terms>=> Return links with urls matching <search terms>",
-		Triggers:    []string{"!url"},
+		HelpMessage: "Return links with urls matching <search terms>",
+		Args:        []core.Arg{{Name: "search terms", Rest: true}},
+		Triggers:    []string{"url"},
 		Handler:     handleSearchUrlsCmd}
 }
 
@@ -63,10 +101,17 @@ func Init(db *sql.DB) {
 	dbPtr = db
 }
 
-// HandleURLs is a message handler that search for URLs in a message
-func HandleURLs(event *irc.Event, callback func(*core.ReplyCallbackData)) {
+// linkScope returns the scope of the links of an event: its channel, or the normalized nick of the sender for a private message.
+// The links posted in a channel are only visible in this channel, and the links sent in private only to their sender.
+func linkScope(event *core.Event) string {
+	if channel := core.GetChannelFromEvent(event); channel != "" {
+		return channel
+	}
+	return core.NormalizeNick(event, event.Nick)
+}
 
-	client := &http.Client{}
+// HandleURLs is a message handler that search for URLs in a message
+func HandleURLs(event *core.Event, callback func(*core.ReplyCallbackData)) error {
 
 	for _, currentURL := range findURLs(event.Message()) {
 
@@ -74,14 +119,14 @@ func HandleURLs(event *irc.Event, callback func(*core.ReplyCallbackData)) {
 
 		req, err := http.NewRequest("GET", currentURL.String(), nil)
 		if err != nil {
-			log.Fatalln(err)
+			return err
 		}
 		req.Header.Set("User-Agent", "Goxxx/1.0")
 
-		response, err := client.Do(req)
+		response, err := client.Do(req.WithContext(event.Context()))
 		if err != nil {
 			log.Println(err)
-			return
+			return nil
 		}
 		defer response.Body.Close()
 
@@ -99,14 +144,14 @@ func HandleURLs(event *irc.Event, callback func(*core.ReplyCallbackData)) {
 		doc, err := html.Parse(reader)
 		if err != nil {
 			log.Println(err)
-			return
+			return nil
 		}
 
 		var user, date string
 		// BUG(vaz-ar) Maybe not necessary to use Query + loop here, see if QueryRow can do the trick
-		rows, err := dbPtr.Query(sqlSelectExist, currentURL.String())
+		rows, err := dbPtr.Query(sqlSelectExist, currentURL.String(), linkScope(event), event.Network)
 		if err != nil {
-			log.Fatalf("%q: %s\n", err, sqlSelectExist)
+			return fmt.Errorf("%q: %s", err, sqlSelectExist)
 		}
 		defer rows.Close()
 
@@ -135,74 +180,67 @@ func HandleURLs(event *irc.Event, callback func(*core.ReplyCallbackData)) {
 
 		// If the link was not found we save it in the database along with the user that posted it and it's title
 		if user == "" {
-			_, err := dbPtr.Exec(sqlInsert, event.Nick, currentURL.String(), title)
+			_, err := dbPtr.Exec(sqlInsert, event.Nick, currentURL.String(), title, linkScope(event), event.Network, core.DBTime(event.Time))
 			if err != nil {
-				log.Fatalf("%q: %s\n", err, sqlInsert)
+				return fmt.Errorf("%q: %s", err, sqlInsert)
 			}
 		}
 	}
+	return nil
 }
 
 // handleSearchTitlesCmd is a command handler that search in the database for page titles matching a pattern
-func handleSearchTitlesCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1:]  => URL
-	if len(fields) < 2 {
-		return false
-	}
+func handleSearchTitlesCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
 	var (
 		user, date, title, url string
-		search                 = strings.Join(fields[1:], " ")
+		search                 = event.Args.String("search terms")
 	)
 	// BUG(vaz-ar) Maybe not necessary to use Query + loop here, see if QueryRow can do the trick
-	rows, err := dbPtr.Query(sqlSelectWhereTitle, "%"+search+"%")
+	rows, err := dbPtr.Query(sqlSelectWhereTitle, "%"+search+"%", linkScope(event), event.Network)
 	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlSelectWhereTitle)
+		return fmt.Errorf("%q: %s", err, sqlSelectWhereTitle)
 	}
 	defer rows.Close()
 
+	var results core.ResultSet
 	for rows.Next() {
 		rows.Scan(&user, &date, &title, &url)
 		if title == "" {
 			title = "No Title"
 		}
-		callback(&core.ReplyCallbackData{
-			Message: fmt.Sprintf(`Link found for "%s" => %s (%s) [Posted by %s, %s]`, search, title, url, user, date),
-			Target:  core.GetTargetFromEvent(event)})
+		results.Lines = append(results.Lines, fmt.Sprintf(`Link found for "%s" => %s (%s) [Posted by %s, %s]`, search, title, url, user, date))
 	}
-	return true
+	callback(&core.ReplyCallbackData{
+		Results: &results,
+		Target:  core.GetTargetFromEvent(event)})
+	return nil
 }
 
 // handleSearchUrlsCmd is a command handler that search in the database for url matching a pattern
-func handleSearchUrlsCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1:]  => URL
-	if len(fields) < 2 {
-		return false
-	}
+func handleSearchUrlsCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
 	var (
 		user, date, title, url string
-		search                 = strings.Join(fields[1:], " ")
+		search                 = event.Args.String("search terms")
 	)
 	// BUG(vaz-ar) Maybe not necessary to use Query + loop here, see if QueryRow can do the trick
-	rows, err := dbPtr.Query(sqlSelectWhereURL, "%"+search+"%")
+	rows, err := dbPtr.Query(sqlSelectWhereURL, "%"+search+"%", linkScope(event), event.Network)
 	if err != nil {
-		log.Fatalf("%q: %s\n", err, sqlSelectWhereURL)
+		return fmt.Errorf("%q: %s", err, sqlSelectWhereURL)
 	}
 	defer rows.Close()
 
+	var results core.ResultSet
 	for rows.Next() {
 		rows.Scan(&user, &date, &title, &url)
 		if title == "" {
 			title = "No Title"
 		}
-		callback(&core.ReplyCallbackData{
-			Message: fmt.Sprintf(`URLs matching "%s" => %s (%s) [Posted by %s, %s]`, search, title, url, user, date),
-			Target:  core.GetTargetFromEvent(event)})
+		results.Lines = append(results.Lines, fmt.Sprintf(`URLs matching "%s" => %s (%s) [Posted by %s, %s]`, search, title, url, user, date))
 	}
-	return true
+	callback(&core.ReplyCallbackData{
+		Results: &results,
+		Target:  core.GetTargetFromEvent(event)})
+	return nil
 }
 
 // Extract the title from an HTML page
@@ -240,8 +278,8 @@ func getTitleFromHTML(document *html.Node) (title string, found bool) {
 		return
 	}
 
-	// Retrieve the content inside the <title> and post-process it
-	title = strings.TrimSpace(child.FirstChild.Data)
+	// Retrieve the content inside the <title> and post-process it, the formatting is removed so that a page cannot format the bot's replies
+	title = strings.TrimSpace(format.Strip(child.FirstChild.Data))
 	// Replace every whitespaces or new lines sequence with a single whitespace
 	re := regexp.MustCompile("\\s+")
 	title = re.ReplaceAllString(title, " ")
@@ -7,11 +7,12 @@ package webinfo
 
 import (
 	"fmt"
-	"github.com/thoj/go-ircevent"
 	"github.com/vaz-ar/goxxx/core"
 	"github.com/vaz-ar/goxxx/database"
 	"golang.org/x/net/html"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"regexp"
 	"strings"
 	"testing"
@@ -37,11 +38,11 @@ var (
 
 	messageWithoutURL = "This is just.a.message without/any URL in.it"
 
-	validEvent = irc.Event{
+	validEvent = core.Event{
 		Nick:      expectedNick,
 		Arguments: []string{"#test_channel", messagesWithUrls[1]}} // -- 1
 
-	invalidEvent = irc.Event{
+	invalidEvent = core.Event{
 		Nick:      expectedNick,
 		Arguments: []string{"#test_channel", messageWithoutURL}}
 
@@ -154,3 +155,45 @@ func Test_HandleURLs(t *testing.T) {
 	}
 	// --- --- --- --- --- ---
 }
+
+func Test_HandleURLsScope(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		fmt.Fprint(writer, "<html><head><title>Private page</title></head><body></body></html>")
+	}))
+	defer server.Close()
+	db := database.NewDatabase("./tests.sqlite", "../../database/migrations", true)
+	defer db.Close()
+	Init(db)
+
+	// handle returns the replies to a message
+	handle := func(nick, target string) (replies []core.ReplyCallbackData) {
+		event := core.Event{Nick: nick, Network: "test_network", Arguments: []string{target, "Look at " + server.URL + "/page"}}
+		if err := HandleURLs(&event, func(data *core.ReplyCallbackData) { replies = append(replies, *data) }); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// A link sent in private is only known by its sender, and the title is sent back to the sender only
+	if replies := handle(expectedNick, "goxxx"); len(replies) != 1 || replies[0].Target != expectedNick || replies[0].Message != "Private page" {
+		t.Errorf("Unexpected replies to a private message: %#v", replies)
+	}
+	if replies := handle(expectedNick, "#test_channel"); len(replies) != 1 {
+		t.Errorf("Link sent in private known in a channel: %#v", replies)
+	}
+	if replies := handle("Other", "goxxx"); len(replies) != 1 {
+		t.Errorf("Link sent in private known by another user: %#v", replies)
+	}
+	if replies := handle(strings.ToUpper(expectedNick), "goxxx"); len(replies) != 2 || !re.MatchString(replies[0].Message) {
+		t.Errorf("Link sent in private not known by its sender: %#v", replies)
+	}
+	if replies := handle("Other", "#test_channel"); len(replies) != 2 {
+		t.Errorf("Link posted in a channel not known in the channel: %#v", replies)
+	}
+	if replies := handle("Other", "#other_channel"); len(replies) != 1 {
+		t.Errorf("Link posted in a channel known in another channel: %#v", replies)
+	}
+	if handlers := (module{}).MsgHandlers(); handlers[0].ReplyToAll {
+		t.Error("The titles of the links sent in private must not be sent to the channels")
+	}
+}
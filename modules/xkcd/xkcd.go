@@ -8,23 +8,29 @@
 package xkcd
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/thoj/go-ircevent"
 	"github.com/vaz-ar/goxxx/core"
+	"github.com/vaz-ar/goxxx/core/format"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
+	"time"
 )
 
 const (
 	urlWebsite    string = "https://xkcd.com/%d/"            // Website URL format string
 	urlJSON       string = "https://xkcd.com/%d/info.0.json" // JSON URL format string
 	urlLatestJSON string = "https://xkcd.com/info.0.json"    // JSON URL for the current comic
+
+	cooldown = 5 * time.Second // Time a user must wait before getting another comic
 )
 
+// HTTP client used to get the comics, its timeout applies when the request's context has no deadline
+var client = &http.Client{Timeout: 10 * time.Second}
+
 type xkcd struct {
 	Img   string `json:"img"`
 	Link  string `json:"link"`
@@ -32,18 +38,49 @@ type xkcd struct {
 	Title string `json:"title"`
 }
 
+func init() {
+	core.RegisterModule(module{})
+}
+
+// module implements core.Module for the xkcd package
+type module struct{}
+
+func (module) Name() string {
+	return "xkcd"
+}
+
+func (module) Init(dependencies *core.Dependencies) error {
+	return nil
+}
+
+func (module) Commands() []*core.Command {
+	return []*core.Command{GetCommand()}
+}
+
+func (module) MsgHandlers() []core.MsgHandler {
+	return nil
+}
+
+func (module) Subscriptions() []core.Subscription {
+	return nil
+}
+
+func (module) Shutdown() {}
+
 // GetCommand returns a Command structure for the XKCD command
 func GetCommand() *core.Command {
 	return &core.Command{
 		Module:      "xkcd",
-		HelpMessage: "!xkcd [<comic number>] => Return the XKCD comic corresponding to the number. If number is not specified, returns the last comic.",
-		Triggers:    []string{"!xkcd"},
+		HelpMessage: "Return the XKCD comic corresponding to the number. If number is not specified, returns the last comic.",
+		Triggers:    []string{"xkcd"},
+		Args:        []core.Arg{{Name: "comic number", Type: core.ArgInt, Optional: true}},
+		Cooldown:    cooldown,
 		Handler:     handleXKCDCmd}
 }
 
 // If number is superior to 0 attempt to get informations on the corresponding comic, else return the inforamtions for the current comic.
 // In case of error return nil
-func getComic(number int64) *xkcd {
+func getComic(ctx context.Context, number int64) *xkcd {
 	var url string
 	if number <= 0 {
 		// Get latest comic
@@ -53,7 +90,12 @@ func getComic(number int64) *xkcd {
 		url = fmt.Sprintf(urlJSON, number)
 	}
 
-	response, err := http.Get(url)
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	response, err := client.Do(request.WithContext(ctx))
 	if err != nil {
 		log.Println(err)
 		return nil
@@ -79,48 +121,35 @@ func getComic(number int64) *xkcd {
 }
 
 // handleXKCDCmd Handles XKCD commands
-func handleXKCDCmd(event *irc.Event, callback func(*core.ReplyCallbackData)) bool {
+func handleXKCDCmd(event *core.Event, callback func(*core.ReplyCallbackData)) error {
 	if callback == nil {
-		log.Println("Callback nil for the HandleXKCDCmd function")
-		return false
-	}
-
-	fields := strings.Fields(event.Message())
-	// fields[0]  => Command
-	// fields[1]  => Comic #
-
-	count := len(fields)
-	if count == 0 || fields[0] != "!xkcd" {
-		return false
+		return errors.New("no reply callback")
 	}
 
 	var message string
-	if count < 2 {
-		comic := getComic(0)
+	if !event.Args.Has("comic number") {
+		comic := getComic(event.Context(), 0)
 		if comic == nil {
-			log.Println("XKCD: No comic return by getComic")
-			return false
+			return errors.New("no comic returned by getComic")
 		}
-		message = fmt.Sprintf("Last XKCD Comic: %s => %s", comic.Title, comic.Link)
+		message = fmt.Sprintf("Last XKCD Comic: %s => %s", format.Bold(comic.Title), comic.Link)
 	} else {
-		number, err := strconv.ParseInt(fields[1], 10, 64)
-		if err != nil {
-			log.Println(err)
-			return false
+		number := int64(event.Args.Int("comic number"))
+		last := getComic(event.Context(), 0)
+		if last == nil {
+			return errors.New("no comic returned by getComic")
 		}
-
-		if number < 0 || getComic(0).Num < number {
+		if number < 0 || last.Num < number {
 			message = fmt.Sprintf("There is no XKCD comic #%d", number)
 		} else {
-			comic := getComic(number)
+			comic := getComic(event.Context(), number)
 			if comic == nil {
-				log.Println("XKCD: No comic return by getComic")
-				return false
+				return fmt.Errorf("no comic returned by getComic for #%d", number)
 			}
-			message = fmt.Sprintf("XKCD Comic #%d: %s => %s", comic.Num, comic.Title, comic.Link)
+			message = fmt.Sprintf("XKCD Comic #%d: %s => %s", comic.Num, format.Bold(comic.Title), comic.Link)
 		}
 	}
 	log.Println(message)
 	callback(&core.ReplyCallbackData{Message: message, Target: core.GetTargetFromEvent(event)})
-	return true
+	return nil
 }
@@ -6,9 +6,10 @@
 package xkcd
 
 import (
+	"context"
 	"fmt"
-	"github.com/thoj/go-ircevent"
 	"github.com/vaz-ar/goxxx/core"
+	"github.com/vaz-ar/goxxx/core/format"
 	"log"
 	"regexp"
 	"testing"
@@ -26,22 +27,22 @@ var (
 		Title: "Error Code"}
 
 	// IRC Events
-	validEvent = irc.Event{
+	validEvent = core.Event{
 		Nick:      "Sender",
-		Arguments: []string{"#test_channel", fmt.Sprintf(" \t  !xkcd   %d   ", expectedResult.Num)}}
+		Arguments: []string{"#test_channel", fmt.Sprintf(" \t  xkcd   %d   ", expectedResult.Num)}}
 
-	validEventLastComic = irc.Event{
+	validEventLastComic = core.Event{
 		Nick:      "Sender",
 		Arguments: []string{"#test_channel", "  !xkcd      "}}
 
-	validEventNoResult = irc.Event{
+	validEventNoResult = core.Event{
 		Nick:      "Sender",
 		Arguments: []string{"#test_channel", " \t  !xkcd    1000000000000000000"}}
 
 	// Reply structs
 	validReply = core.ReplyCallbackData{
 		Target:  "#test_channel",
-		Message: fmt.Sprintf("XKCD Comic #%d: %s => %s", expectedResult.Num, expectedResult.Title, expectedResult.Link)}
+		Message: fmt.Sprintf("XKCD Comic #%d: %s => %s", expectedResult.Num, format.Bold(expectedResult.Title), expectedResult.Link)}
 
 	validReplyNoResult = core.ReplyCallbackData{
 		Target:  "#test_channel",
@@ -50,11 +51,18 @@ var (
 	reValidReplyLastComic = regexp.MustCompile(`Last XKCD Comic: (\S+\s+)+=> \S+`)
 )
 
+func init() {
+	// The core parses the arguments before calling the handler
+	for _, event := range []*core.Event{&validEvent, &validEventLastComic, &validEventNoResult} {
+		event.Args, _ = GetCommand().Parse(event.Message())
+	}
+}
+
 // --- --- --- General --- --- ---
 func Test_getComic(t *testing.T) {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	comic := getComic(expectedResult.Num)
+	comic := getComic(context.Background(), expectedResult.Num)
 	if comic == nil {
 		t.Errorf("getComic: No data returned")
 	} else if *comic != expectedResult {